@@ -0,0 +1,188 @@
+// Package ack provides methods for tracking acknowledgements, sent by receivers, of messages relayed from controllers.
+package ack
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Delivered is the status reported when a receiver has successfully handled a message.
+const Delivered string = "delivered"
+
+// Failed is the status reported when a receiver failed to handle a message or did not acknowledge it in time.
+const Failed string = "failed"
+
+// type Acknowledgement is a struct that encapsulates a receiver's acknowledgement of a relayed message.
+type Acknowledgement struct {
+	// The unique ID of the message being acknowledged.
+	ID string `json:"id"`
+	// The status of the message. Valid options are "delivered" and "failed".
+	Status string `json:"status"`
+	// An optional explanation of the status.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Validate ensures that 'a' contains a message ID and a valid status.
+func (a *Acknowledgement) Validate() error {
+
+	if a.ID == "" {
+		return fmt.Errorf("Missing message ID")
+	}
+
+	switch a.Status {
+	case Delivered, Failed:
+		// pass
+	default:
+		return fmt.Errorf("Invalid status '%s'", a.Status)
+	}
+
+	return nil
+}
+
+// type Callback is a function that is invoked exactly once for each message tracked by a `Tracker`
+// instance, either when the message is acknowledged or when it times out.
+type Callback func(*Acknowledgement)
+
+type pending struct {
+	// The ID of the message assigned by the controller that sent it.
+	id       string
+	callback Callback
+	timer    *time.Timer
+}
+
+// type Tracker is a struct for tracking messages awaiting acknowledgement from a receiver. Messages are tracked using
+// a unique delivery ID, assigned by the tracker, rather than the ID chosen by the controller that sent them so that
+// controllers can not resolve (or collide with) each other's messages.
+type Tracker struct {
+	timeout time.Duration
+	pending map[string]*pending
+	mu      *sync.Mutex
+}
+
+// NewTracker returns a new `Tracker` instance where messages which have not been acknowledged
+// after 'timeout' are reported as failed.
+func NewTracker(timeout time.Duration) *Tracker {
+
+	t := &Tracker{
+		timeout: timeout,
+		pending: make(map[string]*pending),
+		mu:      new(sync.Mutex),
+	}
+
+	return t
+}
+
+// Add will start tracking message 'id' sent to 'room' and returns a new delivery ID which receivers must use to
+// acknowledge it. 'cb' will be invoked, with an `Acknowledgement` whose ID is 'id', when the message is acknowledged
+// or when it times out.
+func (t *Tracker) Add(room string, id string, cb Callback) (string, error) {
+
+	if id == "" {
+		return "", fmt.Errorf("Missing message ID")
+	}
+
+	delivery_id, err := newDeliveryID()
+
+	if err != nil {
+		return "", err
+	}
+
+	key := t.key(room, delivery_id)
+
+	on_timeout := func() {
+
+		a := &Acknowledgement{
+			ID:     delivery_id,
+			Status: Failed,
+			Reason: "timeout",
+		}
+
+		t.resolve(key, a)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[key] = &pending{
+		id:       id,
+		callback: cb,
+		timer:    time.AfterFunc(t.timeout, on_timeout),
+	}
+
+	return delivery_id, nil
+}
+
+// Acknowledge resolves the pending message in 'room' whose delivery ID matches 'a', invoking its callback. It returns
+// false if there is no matching message awaiting acknowledgement.
+func (t *Tracker) Acknowledge(room string, a *Acknowledgement) bool {
+	key := t.key(room, a.ID)
+	return t.resolve(key, a)
+}
+
+// Remove stops tracking the message with delivery ID 'delivery_id' in 'room' without invoking its callback.
+func (t *Tracker) Remove(room string, delivery_id string) {
+
+	key := t.key(room, delivery_id)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, exists := t.pending[key]
+
+	if !exists {
+		return
+	}
+
+	p.timer.Stop()
+	delete(t.pending, key)
+}
+
+func (t *Tracker) resolve(key string, a *Acknowledgement) bool {
+
+	t.mu.Lock()
+
+	p, exists := t.pending[key]
+
+	if exists {
+		p.timer.Stop()
+		delete(t.pending, key)
+	}
+
+	t.mu.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	// Report the acknowledgement using the ID assigned by the controller
+
+	controller_a := &Acknowledgement{
+		ID:     p.id,
+		Status: a.Status,
+		Reason: a.Reason,
+	}
+
+	p.callback(controller_a)
+	return true
+}
+
+func (t *Tracker) key(room string, id string) string {
+	return fmt.Sprintf("%s#%s", room, id)
+}
+
+// newDeliveryID returns a new random identifier for a tracked message.
+func newDeliveryID() (string, error) {
+
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create delivery ID, %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/http"
+	"github.com/sfomuseum/www-multiscreen-starter/sse"
+	"time"
+)
+
+// pruneAccessCodes will remove expired access codes from the server's database, according to the server's retention
+// policy, until 'ctx' is cancelled. If the retention policy has no interval this method returns immediately.
+func (s *Server) pruneAccessCodes(ctx context.Context) {
+
+	ttl := s.config.AccessCodeTTL
+	interval := s.retention.Interval()
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+
+			ts := now.Unix()
+			expires := ts - int64(ttl)
+
+			err := s.retention.Apply(ctx, s.store, expires)
+
+			if err != nil {
+				s.logger.Printf("Failed to prune access codes, %v", err)
+			}
+
+		}
+	}
+}
+
+// mintAccessCodes will create (and publish) a new access code for 'room' every (n) seconds, where (n) is
+// the access code TTL defined in the server's config, until 'ctx' is cancelled.
+func (s *Server) mintAccessCodes(ctx context.Context, room string) {
+
+	ttl := s.config.AccessCodeTTL
+
+	ticker := time.NewTicker(time.Duration(ttl) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+
+			err := s.mintAccessCode(ctx, room)
+
+			if err != nil {
+				s.logger.Printf("Failed to reset access code, %v", err)
+			}
+		}
+	}
+}
+
+// mintAccessCode creates (and publishes) a new access code for 'room' if the current access code has expired. When
+// several server instances share the same database only the instance holding the room's minting lease creates new
+// access codes, so that there is only ever one current access code for a room. The lease is renewed every time this
+// method is invoked and lasts for twice the access code TTL so that another instance will take over minting access
+// codes if the instance holding the lease stops.
+func (s *Server) mintAccessCode(ctx context.Context, room string) error {
+
+	ttl := s.config.AccessCodeTTL
+
+	now := time.Now()
+	ts := now.Unix()
+
+	leased, err := s.store.AcquireLease(ctx, mintLeaseName(room), s.id, ttl*2)
+
+	if err != nil {
+		return fmt.Errorf("Failed to acquire lease for room '%s', %w", room, err)
+	}
+
+	if !leased {
+		return nil
+	}
+
+	current_code, err := s.store.Current(ctx, room, ttl)
+
+	if err != nil {
+		s.logger.Printf("Unable to determine current access code for room '%s', %v", room, err)
+	}
+
+	if current_code != nil && current_code.Expires > ts {
+		s.logger.Printf("There is an unexpired access code (%d) already in use for room '%s'", current_code.Expires, room)
+		return nil
+	}
+
+	rc, err := s.publishAccessCode(ctx, room)
+
+	if err != nil {
+		return err
+	}
+
+	s.logger.Printf("Reset access code for room '%s' (expires %d)\n", room, rc.Expires)
+
+	// Let any controllers whose codes are no longer valid know right away
+
+	s.expireControllers(ctx, room)
+	return nil
+}
+
+// releaseMintLeases releases the minting leases held by the server for each room.
+func (s *Server) releaseMintLeases(ctx context.Context) error {
+
+	for _, room := range s.config.Rooms {
+
+		err := s.store.ReleaseLease(ctx, mintLeaseName(room), s.id)
+
+		if err != nil {
+			return fmt.Errorf("Failed to release lease for room '%s', %w", room, err)
+		}
+	}
+
+	return nil
+}
+
+// mintLeaseName returns the name of the lease used to coordinate minting access codes for 'room'.
+func mintLeaseName(room string) string {
+	return fmt.Sprintf("mint:%s", room)
+}
+
+// RotateAccessCode creates (and publishes) a new access code for 'room' and revokes all older access codes
+// for that room. Any controllers still using the older codes are sent an "expired" message and disconnected.
+func (s *Server) RotateAccessCode(ctx context.Context, room string) (*auth.RelayCode, error) {
+
+	if !s.isRoom(room) {
+		return nil, fmt.Errorf("Unknown room '%s'", room)
+	}
+
+	rc, err := s.publishAccessCode(ctx, room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.Revoke(ctx, rc)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to revoke previous access codes for room '%s', %w", room, err)
+	}
+
+	s.logger.Printf("Rotated access code for room '%s'\n", room)
+
+	s.expireControllers(ctx, room)
+	return rc, nil
+}
+
+// publishAccessCode creates a new access code for 'room' and publishes it to the room's receivers.
+func (s *Server) publishAccessCode(ctx context.Context, room string) (*auth.RelayCode, error) {
+
+	rc, err := s.newRelayCode(ctx, room)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new relay code for room '%s', %w", room, err)
+	}
+
+	msg := sse.NewAccessCodeMessage(room, rc)
+	err = msg.Publish(ctx, s.publisher)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to publish relay code for room '%s', %w", room, err)
+	}
+
+	return rc, nil
+}
+
+// newRelayCode creates (and stores) a new access code for 'room'. If the server has been configured with access code
+// secrets the access code will be signed, otherwise it will be created by the server's access code generator.
+func (s *Server) newRelayCode(ctx context.Context, room string) (*auth.RelayCode, error) {
+
+	if s.signer != nil {
+		return auth.NewSignedRelayCodeWithStore(ctx, s.store, s.signer, room, s.config.AccessCodeTTL)
+	}
+
+	return auth.NewRelayCodeWithStore(ctx, s.store, s.generator, room, s.config.AccessCodeTTL)
+}
+
+// expireControllers sends an "expired" message to, and closes the connection of, every controller in 'room' whose
+// access code is no longer valid.
+func (s *Server) expireControllers(ctx context.Context, room string) {
+
+	expire_opts := &http.ExpireControllersOptions{
+		Controllers: s.controllers,
+		Store:       s.store,
+		Signer:      s.signer,
+		Publisher:   s.publisher,
+		Logger:      s.logger,
+		Room:        room,
+		RevokedOnly: s.config.EnableControllerQueue,
+	}
+
+	count := http.ExpireControllers(ctx, expire_opts)
+
+	if count > 0 {
+		s.logger.Printf("Expired %d controller(s) in room '%s'\n", count, room)
+	}
+}
+
+// notifyAccessCodesChanged publishes a message notifying other server instances that the access codes for 'room'
+// have changed so that they can invalidate their access code caches.
+func (s *Server) notifyAccessCodesChanged(ctx context.Context, room string) error {
+
+	msg := sse.NewInvalidateCodesMessage(room, s.id)
+	return msg.Publish(ctx, s.publisher)
+}
+
+// interceptMessage invalidates the server's access code cache for messages published by other server instances
+// notifying them that the access codes for a room have changed. These messages are not dispatched to receivers.
+func (s *Server) interceptMessage(ctx context.Context, msg *sse.SSEMessage) bool {
+
+	if msg.Type != sse.InvalidateCodesMessageType {
+		return false
+	}
+
+	if s.cache == nil {
+		return true
+	}
+
+	data, ok := msg.Data.(map[string]interface{})
+
+	if ok && data["origin"] == s.id {
+		return true
+	}
+
+	s.cache.Invalidate(msg.Room)
+	return true
+}
+
+// isRoom returns a boolean value indicating whether 'room' is one of the rooms the server relays messages for.
+func (s *Server) isRoom(room string) bool {
+
+	for _, r := range s.config.Rooms {
+
+		if r == room {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/http"
+	"github.com/sfomuseum/www-multiscreen-starter/sse"
+	"io/fs"
+	"log"
+	gohttp "net/http"
+	"time"
+)
+
+// type Config is a struct containing configuration details for a `Server` instance.
+type Config struct {
+	// The host name to listen for requests on.
+	Host string
+	// The port number to listen for requests on.
+	Port int
+	// A valid sfomuseum/go-pubsub/publisher URI.
+	PublisherURI string
+	// A valid sfomuseum/go-pubsub/subscriber URI.
+	SubscriberURI string
+	// A valid auth.Store URI, for example a gocloud.dev/docstore or SQL database URI.
+	DatabaseURI string
+	// A valid `auth.AccessCodeGenerator` URI used to create new access codes.
+	AccessCodeGeneratorURI string
+	// An optional list of shared secrets used to sign and verify stateless access codes. The first secret is used to sign
+	// new access codes and all the secrets are used to verify them. If empty access codes are created using AccessCodeGeneratorURI.
+	AccessCodeSecrets []string
+	// The time-to-live in number of seconds for access codes.
+	AccessCodeTTL int
+	// An optional `auth.RetentionPolicy` URI used to remove expired access codes. If empty expired access codes are pruned
+	// periodically unless the database removes them itself.
+	AccessCodeRetentionURI string
+	// Enable an in-memory cache of the current and previous access codes for each room. Caches are invalidated across
+	// server instances using the publisher and subscriber defined by PublisherURI and SubscriberURI.
+	EnableAccessCodeCache bool
+	// The maximum number of invalid access codes a single client may send to a room, within AccessCodeFailureWindow, when
+	// access codes are PINs (created by a "pin://" generator). Once it is reached the client's access codes are no longer
+	// checked, even if it reconnects. Clients are identified by their address (see ClientAddressHeader). If zero there is no limit.
+	AccessCodeMaxFailures int
+	// The maximum number of invalid access codes the clients at a single address may send to all rooms, within
+	// AccessCodeFailureWindow, when access codes are PINs. If zero there is no limit.
+	AccessCodeMaxAddressFailures int
+	// The amount of time after the first invalid access code sent by a client during which AccessCodeMaxFailures and
+	// AccessCodeMaxAddressFailures apply.
+	AccessCodeFailureWindow time.Duration
+	// The name of a trusted HTTP header, set by the proxy or load balancer in front of the server, containing the address
+	// of each client (for example "X-Forwarded-For"). If empty the address of the connection is used. Do not set this
+	// unless the server is only reachable through a proxy which sets the header, since clients can send it themselves.
+	ClientAddressHeader string
+	// The number of seconds to allow SSE connections to stay open.
+	SSEHandlerTTL int
+	// The number of SSE messages retained for each room in order to replay them to receivers which reconnect with a
+	// "Last-Event-ID" header. This is not used if the subscriber retains messages itself (for example Redis Streams). If zero messages are not replayed.
+	SSEReplayBuffer int
+	// The list of rooms whose SSE messages are written as named events, with the message type as the "event:" field and its data
+	// as the "data:" field. If the list contains "*" all rooms use named events. Other rooms use the default "message" event.
+	SSENamedEventRooms []string
+	// The reconnection time sent to SSE clients when they connect. If zero no reconnection time is sent.
+	SSERetry time.Duration
+	// The amount of time to wait for a receiver to acknowledge a message before notifying the controller that it failed.
+	DeliveryTimeout time.Duration
+	// The amount of time a controller may go without sending a message before a "controllerIdle" event is published. If zero no idle events are published.
+	ControllerIdleThreshold time.Duration
+	// The amount of time during which a controller whose connection drops may resume its session over a new connection. Only
+	// controllers which negotiate JSON-encoded responses, or announce a protocol version, are sent resume tokens. If zero sessions cannot be resumed.
+	ControllerResumeGrace time.Duration
+	// Enable one-time access codes which may only be used by the first controller to send a message with them.
+	EnableOneTimeCodes bool
+	// Enable a turn-taking queue for controllers so that only one controller per room may relay messages at a time.
+	EnableControllerQueue bool
+	// The maximum amount of time a controller may remain active when the controller queue is enabled. If zero there is no limit.
+	ControllerMaxDuration time.Duration
+	// The maximum amount of time an active controller may go without sending a message when the controller queue is enabled. If zero there is no limit.
+	ControllerIdleTimeout time.Duration
+	// An optional filesystem (for example an embed.FS instance) containing a "{TYPE}.json" JSON Schema document for each
+	// message type controllers may relay. Messages of other types, or whose body fails validation, are rejected. If nil
+	// messages are not validated.
+	MessageSchemas fs.FS
+	// The shared secret receivers must present in order to publish their state or acknowledge messages. If empty a
+	// random secret is generated when the server is created. It is not logged but it can be retrieved using the
+	// `Server.ReceiverSecret` method.
+	ReceiverSecret string
+	// The list of room (installation) names to relay messages for.
+	Rooms []string
+	// Enable a /receiver endpoint on the web server. Used for debugging.
+	EnableReceiver bool
+	// The amount of time to allow for Websocket pong requests. Must be greater than zero.
+	PongWait time.Duration
+	// The amount of time to allow for Websocket ping requests. Must be greater than zero.
+	PingPeriod time.Duration
+	// The amount of time to allow Websocket write operations to complete. Must be greater than zero.
+	WriteWait time.Duration
+	// A custom "check origin" function to pass to the gorilla/websocket.Upgrader method.
+	CheckOrigin func(r *gohttp.Request) bool
+	// A valid *log.Logger instance. If nil then `log.Default()` will be used.
+	Logger *log.Logger
+}
+
+// DefaultConfig returns a `Config` instance with default values, equivalent to those defined by the `DefaultFlagSet` method.
+func DefaultConfig() *Config {
+
+	check_origin := func(req *gohttp.Request) bool {
+		return true
+	}
+
+	cfg := &Config{
+		Host:                         "localhost",
+		Port:                         8080,
+		PublisherURI:                 "mem://pubssed",
+		SubscriberURI:                "mem://pubssed",
+		DatabaseURI:                  "mem://access/Code",
+		AccessCodeGeneratorURI:       auth.DefaultAccessCodeGeneratorURI,
+		AccessCodeSecrets:            []string{},
+		AccessCodeTTL:                300,
+		AccessCodeRetentionURI:       "",
+		EnableAccessCodeCache:        false,
+		AccessCodeMaxFailures:        5,
+		AccessCodeMaxAddressFailures: 0,
+		AccessCodeFailureWindow:      10 * time.Minute,
+		ClientAddressHeader:          "",
+		SSEHandlerTTL:                1200,
+		SSEReplayBuffer:              sse.DefaultBufferSize,
+		SSENamedEventRooms:           []string{},
+		DeliveryTimeout:              10 * time.Second,
+		ControllerIdleThreshold:      30 * time.Second,
+		ControllerResumeGrace:        30 * time.Second,
+		EnableOneTimeCodes:           false,
+		EnableControllerQueue:        false,
+		ControllerMaxDuration:        180 * time.Second,
+		ControllerIdleTimeout:        60 * time.Second,
+		ReceiverSecret:               "",
+		Rooms:                        []string{auth.DefaultRoom},
+		EnableReceiver:               false,
+		PongWait:                     60 * time.Second,
+		PingPeriod:                   30 * time.Second, // (pong_wait * 9) / 10
+		WriteWait:                    30 * time.Second, // this is very long...
+		CheckOrigin:                  check_origin,
+		Logger:                       log.Default(),
+	}
+
+	return cfg
+}
+
+// Address returns the "{HOST}:{PORT}" address defined by 'cfg'.
+func (cfg *Config) Address() string {
+	return fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+}
+
+// Validate ensures that 'cfg' contains the minimum set of properties necessary to create a new `Server` instance.
+func (cfg *Config) Validate() error {
+
+	if cfg.AccessCodeGeneratorURI == "" {
+		return fmt.Errorf("Missing access code generator URI")
+	}
+
+	if cfg.AccessCodeTTL <= 0 {
+		return fmt.Errorf("Invalid access code TTL")
+	}
+
+	if cfg.AccessCodeMaxFailures < 0 {
+		return fmt.Errorf("Invalid access code max failures")
+	}
+
+	if cfg.AccessCodeMaxAddressFailures < 0 {
+		return fmt.Errorf("Invalid access code max address failures")
+	}
+
+	if (cfg.AccessCodeMaxFailures > 0 || cfg.AccessCodeMaxAddressFailures > 0) && cfg.AccessCodeFailureWindow <= 0 {
+		return fmt.Errorf("Invalid access code failure window")
+	}
+
+	if cfg.SSEHandlerTTL <= 0 {
+		return fmt.Errorf("Invalid SSE handler TTL")
+	}
+
+	if cfg.SSEReplayBuffer < 0 {
+		return fmt.Errorf("Invalid SSE replay buffer")
+	}
+
+	if cfg.DeliveryTimeout <= 0 {
+		return fmt.Errorf("Invalid delivery timeout")
+	}
+
+	if cfg.ControllerIdleThreshold < 0 {
+		return fmt.Errorf("Invalid controller idle threshold")
+	}
+
+	if cfg.ControllerResumeGrace < 0 {
+		return fmt.Errorf("Invalid controller resume grace")
+	}
+
+	if cfg.ControllerMaxDuration < 0 {
+		return fmt.Errorf("Invalid controller max duration")
+	}
+
+	if cfg.ControllerIdleTimeout < 0 {
+		return fmt.Errorf("Invalid controller idle timeout")
+	}
+
+	if len(cfg.Rooms) == 0 {
+		return fmt.Errorf("No rooms defined")
+	}
+
+	seen := make(map[string]bool)
+
+	for _, room := range cfg.Rooms {
+
+		if !http.IsValidRoom(room) {
+			return fmt.Errorf("Invalid room name '%s'", room)
+		}
+
+		if seen[room] {
+			return fmt.Errorf("Duplicate room name '%s'", room)
+		}
+
+		// The path for receiver websocket connections would be masked by the controller websocket path for this room
+
+		if "/ws/"+room == http.ReceiverWebsocketPrefix {
+			return fmt.Errorf("Room name '%s' is reserved", room)
+		}
+
+		seen[room] = true
+	}
+
+	for _, room := range cfg.SSENamedEventRooms {
+
+		if room != "*" && !seen[room] {
+			return fmt.Errorf("Unknown named event room '%s'", room)
+		}
+	}
+
+	if cfg.SSERetry < 0 {
+		return fmt.Errorf("Invalid SSE retry")
+	}
+
+	if cfg.PongWait <= 0 {
+		return fmt.Errorf("Invalid pong wait")
+	}
+
+	if cfg.PingPeriod <= 0 {
+		return fmt.Errorf("Invalid ping period")
+	}
+
+	if cfg.WriteWait <= 0 {
+		return fmt.Errorf("Invalid write wait")
+	}
+
+	return nil
+}
@@ -2,50 +2,367 @@ package server
 
 import (
 	"flag"
+	"fmt"
 	"github.com/sfomuseum/go-flags/flagset"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-// The host name to listen for requests on.
-var host string
+// DefaultFlagSet returns a `*flag.FlagSet` with default flags for starting to multiscreen webserver.
+func DefaultFlagSet() *flag.FlagSet {
 
-// The port number to listen for requests on.
-var port int
+	cfg := DefaultConfig()
 
-// A valid sfomuseum/go-pubsub/publisher URI.
-var publisher_uri string
+	fs := flagset.NewFlagSet("relay")
 
-// A valid sfomuseum/go-pubsub/publisher URI.
-var subscriber_uri string
+	fs.String("host", cfg.Host, "The host name to listen for requests on.")
+	fs.Int("port", cfg.Port, "The port number to listen for requests on.")
 
-// A valid gocloud.dev/docstore URI.
-var database_uri string
+	fs.String("publisher-uri", cfg.PublisherURI, "A valid sfomuseum/go-pubsub/publisher URI.")
+	fs.String("subscriber-uri", cfg.SubscriberURI, "A valid sfomuseum/go-pububs/subscriber URI.")
 
-// The time-to-live in number of seconds for access codes.
-var ttl int
+	fs.String("database-uri", cfg.DatabaseURI, "A valid auth.Store URI, for example a gocloud.dev/docstore or SQL database URI.")
 
-// The number of seconds to allow SSE connections to stay open.
-var sse_ttl int
+	fs.String("access-code-generator-uri", cfg.AccessCodeGeneratorURI, fmt.Sprintf("A valid auth.AccessCodeGenerator URI used to create new access codes. Valid schemes are: %s.", strings.Join(auth.AccessCodeGeneratorSchemes(), ", ")))
+	fs.String("access-code-secrets", strings.Join(cfg.AccessCodeSecrets, ","), "An optional comma-separated list of shared secrets used to sign and verify stateless access codes. The first secret is used to sign new access codes and all the secrets are used to verify them. If empty access codes are created using -access-code-generator-uri and validated using the database.")
+	fs.Int("access-code-ttl", cfg.AccessCodeTTL, "The time-to-live in number of seconds for access codes.")
+	fs.String("access-code-retention-uri", cfg.AccessCodeRetentionURI, fmt.Sprintf("An optional auth.RetentionPolicy URI used to remove expired access codes. If empty expired access codes are pruned every two hours unless the database removes them itself (for example DynamoDB tables with TimeToLive enabled). Valid schemes are: %s.", strings.Join(auth.RetentionPolicySchemes(), ", ")))
+	fs.Bool("enable-access-code-cache", cfg.EnableAccessCodeCache, "Enable an in-memory cache of the current and previous access codes for each room. Caches are invalidated across server instances using -publisher-uri and -subscriber-uri.")
+	fs.Int("access-code-max-failures", cfg.AccessCodeMaxFailures, "The maximum number of invalid access codes a single client may send to a room, within -access-code-failure-window, when -access-code-generator-uri is a pin:// URI. Once it is reached the client's access codes are no longer checked, even if it reconnects. Clients are identified by their IP address (see -client-address-header). If 0 there is no limit.")
+	fs.Int("access-code-max-address-failures", cfg.AccessCodeMaxAddressFailures, "The maximum number of invalid access codes the clients at a single IP address may send to all rooms, within -access-code-failure-window, when -access-code-generator-uri is a pin:// URI. If 0 there is no limit.")
+	fs.Int("access-code-failure-window", int(cfg.AccessCodeFailureWindow.Seconds()), "The number of seconds after the first invalid access code sent by a client during which -access-code-max-failures and -access-code-max-address-failures apply.")
+	fs.String("client-address-header", cfg.ClientAddressHeader, "The name of a trusted HTTP header, set by the proxy or load balancer in front of the server, containing the IP address of each client (for example \"X-Forwarded-For\"). If empty the address of the connection is used. Do not set this unless the server is only reachable through a proxy which sets the header, since clients can send it themselves.")
 
-// Enable a /receiver endpoint on the web server. Used for debugging.
-var enable_receiver bool
+	fs.Int("sse-handler-ttl", cfg.SSEHandlerTTL, "The number of seconds to allow SSE connections to stay open.")
+	fs.String("sse-named-event-rooms", strings.Join(cfg.SSENamedEventRooms, ","), "An optional comma-separated list of rooms whose SSE messages are written as named events, with the message type as the \"event:\" field and its data as the \"data:\" field. Use \"*\" for all rooms. Other rooms write JSON-encoded messages to the default \"message\" event.")
+	fs.Int("sse-retry", int(cfg.SSERetry.Milliseconds()), "The reconnection time, in milliseconds, sent to SSE clients when they connect. If 0 no reconnection time is sent.")
+	fs.Int("sse-replay-buffer", cfg.SSEReplayBuffer, "The number of SSE messages retained for each room in order to replay them to receivers which reconnect with a \"Last-Event-ID\" header. Receivers which have missed more messages are sent a \"reset\" message. Not used if the subscriber retains messages itself (for example Redis Streams). If 0 messages are not replayed.")
 
-// DefaultFlagSet returns a `*flag.FlagSet` with default flags for starting to multiscreen webserver.
-func DefaultFlagSet() *flag.FlagSet {
+	fs.Int("delivery-timeout", int(cfg.DeliveryTimeout.Seconds()), "The number of seconds to wait for a receiver to acknowledge a message (with an ID) before notifying the controller that it failed.")
 
-	fs := flagset.NewFlagSet("relay")
+	fs.Int("controller-idle-threshold", int(cfg.ControllerIdleThreshold.Seconds()), "The number of seconds a controller may go without sending a message before a \"controllerIdle\" event is published to the receiver. If 0 no idle events are published.")
 
-	fs.StringVar(&host, "host", "localhost", "The host name to listen for requests on.")
-	fs.IntVar(&port, "port", 8080, "The port number to listen for requests on.")
+	fs.Int("controller-resume-grace", int(cfg.ControllerResumeGrace.Seconds()), "The number of seconds during which a controller whose connection drops may resume its session over a new connection. Messages sent to the controller during this time are delivered when it resumes. Only controllers which request the \"multiscreen.v1\" WebSocket subprotocol, or announce a protocol version, are sent resume tokens. If 0 sessions cannot be resumed.")
 
-	fs.StringVar(&publisher_uri, "publisher-uri", "mem://pubssed", "A valid sfomuseum/go-pubsub/publisher URI.")
-	fs.StringVar(&subscriber_uri, "subscriber-uri", "mem://pubssed", "A valid sfomuseum/go-pububs/subscriber URI.")
+	fs.Bool("enable-one-time-codes", cfg.EnableOneTimeCodes, "Enable one-time access codes. The first controller to send a message with an access code claims it and is sent a session token. Other controllers using the same access code are sent a \"claimed\" message unless they include the session token.")
 
-	fs.StringVar(&database_uri, "database-uri", "mem://access/Code", "A valid gocloud.dev/docstore URI.")
+	fs.Bool("enable-controller-queue", cfg.EnableControllerQueue, "Enable a turn-taking queue so that only one controller per room may relay messages at a time. Other controllers wait in line and are promoted when the active controller's session ends.")
+	fs.Int("controller-max-duration", int(cfg.ControllerMaxDuration.Seconds()), "The maximum number of seconds a controller may remain active when the controller queue is enabled. If 0 there is no limit.")
+	fs.Int("controller-idle-timeout", int(cfg.ControllerIdleTimeout.Seconds()), "The maximum number of seconds an active controller may go without sending a message when the controller queue is enabled. If 0 there is no limit.")
 
-	fs.IntVar(&ttl, "access-code-ttl", 300, "The time-to-live in number of seconds for access codes.")
+	fs.String("message-schemas", "", "An optional path to a directory containing a \"{TYPE}.json\" JSON Schema document for each message type controllers may relay. Messages of other types, or whose body fails validation, are not relayed and the controller is sent a \"rejected\" message. If empty messages are not validated.")
 
-	fs.IntVar(&sse_ttl, "sse-handler-ttl", 1200, "The number of seconds to allow SSE connections to stay open.")
+	fs.String("receiver-secret", cfg.ReceiverSecret, "The shared secret receivers must present, as a bearer token in the \"Authorization\" header or a \"receiver_token\" query parameter, in order to publish their state or acknowledge messages. If empty a random secret, which is not logged, is generated when the server starts and receivers will not be able to publish their state or acknowledge messages.")
 
-	fs.BoolVar(&enable_receiver, "enable-receiver", false, "Enable a /receiver endpoint on the web server. Used for debugging.")
+	fs.String("rooms", strings.Join(cfg.Rooms, ","), "A comma-separated list of room (installation) names to relay messages for. Each room has its own access codes and is available at /sse/{room}, /ws/{room} and /code/{room}. Requests without a room are handled by the \"default\" room.")
+
+	fs.Bool("enable-receiver", cfg.EnableReceiver, "Enable a /receiver endpoint on the web server. Used for debugging.")
 	return fs
 }
+
+// ConfigFromFlagSet returns a new `Config` instance derived from the (parsed) flags in 'fs'.
+func ConfigFromFlagSet(fs *flag.FlagSet) (*Config, error) {
+
+	cfg := DefaultConfig()
+
+	var err error
+
+	cfg.Host, err = stringFlag(fs, "host")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Port, err = intFlag(fs, "port")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.PublisherURI, err = stringFlag(fs, "publisher-uri")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SubscriberURI, err = stringFlag(fs, "subscriber-uri")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.DatabaseURI, err = stringFlag(fs, "database-uri")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessCodeGeneratorURI, err = stringFlag(fs, "access-code-generator-uri")
+
+	if err != nil {
+		return nil, err
+	}
+
+	str_secrets, err := stringFlag(fs, "access-code-secrets")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessCodeSecrets = parseList(str_secrets)
+
+	cfg.AccessCodeTTL, err = intFlag(fs, "access-code-ttl")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessCodeRetentionURI, err = stringFlag(fs, "access-code-retention-uri")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.EnableAccessCodeCache, err = boolFlag(fs, "enable-access-code-cache")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessCodeMaxFailures, err = intFlag(fs, "access-code-max-failures")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessCodeMaxAddressFailures, err = intFlag(fs, "access-code-max-address-failures")
+
+	if err != nil {
+		return nil, err
+	}
+
+	access_code_failure_window, err := intFlag(fs, "access-code-failure-window")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessCodeFailureWindow = time.Duration(access_code_failure_window) * time.Second
+
+	cfg.ClientAddressHeader, err = stringFlag(fs, "client-address-header")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SSEHandlerTTL, err = intFlag(fs, "sse-handler-ttl")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SSEReplayBuffer, err = intFlag(fs, "sse-replay-buffer")
+
+	if err != nil {
+		return nil, err
+	}
+
+	str_named_event_rooms, err := stringFlag(fs, "sse-named-event-rooms")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SSENamedEventRooms = parseList(str_named_event_rooms)
+
+	sse_retry, err := intFlag(fs, "sse-retry")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SSERetry = time.Duration(sse_retry) * time.Millisecond
+
+	delivery_timeout, err := intFlag(fs, "delivery-timeout")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.DeliveryTimeout = time.Duration(delivery_timeout) * time.Second
+
+	controller_idle_threshold, err := intFlag(fs, "controller-idle-threshold")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ControllerIdleThreshold = time.Duration(controller_idle_threshold) * time.Second
+
+	controller_resume_grace, err := intFlag(fs, "controller-resume-grace")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ControllerResumeGrace = time.Duration(controller_resume_grace) * time.Second
+
+	cfg.EnableOneTimeCodes, err = boolFlag(fs, "enable-one-time-codes")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.EnableControllerQueue, err = boolFlag(fs, "enable-controller-queue")
+
+	if err != nil {
+		return nil, err
+	}
+
+	controller_max_duration, err := intFlag(fs, "controller-max-duration")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ControllerMaxDuration = time.Duration(controller_max_duration) * time.Second
+
+	controller_idle_timeout, err := intFlag(fs, "controller-idle-timeout")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ControllerIdleTimeout = time.Duration(controller_idle_timeout) * time.Second
+
+	message_schemas, err := stringFlag(fs, "message-schemas")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if message_schemas != "" {
+
+		abs_path, err := filepath.Abs(message_schemas)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to derive absolute path for -message-schemas, %w", err)
+		}
+
+		cfg.MessageSchemas = os.DirFS(abs_path)
+	}
+
+	cfg.ReceiverSecret, err = stringFlag(fs, "receiver-secret")
+
+	if err != nil {
+		return nil, err
+	}
+
+	str_rooms, err := stringFlag(fs, "rooms")
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Rooms = parseList(str_rooms)
+
+	cfg.EnableReceiver, err = boolFlag(fs, "enable-receiver")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// parseList splits the comma-separated values in 'str' in to a list of unique, non-empty values.
+func parseList(str string) []string {
+
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, v := range strings.Split(str, ",") {
+
+		v = strings.TrimSpace(v)
+
+		if v == "" || seen[v] {
+			continue
+		}
+
+		seen[v] = true
+		values = append(values, v)
+	}
+
+	return values
+}
+
+func lookupFlag(fs *flag.FlagSet, name string) (interface{}, error) {
+
+	fl := fs.Lookup(name)
+
+	if fl == nil {
+		return nil, fmt.Errorf("Missing -%s flag", name)
+	}
+
+	getter, ok := fl.Value.(flag.Getter)
+
+	if !ok {
+		return nil, fmt.Errorf("Unable to derive value for -%s flag", name)
+	}
+
+	return getter.Get(), nil
+}
+
+func stringFlag(fs *flag.FlagSet, name string) (string, error) {
+
+	v, err := lookupFlag(fs, name)
+
+	if err != nil {
+		return "", err
+	}
+
+	str_v, ok := v.(string)
+
+	if !ok {
+		return "", fmt.Errorf("Invalid value for -%s flag", name)
+	}
+
+	return str_v, nil
+}
+
+func intFlag(fs *flag.FlagSet, name string) (int, error) {
+
+	v, err := lookupFlag(fs, name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	int_v, ok := v.(int)
+
+	if !ok {
+		return 0, fmt.Errorf("Invalid value for -%s flag", name)
+	}
+
+	return int_v, nil
+}
+
+func boolFlag(fs *flag.FlagSet, name string) (bool, error) {
+
+	v, err := lookupFlag(fs, name)
+
+	if err != nil {
+		return false, err
+	}
+
+	bool_v, ok := v.(bool)
+
+	if !ok {
+		return false, fmt.Errorf("Invalid value for -%s flag", name)
+	}
+
+	return bool_v, nil
+}
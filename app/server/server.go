@@ -1,2 +1,731 @@
 // Package server provides a HTTP server implementing the multiscreen webserver for brokering requests between a controller device (over WebSockets) and receiver device (over ServerSent Events)
 package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/cors"
+	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/go-pubsub/subscriber"
+	"github.com/sfomuseum/www-multiscreen-starter/ack"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/http"
+	"github.com/sfomuseum/www-multiscreen-starter/hub"
+	"github.com/sfomuseum/www-multiscreen-starter/sse"
+	"github.com/sfomuseum/www-multiscreen-starter/static/controller"
+	"github.com/sfomuseum/www-multiscreen-starter/static/receiver"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"log"
+	gohttp "net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// type Server is a struct that implements the multiscreen webserver. It can be embedded in other
+// applications by using its `Handler` method or started as a standalone webserver using its
+// `ListenAndServe` method.
+type Server struct {
+	config      *Config
+	logger      *log.Logger
+	publisher   publisher.Publisher
+	subscriber  subscriber.Subscriber
+	id          string
+	store       auth.Store
+	cache       *auth.CachedStore
+	retention   auth.RetentionPolicy
+	generator   auth.AccessCodeGenerator
+	signer      *auth.Signer
+	broker      *sse.RoomsBroker
+	acks        *ack.Tracker
+	controllers *hub.Hub
+	queues      map[string]*hub.Queue
+	messages    *ws.Registry
+	// The throttles for invalid access codes sent from each address, and from each client address to a room. These
+	// are only defined if access codes are PINs.
+	throttle        *auth.Throttle
+	client_throttle *auth.Throttle
+	// The shared secret receivers must present in order to publish their state or acknowledge messages.
+	receiver_secret string
+	handler         gohttp.Handler
+	mu              *sync.Mutex
+	cancel          context.CancelFunc
+}
+
+// New returns a new `Server` instance derived from 'cfg'. The server will not relay messages
+// or mint new access codes until its `Start` method is invoked.
+func New(ctx context.Context, cfg *Config) (*Server, error) {
+
+	err := cfg.Validate()
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config, %w", err)
+	}
+
+	logger := cfg.Logger
+
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	// A unique identifier for this server instance, used to coordinate with other instances sharing the same database
+
+	id, err := auth.NewAccessCode()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create server ID, %w", err)
+	}
+
+	s := &Server{
+		id:     id,
+		config: cfg,
+		logger: logger,
+		mu:     new(sync.Mutex),
+	}
+
+	ws_pub, err := publisher.NewPublisher(ctx, cfg.PublisherURI)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new publisher for '%s', %w", cfg.PublisherURI, err)
+	}
+
+	s.publisher = ws_pub
+
+	sse_sub, err := subscriber.NewSubscriber(ctx, cfg.SubscriberURI)
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to create subscriber for '%s', %w", cfg.SubscriberURI, err)
+	}
+
+	s.subscriber = sse_sub
+
+	// Set up the auth.Store for storing access tokens
+
+	store, err := auth.NewStore(ctx, cfg.DatabaseURI)
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to create access codes database for '%s', %w", cfg.DatabaseURI, err)
+	}
+
+	s.store = store
+
+	// Cache the current access codes, if necessary. Other server instances are notified when the access codes
+	// for a room change using the same publisher and subscriber used to relay messages to receivers.
+
+	if cfg.EnableAccessCodeCache {
+
+		s.cache = auth.NewCachedStore(store)
+		s.cache.Notify = s.notifyAccessCodesChanged
+		s.cache.Logger = logger
+
+		s.store = s.cache
+	}
+
+	// Set up the policy for removing expired access codes
+
+	retention, err := auth.NewRetentionPolicyForStore(ctx, cfg.AccessCodeRetentionURI, s.store)
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to create access code retention policy, %w", err)
+	}
+
+	s.retention = retention
+
+	// Set up the generator for new access codes
+
+	gen, err := auth.NewAccessCodeGenerator(ctx, cfg.AccessCodeGeneratorURI)
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to create access code generator for '%s', %w", cfg.AccessCodeGeneratorURI, err)
+	}
+
+	s.generator = gen
+
+	// Set up the signer for stateless access codes, if necessary
+
+	if len(cfg.AccessCodeSecrets) > 0 {
+
+		signer, err := auth.NewSigner(cfg.AccessCodeSecrets)
+
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Failed to create access code signer, %w", err)
+		}
+
+		s.signer = signer
+	}
+
+	// Throttle invalid access codes if they are PINs, which are short enough to be guessed by trying every
+	// possible code. Signed access codes are not created by the generator so they are not throttled.
+
+	_, is_pin := gen.(*auth.PINAccessCodeGenerator)
+
+	if is_pin && s.signer == nil {
+
+		if cfg.AccessCodeMaxFailures > 0 {
+			s.client_throttle = auth.NewThrottle(cfg.AccessCodeMaxFailures, cfg.AccessCodeFailureWindow)
+		}
+
+		if cfg.AccessCodeMaxAddressFailures > 0 {
+			s.throttle = auth.NewThrottle(cfg.AccessCodeMaxAddressFailures, cfg.AccessCodeFailureWindow)
+		}
+	}
+
+	// SSE endpoint - this is where the target (iPad) will listen for updates
+	// See notes above about "publishers" and Redis
+
+	sse_broker, err := sse.NewRoomsBroker(cfg.Rooms)
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to create SSE broker, %w", err)
+	}
+
+	sse_broker.Logger = logger
+	sse_broker.BufferSize = cfg.SSEReplayBuffer
+	sse_broker.NamedEventRooms = cfg.SSENamedEventRooms
+	sse_broker.Retry = cfg.SSERetry
+	sse_broker.Intercept = s.interceptMessage
+
+	s.broker = sse_broker
+
+	// Messages awaiting acknowledgement from a receiver
+
+	s.acks = ack.NewTracker(cfg.DeliveryTimeout)
+
+	// Controllers connected to the server, used to relay messages from receivers
+
+	s.controllers = hub.NewHub()
+
+	// Turn-taking queues for the controllers in each room
+
+	if cfg.EnableControllerQueue {
+
+		s.queues = make(map[string]*hub.Queue)
+
+		for _, room := range cfg.Rooms {
+			s.queues[room] = s.newControllerQueue(room)
+		}
+	}
+
+	// The message types controllers may relay and the JSON Schemas used to validate them
+
+	if cfg.MessageSchemas != nil {
+
+		messages, err := ws.NewRegistry(cfg.MessageSchemas)
+
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Failed to load message schemas, %w", err)
+		}
+
+		logger.Printf("Validating message types: %s", strings.Join(messages.Types(), ", "))
+		s.messages = messages
+	}
+
+	// The shared secret receivers must present in order to publish their state or acknowledge messages
+
+	s.receiver_secret = cfg.ReceiverSecret
+
+	if s.receiver_secret == "" {
+
+		secret, err := http.NewReceiverSecret()
+
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		// The secret is a credential so it is never logged. Applications embedding the server can retrieve
+		// it using the ReceiverSecret method.
+
+		logger.Printf("Receiver secret not defined, using a random secret (not logged)")
+		s.receiver_secret = secret
+	}
+
+	handler, err := s.newHandler()
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to create handler, %w", err)
+	}
+
+	s.handler = handler
+	return s, nil
+}
+
+// Handler returns the `http.Handler` instance for all the multiscreen webserver endpoints.
+func (s *Server) Handler() gohttp.Handler {
+	return s.handler
+}
+
+// Publisher returns the `publisher.Publisher` instance used to relay messages to receivers.
+func (s *Server) Publisher() publisher.Publisher {
+	return s.publisher
+}
+
+// Store returns the `auth.Store` instance used to store access codes.
+func (s *Server) Store() auth.Store {
+	return s.store
+}
+
+// ReceiverSecret returns the shared secret receivers must present in order to publish their state or acknowledge
+// messages. This is the secret generated when the server was created if the config did not define one.
+func (s *Server) ReceiverSecret() string {
+	return s.receiver_secret
+}
+
+// Start will prune expired access codes, mint a new access code for each room and start the background
+// processes used to relay messages and refresh access codes. These processes will run until 'ctx' is
+// cancelled or the `Close` method is invoked.
+func (s *Server) Start(ctx context.Context) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return fmt.Errorf("Server has already been started")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	err := s.start(ctx)
+
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	s.cancel = cancel
+	return nil
+}
+
+func (s *Server) start(ctx context.Context) error {
+
+	// Prune all previous access code
+
+	now := time.Now()
+	ts := now.Unix()
+
+	err := s.retention.Apply(ctx, s.store, ts)
+
+	if err != nil {
+		return fmt.Errorf("Failed to prune access codes, %w", err)
+	}
+
+	// Create a new access code for each room, if necessary, and start a timer to refresh them every (n) seconds
+
+	for _, room := range s.config.Rooms {
+
+		err = s.mintAccessCode(ctx, room)
+
+		if err != nil {
+			return fmt.Errorf("Failed to create new relay code for room '%s', %w", room, err)
+		}
+	}
+
+	err = s.broker.Start(ctx, s.subscriber, auth.DefaultRoom)
+
+	if err != nil {
+		return fmt.Errorf("Failed to start SSE broker, %w", err)
+	}
+
+	// Set up a time to prune old access codes in the background
+
+	go s.pruneAccessCodes(ctx)
+
+	// Set up a timer to mint new access codes for each room in the background
+
+	for _, room := range s.config.Rooms {
+		go s.mintAccessCodes(ctx, room)
+	}
+
+	return nil
+}
+
+// ListenAndServe will start the server's background processes, if necessary, and then listen for HTTP requests
+// on the address defined by the server's config until 'ctx' is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+
+	s.mu.Lock()
+	started := s.cancel != nil
+	s.mu.Unlock()
+
+	if !started {
+
+		err := s.Start(ctx)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	addr := s.config.Address()
+
+	http_server := &gohttp.Server{
+		Addr:    addr,
+		Handler: s.handler,
+	}
+
+	go func() {
+
+		<-ctx.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		http_server.Shutdown(ctx)
+	}()
+
+	s.logger.Printf("Listening on %s\n", addr)
+	err := http_server.ListenAndServe()
+
+	if err != nil && !errors.Is(err, gohttp.ErrServerClosed) {
+		return fmt.Errorf("Failed to serve requests, %w", err)
+	}
+
+	return nil
+}
+
+// Close will stop the server's background processes and close its publisher, subscriber and database connections.
+func (s *Server) Close() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := make([]error, 0)
+
+	if s.cancel != nil {
+
+		s.cancel()
+
+		// Let other server instances take over minting access codes right away
+
+		err := s.releaseMintLeases(context.Background())
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.publisher != nil {
+
+		err := s.publisher.Close()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to close publisher, %w", err))
+		}
+	}
+
+	if s.subscriber != nil {
+
+		err := s.subscriber.Close()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to close subscriber, %w", err))
+		}
+	}
+
+	if s.store != nil {
+
+		err := s.store.Close()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to close database, %w", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// newHandler returns a new `http.Handler` instance for all the multiscreen webserver endpoints.
+func (s *Server) newHandler() (gohttp.Handler, error) {
+
+	// Start building the HTTP endpoints
+
+	mux := gohttp.NewServeMux()
+
+	sse_handler_ttl := time.Duration(s.config.SSEHandlerTTL) * time.Second
+
+	c := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+	})
+
+	ws_handlers := make(map[string]gohttp.Handler)
+	receiver_ws_handlers := make(map[string]gohttp.Handler)
+	relay_handlers := make(map[string]gohttp.Handler)
+	sse_handlers := make(map[string]gohttp.Handler)
+	code_handlers := make(map[string]gohttp.Handler)
+	ack_handlers := make(map[string]gohttp.Handler)
+	state_handlers := make(map[string]gohttp.Handler)
+
+	for _, room := range s.config.Rooms {
+
+		ws_opts := &http.WebsocketHandlerOptions{
+			Publisher:                s.publisher,
+			Store:                    s.store,
+			Signer:                   s.signer,
+			PingPeriod:               s.config.PingPeriod,
+			PongWait:                 s.config.PongWait,
+			WriteWait:                s.config.WriteWait,
+			Logger:                   s.logger,
+			CheckOrigin:              s.config.CheckOrigin,
+			Room:                     room,
+			Acknowledgements:         s.acks,
+			Controllers:              s.controllers,
+			Queue:                    s.queues[room],
+			IdleThreshold:            s.config.ControllerIdleThreshold,
+			OneTimeCodes:             s.config.EnableOneTimeCodes,
+			ResumeGrace:              s.config.ControllerResumeGrace,
+			Messages:                 s.messages,
+			AccessCodeThrottle:       s.throttle,
+			ClientAccessCodeThrottle: s.client_throttle,
+			ClientAddressHeader:      s.config.ClientAddressHeader,
+		}
+
+		ws_handler, err := http.WebsocketHandler(ws_opts)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create websocket handler for room '%s', %w", room, err)
+		}
+
+		ws_handlers[room] = ws_handler
+
+		receiver_ws_opts := &http.ReceiverWebsocketHandlerOptions{
+			Broker:           s.broker,
+			Acknowledgements: s.acks,
+			Controllers:      s.controllers,
+			Store:            s.store,
+			Signer:           s.signer,
+			PingPeriod:       s.config.PingPeriod,
+			PongWait:         s.config.PongWait,
+			WriteWait:        s.config.WriteWait,
+			Logger:           s.logger,
+			CheckOrigin:      s.config.CheckOrigin,
+			Room:             room,
+			ReceiverSecret:   s.receiver_secret,
+		}
+
+		receiver_ws_handler, err := http.ReceiverWebsocketHandler(receiver_ws_opts)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create receiver websocket handler for room '%s', %w", room, err)
+		}
+
+		receiver_ws_handlers[room] = receiver_ws_handler
+
+		relay_opts := &http.RelayHandlerOptions{
+			Publisher:                s.publisher,
+			Store:                    s.store,
+			Signer:                   s.signer,
+			Logger:                   s.logger,
+			Room:                     room,
+			Acknowledgements:         s.acks,
+			Controllers:              s.controllers,
+			Queue:                    s.queues[room],
+			IdleThreshold:            s.config.ControllerIdleThreshold,
+			OneTimeCodes:             s.config.EnableOneTimeCodes,
+			Messages:                 s.messages,
+			AccessCodeThrottle:       s.throttle,
+			ClientAccessCodeThrottle: s.client_throttle,
+			ClientAddressHeader:      s.config.ClientAddressHeader,
+		}
+
+		relay_handler, err := http.RelayHandler(relay_opts)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create relay handler for room '%s', %w", room, err)
+		}
+
+		relay_handlers[room] = relay_handler
+
+		sse_handler, err := s.broker.HandlerFuncWithTimeout(room, &sse_handler_ttl)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create SSE handler for room '%s', %w", room, err)
+		}
+
+		// Note the part where we need to explicitly type the
+		// result as a HandlerFunc - I wish rs/cors just did
+		// this for us but it doesn't.
+
+		sse_handlers[room] = c.Handler(sse_handler).(gohttp.HandlerFunc)
+
+		code_opts := &http.AccessCodeHandlerOptions{
+			Store:     s.store,
+			Publisher: s.publisher,
+			Logger:    s.logger,
+			TTL:       s.config.AccessCodeTTL,
+			Room:      room,
+		}
+
+		code_handler, err := http.AccessCodeHandler(code_opts)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create access code handler for room '%s', %w", room, err)
+		}
+
+		code_handlers[room] = c.Handler(code_handler).(gohttp.HandlerFunc)
+
+		ack_opts := &http.AcknowledgementHandlerOptions{
+			Acknowledgements: s.acks,
+			Logger:           s.logger,
+			Room:             room,
+			ReceiverSecret:   s.receiver_secret,
+		}
+
+		ack_handler, err := http.AcknowledgementHandler(ack_opts)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create acknowledgement handler for room '%s', %w", room, err)
+		}
+
+		ack_handlers[room] = c.Handler(ack_handler).(gohttp.HandlerFunc)
+
+		state_opts := &http.StateHandlerOptions{
+			Controllers:    s.controllers,
+			Store:          s.store,
+			Signer:         s.signer,
+			Logger:         s.logger,
+			Room:           room,
+			ReceiverSecret: s.receiver_secret,
+		}
+
+		state_handler, err := http.StateHandler(state_opts)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create state handler for room '%s', %w", room, err)
+		}
+
+		state_handlers[room] = c.Handler(state_handler).(gohttp.HandlerFunc)
+	}
+
+	ws_handler, err := http.RoomsHandler("/ws/", ws_handlers, auth.DefaultRoom)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create websocket rooms handler, %w", err)
+	}
+
+	mux.Handle("/ws/", ws_handler)
+
+	// Receiver websocket endpoint - this is an alternative to the SSE endpoint for receivers which also
+	// want to send messages (acknowledgements and state) over the same connection
+
+	receiver_ws_handler, err := http.RoomsHandler(http.ReceiverWebsocketPrefix, receiver_ws_handlers, auth.DefaultRoom)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create receiver websocket rooms handler, %w", err)
+	}
+
+	mux.Handle(http.ReceiverWebsocketPrefix, receiver_ws_handler)
+	mux.Handle(http.ReceiverWebsocketPrefix+"/", receiver_ws_handler)
+
+	// Relay endpoint - this is where controllers which can not use WebSockets send updates and poll for responses
+
+	relay_handler, err := http.RoomsHandler("/relay/", relay_handlers, auth.DefaultRoom)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create relay rooms handler, %w", err)
+	}
+
+	mux.Handle("/relay/", relay_handler)
+
+	sse_handler, err := http.RoomsHandler("/sse/", sse_handlers, auth.DefaultRoom)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create SSE rooms handler, %w", err)
+	}
+
+	mux.Handle("/sse/", sse_handler)
+
+	code_handler, err := http.RoomsHandler("/code/", code_handlers, auth.DefaultRoom)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create access code rooms handler, %w", err)
+	}
+
+	mux.Handle("/code/", code_handler)
+
+	// Acknowledgement endpoint - this is where the receiver reports whether it handled a message
+
+	ack_handler, err := http.RoomsHandler("/ack/", ack_handlers, auth.DefaultRoom)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create acknowledgement rooms handler, %w", err)
+	}
+
+	mux.Handle("/ack/", ack_handler)
+
+	// State endpoint - this is where the receiver publishes its current state to controllers
+
+	state_handler, err := http.RoomsHandler("/state/", state_handlers, auth.DefaultRoom)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create state rooms handler, %w", err)
+	}
+
+	mux.Handle("/state/", state_handler)
+
+	// Controller (index) webpage
+
+	http_fs := gohttp.FS(controller.FS)
+	fs_handler := gohttp.FileServer(http_fs)
+
+	mux.Handle("/", fs_handler)
+
+	// Receiver webpage
+
+	if s.config.EnableReceiver {
+
+		http_fs := gohttp.FS(receiver.FS)
+		fs_handler := gohttp.FileServer(http_fs)
+		fs_handler = gohttp.StripPrefix("/receiver", fs_handler)
+
+		mux.Handle("/receiver/", fs_handler)
+	}
+
+	return mux, nil
+}
+
+// newControllerQueue returns a new `hub.Queue` instance for 'room' which notifies controllers of their status over
+// their WebSocket connection and publishes "controllerChanged" events to the room's receivers.
+func (s *Server) newControllerQueue(room string) *hub.Queue {
+
+	on_status := func(c hub.Controller, position int, reason string) {
+
+		msg := ws.NewQueueMessage(position, reason)
+		err := c.Send(context.Background(), msg)
+
+		if err != nil {
+			s.logger.Printf("Failed to send queue status to controller '%s' in room '%s', %v", c.ID(), room, err)
+		}
+	}
+
+	on_change := func(active string, waiting int) {
+
+		msg := sse.NewControllerChangedMessage(room, active, waiting)
+		err := msg.Publish(context.Background(), s.publisher)
+
+		if err != nil {
+			s.logger.Printf("Failed to publish controller change for room '%s', %v", room, err)
+		}
+	}
+
+	opts := &hub.QueueOptions{
+		MaxDuration: s.config.ControllerMaxDuration,
+		IdleTimeout: s.config.ControllerIdleTimeout,
+		OnStatus:    on_status,
+		OnChange:    on_change,
+	}
+
+	return hub.NewQueue(opts)
+}
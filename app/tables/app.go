@@ -0,0 +1,108 @@
+// tables implements the relay-tables tool for managing the database tables used to store access codes.
+package tables
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/sfomuseum/go-flags/flagset"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"log"
+	"os"
+)
+
+// Run will manage the tables used to store access codes using the flagset defined by the `DefaultFlagSet` method.
+func Run(ctx context.Context, logger *log.Logger) error {
+	fs := DefaultFlagSet()
+	return RunWithFlagSet(ctx, fs, logger)
+}
+
+// Run will manage the tables used to store access codes using 'fs'. Flags may also be set using environment variables
+// with the same "RELAY" prefix as the server so that both tools can share the same -database-uri configuration.
+func RunWithFlagSet(ctx context.Context, fs *flag.FlagSet, logger *log.Logger) error {
+
+	flagset.Parse(fs)
+
+	err := flagset.SetFlagsFromEnvVars(fs, "RELAY")
+
+	if err != nil {
+		return fmt.Errorf("Failed to set flags from env vars, %v", err)
+	}
+
+	database_uri, err := stringFlag(fs, "database-uri")
+
+	if err != nil {
+		return err
+	}
+
+	confirm, err := boolFlag(fs, "confirm")
+
+	if err != nil {
+		return err
+	}
+
+	args := fs.Args()
+
+	if len(args) != 1 {
+		fs.Usage()
+		return fmt.Errorf("Missing or invalid command")
+	}
+
+	command := args[0]
+
+	switch command {
+	case CreateCommand, DescribeCommand, MigrateCommand:
+		// pass
+	case DropCommand:
+
+		if !confirm {
+			return fmt.Errorf("The %s command requires the -confirm flag", command)
+		}
+
+	default:
+		return fmt.Errorf("Invalid command '%s'", command)
+	}
+
+	m, err := auth.NewTableManager(ctx, database_uri)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create table manager, %w", err)
+	}
+
+	defer m.Close()
+
+	switch command {
+	case CreateCommand:
+		err = m.Create(ctx)
+	case MigrateCommand:
+		err = m.Migrate(ctx)
+	case DropCommand:
+		err = m.Drop(ctx)
+	case DescribeCommand:
+
+		descriptions, err := m.Describe(ctx)
+
+		if err != nil {
+			return fmt.Errorf("Failed to describe tables, %w", err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+
+		err = enc.Encode(descriptions)
+
+		if err != nil {
+			return fmt.Errorf("Failed to encode table descriptions, %w", err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to %s tables, %w", command, err)
+	}
+
+	logger.Printf("Finished %s command for tables", command)
+	return nil
+}
@@ -0,0 +1,90 @@
+package tables
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sfomuseum/go-flags/flagset"
+	"github.com/sfomuseum/www-multiscreen-starter/app/server"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"os"
+	"strings"
+)
+
+// The commands supported by the relay-tables tool.
+const (
+	CreateCommand   string = "create"
+	DescribeCommand string = "describe"
+	MigrateCommand  string = "migrate"
+	DropCommand     string = "drop"
+)
+
+// DefaultFlagSet returns a `*flag.FlagSet` with default flags for managing the tables used to store access codes.
+func DefaultFlagSet() *flag.FlagSet {
+
+	cfg := server.DefaultConfig()
+
+	fs := flagset.NewFlagSet("relay-tables")
+
+	fs.String("database-uri", cfg.DatabaseURI, fmt.Sprintf("A valid auth.TableManager URI. This is the same URI passed to the server's -database-uri flag. Valid schemes are: %s.", strings.Join(auth.TableManagerSchemes(), ", ")))
+	fs.Bool("confirm", false, "Confirm that the tables (and all the access codes they contain) should be dropped. Required by the \"drop\" command.")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Create, describe, migrate or drop the database tables used to store access codes.\n")
+		fmt.Fprintf(os.Stderr, "Usage:\n\t %s [options] create|describe|migrate|drop\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Valid options are:\n")
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func lookupFlag(fs *flag.FlagSet, name string) (interface{}, error) {
+
+	fl := fs.Lookup(name)
+
+	if fl == nil {
+		return nil, fmt.Errorf("Missing -%s flag", name)
+	}
+
+	getter, ok := fl.Value.(flag.Getter)
+
+	if !ok {
+		return nil, fmt.Errorf("Unable to derive value for -%s flag", name)
+	}
+
+	return getter.Get(), nil
+}
+
+func stringFlag(fs *flag.FlagSet, name string) (string, error) {
+
+	v, err := lookupFlag(fs, name)
+
+	if err != nil {
+		return "", err
+	}
+
+	str_v, ok := v.(string)
+
+	if !ok {
+		return "", fmt.Errorf("Invalid value for -%s flag", name)
+	}
+
+	return str_v, nil
+}
+
+func boolFlag(fs *flag.FlagSet, name string) (bool, error) {
+
+	v, err := lookupFlag(fs, name)
+
+	if err != nil {
+		return false, err
+	}
+
+	bool_v, ok := v.(bool)
+
+	if !ok {
+		return false, fmt.Errorf("Invalid value for -%s flag", name)
+	}
+
+	return bool_v, nil
+}
@@ -3,16 +3,21 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/aaronland/go-string/random"
 	"gocloud.dev/docstore"
 	"io"
 	_ "log"
 	"time"
 )
 
+// DefaultRoom is the name of the room used when a request does not specify one.
+const DefaultRoom string = "default"
+
 // type RelayCode is a struct that encapsulates information about an access token (code).
 type RelayCode struct {
+	// The name of the room (installation) the code is valid for.
+	Room string `json:"room"`
 	// The Unix timestamp when the code was created.
 	Created int64 `json:"created"`
 	// The Unix timestamp when the code was last updated.
@@ -21,15 +26,34 @@ type RelayCode struct {
 	Expires int64 `json:"expires"`
 	// A unique access code.
 	Code string `json:"code"`
+	// The Unix timestamp when the code was revoked, or zero if it has not been revoked.
+	Revoked int64 `json:"revoked,omitempty"`
+	// The Unix timestamp when the code was superseded by a newer code which is in use, or zero if it has not been
+	// superseded. This is only recorded for signed access codes.
+	Superseded int64 `json:"superseded,omitempty"`
+	// The SHA-256 hash of the session token for the controller that claimed the code, or an empty string if the
+	// code has not been claimed. This is only recorded for one-time access codes.
+	Session string `json:"-"`
+	// The document revision used by gocloud.dev/docstore for optimistic locking.
+	DocstoreRevision interface{} `json:"-"`
 }
 
-// CurrentRelayCodeWithCollection returns the most create `RelayCode` from 'col' whose creation time is greater than 'ttl'.
+// CurrentRelayCodeWithCollection returns the most create `RelayCode` for the default room from 'col' whose creation time is greater than 'ttl'.
+//
+// Deprecated: Use the `Current` method of an `auth.Store` instance, for example one returned by
+// `NewDocstoreAccessCodeStoreWithCollection`, instead.
 func CurrentRelayCodeWithCollection(ctx context.Context, col *docstore.Collection, ttl int) (*RelayCode, error) {
+	return currentRelayCodeWithCollection(ctx, col, DefaultRoom, ttl)
+}
+
+// currentRelayCodeWithCollection returns the most create `RelayCode` for 'room' from 'col' whose creation time is greater than 'ttl'.
+func currentRelayCodeWithCollection(ctx context.Context, col *docstore.Collection, room string, ttl int) (*RelayCode, error) {
 
 	now := time.Now()
 	ts := now.Unix()
 
 	q := col.Query()
+	q = q.Where("Room", "=", room)
 	q = q.Where("Created", ">", ts-int64(ttl))
 
 	// query requires a table scan, but has an ordering requirement; add an index or provide Options.RunQueryFallback (code=Unimplemented)
@@ -52,28 +76,61 @@ func CurrentRelayCodeWithCollection(ctx context.Context, col *docstore.Collectio
 	return &rc, nil
 }
 
-// NewRelayCodeWithCollection creates (and returns) a new `RelayCode` instance in 'col'.
-func NewRelayCodeWithCollection(ctx context.Context, col *docstore.Collection, ttl int) (*RelayCode, error) {
+// The maximum number of times to try creating a new access code which doesn't collide with an existing access code.
+const maxNewRelayCodeAttempts int = 10
 
-	rc, err := NewRelayCode(ttl)
+// NewRelayCodeWithStore creates (and returns) a new `RelayCode` instance for 'room' in 'store' using 'gen' to
+// generate the access code. If 'gen' generates a code which already exists in 'store' a new code will be generated.
+func NewRelayCodeWithStore(ctx context.Context, store Store, gen AccessCodeGenerator, room string, ttl int) (*RelayCode, error) {
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create new relay code, %w", err)
-	}
+	for i := 0; i < maxNewRelayCodeAttempts; i++ {
 
-	err = col.Put(ctx, rc)
+		rc, err := NewRelayCodeWithGenerator(ctx, gen, room, ttl)
 
-	if err != nil {
-		return nil, fmt.Errorf("Failed to store new relay code, %w", err)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create new relay code, %w", err)
+		}
+
+		err = store.Put(ctx, rc)
+
+		if err == nil {
+			return rc, nil
+		}
+
+		if !errors.Is(err, ErrCodeExists) {
+			return nil, fmt.Errorf("Failed to store new relay code, %w", err)
+		}
 	}
 
-	return rc, nil
+	return nil, fmt.Errorf("Failed to create a unique relay code after %d attempts", maxNewRelayCodeAttempts)
 }
 
-// NewRelayCode creates a new `RelayCode` with an expiry date 'ttl' seconds from the current time.
+// NewRelayCodeWithCollection creates (and returns) a new `RelayCode` instance for the default room in 'col' using the
+// default random access code generator.
+//
+// Deprecated: Use `NewRelayCodeWithStore` with an `auth.Store` instance, for example one returned by
+// `NewDocstoreAccessCodeStoreWithCollection`, instead.
+func NewRelayCodeWithCollection(ctx context.Context, col *docstore.Collection, ttl int) (*RelayCode, error) {
+
+	store := NewDocstoreAccessCodeStoreWithCollection(col)
+	gen := &RandomAccessCodeGenerator{length: 16}
+
+	return NewRelayCodeWithStore(ctx, store, gen, DefaultRoom, ttl)
+}
+
+// NewRelayCode creates a new `RelayCode` for the default room with an expiry date 'ttl' seconds from the current time using the default random access code generator.
 func NewRelayCode(ttl int) (*RelayCode, error) {
 
-	code, err := NewAccessCode()
+	ctx := context.Background()
+	gen := &RandomAccessCodeGenerator{length: 16}
+
+	return NewRelayCodeWithGenerator(ctx, gen, DefaultRoom, ttl)
+}
+
+// NewRelayCodeWithGenerator creates a new `RelayCode` for 'room', using 'gen' to generate the access code, with an expiry date 'ttl' seconds from the current time.
+func NewRelayCodeWithGenerator(ctx context.Context, gen AccessCodeGenerator, room string, ttl int) (*RelayCode, error) {
+
+	code, err := gen.Generate(ctx)
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create new access code, %w", err)
@@ -84,6 +141,7 @@ func NewRelayCode(ttl int) (*RelayCode, error) {
 	expires := created + int64(ttl)
 
 	r := &RelayCode{
+		Room:    room,
 		Code:    code,
 		Created: created,
 		Expires: expires,
@@ -92,12 +150,11 @@ func NewRelayCode(ttl int) (*RelayCode, error) {
 	return r, nil
 }
 
-// Return a new unique access code.
+// Return a new unique access code using the default random access code generator.
 func NewAccessCode() (string, error) {
 
-	opts := random.DefaultOptions()
-	opts.Length = 16
-	opts.AlphaNumeric = true
+	ctx := context.Background()
+	gen := &RandomAccessCodeGenerator{length: 16}
 
-	return random.String(opts)
+	return gen.Generate(ctx)
 }
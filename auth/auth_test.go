@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"context"
+	"gocloud.dev/docstore/memdocstore"
+	"testing"
+)
+
+func TestRelayCodeWithCollection(t *testing.T) {
+
+	ctx := context.Background()
+
+	col, err := memdocstore.OpenCollection("Code", nil)
+
+	if err != nil {
+		t.Fatalf("Failed to create collection, %v", err)
+	}
+
+	defer col.Close()
+
+	// The deprecated collection methods keep their original signatures and use the default room
+
+	rc, err := NewRelayCodeWithCollection(ctx, col, 300)
+
+	if err != nil {
+		t.Fatalf("Failed to create relay code, %v", err)
+	}
+
+	if rc.Room != DefaultRoom || rc.Expires-rc.Created != 300 {
+		t.Fatalf("Expected relay code for the default room with a TTL of 300 seconds, got %v", rc)
+	}
+
+	current_code, err := CurrentRelayCodeWithCollection(ctx, col, 300)
+
+	if err != nil || current_code == nil || current_code.Code != rc.Code {
+		t.Fatalf("Expected current code to be '%s', got %v (%v)", rc.Code, current_code, err)
+	}
+
+	new_code, err := NewRelayCode(300)
+
+	if err != nil || new_code.Room != DefaultRoom || new_code.Code == "" {
+		t.Fatalf("Expected new relay code for the default room, got %v (%v)", new_code, err)
+	}
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+	"io"
+)
+
+// ErrClaimedCode is returned when a one-time access code has already been claimed by another controller.
+var ErrClaimedCode = errors.New("Claimed access code")
+
+// ClaimRelayCode claims 'rc', which is expected to have been retrieved from 'store', for a single controller session
+// and returns a new session token for that controller. Only the SHA-256 hash of the session token is stored. If 'rc'
+// has already been claimed, including by a concurrent request, the error returned will wrap `ErrClaimedCode`.
+func ClaimRelayCode(ctx context.Context, store Store, rc *RelayCode) (string, error) {
+
+	if rc.Session != "" {
+		return "", fmt.Errorf("%w, code has already been claimed", ErrClaimedCode)
+	}
+
+	token, err := newSessionToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	err = store.Claim(ctx, rc, hashSessionToken(token))
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// VerifyRelayCodeSession returns a boolean value indicating whether 'token' is the session token for the controller
+// that claimed 'rc'.
+func VerifyRelayCodeSession(rc *RelayCode, token string) bool {
+
+	if rc.Session == "" || token == "" {
+		return false
+	}
+
+	session := hashSessionToken(token)
+	return subtle.ConstantTimeCompare([]byte(session), []byte(rc.Session)) == 1
+}
+
+// hashSessionToken returns the hex-encoded SHA-256 hash of 'token'.
+func hashSessionToken(token string) string {
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSessionToken returns a new random session token.
+func newSessionToken() (string, error) {
+
+	b := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, b)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create session token, %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// claimRelayCodeWithCollection records 'session' as the session token for 'rc' in 'col'.
+func claimRelayCodeWithCollection(ctx context.Context, col *docstore.Collection, rc *RelayCode, session string) error {
+
+	if rc.Session != "" {
+		return fmt.Errorf("%w, code has already been claimed", ErrClaimedCode)
+	}
+
+	// Note that 'rc' (including its revision) is passed to col.Update rather than a new RelayCode
+	// instance with only its Code property set. This ensures that the update will fail if 'rc' has
+	// been updated, for example because it was claimed by another controller, since it was retrieved.
+
+	mod := docstore.Mods{"Session": session}
+	err := col.Update(ctx, rc, mod)
+
+	if err != nil {
+
+		if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+			return fmt.Errorf("%w, code was claimed by another controller", ErrClaimedCode)
+		}
+
+		return fmt.Errorf("Failed to claim code, %w", err)
+	}
+
+	rc.Session = session
+	return nil
+}
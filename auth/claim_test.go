@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClaimRelayCode(t *testing.T) {
+
+	for name, store := range newTestLeaseStores(t) {
+
+		store := store
+
+		t.Run(name, func(t *testing.T) {
+
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			putTestCode(t, store, DefaultRoom, "a", 0)
+
+			rc, err := store.Get(ctx, "a")
+
+			if err != nil {
+				t.Fatalf("Failed to get code, %v", err)
+			}
+
+			// A copy of the code retrieved before it is claimed, as though by a concurrent request
+
+			stale, err := store.Get(ctx, "a")
+
+			if err != nil {
+				t.Fatalf("Failed to get code, %v", err)
+			}
+
+			token, err := ClaimRelayCode(ctx, store, rc)
+
+			if err != nil {
+				t.Fatalf("Failed to claim code, %v", err)
+			}
+
+			if token == "" {
+				t.Fatalf("Expected claim to return a session token")
+			}
+
+			// Only the hash of the token is stored
+
+			claimed, err := store.Get(ctx, "a")
+
+			if err != nil {
+				t.Fatalf("Failed to get code, %v", err)
+			}
+
+			if claimed.Session == "" || claimed.Session == token {
+				t.Fatalf("Expected the hash of the session token to be stored, got '%s'", claimed.Session)
+			}
+
+			if !VerifyRelayCodeSession(claimed, token) {
+				t.Fatalf("Expected session token to verify")
+			}
+
+			for _, other := range []string{"", "not-the-token", token + "x"} {
+
+				if VerifyRelayCodeSession(claimed, other) {
+					t.Fatalf("Expected session token '%s' not to verify", other)
+				}
+			}
+
+			// The code can only be claimed once, whether or not the controller knows it has already been claimed
+
+			_, err = ClaimRelayCode(ctx, store, claimed)
+
+			if !errors.Is(err, ErrClaimedCode) {
+				t.Fatalf("Expected second claim to return ErrClaimedCode, got %v", err)
+			}
+
+			_, err = ClaimRelayCode(ctx, store, stale)
+
+			if !errors.Is(err, ErrClaimedCode) {
+				t.Fatalf("Expected concurrent claim to return ErrClaimedCode, got %v", err)
+			}
+
+			claimed, err = store.Get(ctx, "a")
+
+			if err != nil {
+				t.Fatalf("Failed to get code, %v", err)
+			}
+
+			if !VerifyRelayCodeSession(claimed, token) {
+				t.Fatalf("Expected the first session token to remain valid after a failed claim")
+			}
+
+			// Codes which have not been claimed have no session
+
+			putTestCode(t, store, DefaultRoom, "b", 0)
+
+			unclaimed, err := store.Get(ctx, "b")
+
+			if err != nil {
+				t.Fatalf("Failed to get code, %v", err)
+			}
+
+			if VerifyRelayCodeSession(unclaimed, token) {
+				t.Fatalf("Expected session token not to verify for an unclaimed code")
+			}
+		})
+	}
+}
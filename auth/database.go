@@ -4,10 +4,6 @@ import (
 	"context"
 	"fmt"
 	aa_dynamodb "github.com/aaronland/go-aws-dynamodb"
-	aa_session "github.com/aaronland/go-aws-session"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"gocloud.dev/docstore"
 	"gocloud.dev/docstore/awsdynamodb"
 	"io"
@@ -26,8 +22,9 @@ func NewAccessCodesDatabase(ctx context.Context, database_uri string) (*docstore
 	}
 
 	// We need to special-case dynamodb stuff in order to account for queries
-	// queries with ordering requirements. Table definitions are handled in
-	// cmd/dynamodb_tables/main.go
+	// queries with ordering requirements. Tables are only created if the URI
+	// contains a ?create-tables=true parameter; otherwise they are expected to
+	// have been created using the cmd/relay-tables tool (or TableManager).
 
 	if db_u.Scheme == "awsdynamodb" {
 
@@ -40,45 +37,30 @@ func NewAccessCodesDatabase(ctx context.Context, database_uri string) (*docstore
 		db_q := db_u.Query()
 
 		partition_key := db_q.Get("partition_key")
-		region := db_q.Get("region")
-		endpoint := db_q.Get("endpoint")
 
-		credentials := db_q.Get("credentials")
-
-		cfg, err := aa_session.NewConfigWithCredentialsAndRegion(credentials, region)
+		create_tables, err := createTablesQueryParameter(db_q)
 
 		if err != nil {
-			return nil, fmt.Errorf("Failed to create new session for credentials '%s', %w", credentials, err)
-		}
-
-		if endpoint != "" {
-			cfg.Endpoint = aws.String(endpoint)
+			return nil, err
 		}
 
-		sess, err := session.NewSession(cfg)
+		client, err := aa_dynamodb.NewClientWithURI(ctx, database_uri)
 
 		if err != nil {
-			return nil, fmt.Errorf("Failed to create AWS session, %w", err)
+			return nil, fmt.Errorf("Failed to create DynamoDB client, %w", err)
 		}
 
-		// START OF create dynamodb tables if necessary
-		// Unfortunately there's nothing about creating tables in the Go Cloud abstractions
+		if create_tables {
 
-		client := dynamodb.New(sess)
-
-		table_opts := &aa_dynamodb.CreateTablesOptions{
-			Tables:  DynamoDBTables,
-			Refresh: false,
-		}
+			m := NewDynamoDBTableManagerWithClient(client, table)
 
-		err = aa_dynamodb.CreateTables(client, table_opts)
+			err = m.Create(ctx)
 
-		if err != nil {
-			return nil, fmt.Errorf("Failed to create DynamoDB tables, %w", err)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		// END OF create dynamodb tables if necessary
-
 		// START OF necessary for order by created/lastupdate dates
 		// https://pkg.go.dev/gocloud.dev@v0.23.0/docstore/awsdynamodb#InMemorySortFallback
 
@@ -95,9 +77,14 @@ func NewAccessCodesDatabase(ctx context.Context, database_uri string) (*docstore
 
 		// END OF necessary for order by created/lastupdate dates
 
-		col, err := awsdynamodb.OpenCollection(dynamodb.New(sess), table, partition_key, "", opts)
+		col, err := awsdynamodb.OpenCollection(client, table, partition_key, "", opts)
 
 		if err != nil {
+
+			if isDynamoDBResourceNotFound(err) {
+				return nil, fmt.Errorf("Failed to open collection, table '%s' does not exist (create it using cmd/relay-tables or the ?create-tables=true parameter), %w", table, err)
+			}
+
 			return nil, fmt.Errorf("Failed to open collection, %w", err)
 		}
 
@@ -1,13 +1,21 @@
 package auth
 
 import (
+	"context"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
+// The default name of the DynamoDB table used to store access codes. This is also the key for the access codes table
+// definitions in `DynamoDBTables` and `DynamoDBTimeToLive`.
+const DefaultDynamoDBAccessCodesTable string = "AccessCodes"
+
 // DynamoDBTables is a map whose keys are DynamoDB table names and whose values are `dynamodb.CreateTableInput` instances.
+// Use the `DynamoDBAccessCodesTables` method to derive definitions for an access codes table with a different name.
 var DynamoDBTables = map[string]*dynamodb.CreateTableInput{
-	"AccessCodes": &dynamodb.CreateTableInput{
+	DefaultDynamoDBAccessCodesTable: &dynamodb.CreateTableInput{
 		KeySchema: []*dynamodb.KeySchemaElement{
 			{
 				AttributeName: aws.String("Code"),
@@ -19,6 +27,10 @@ var DynamoDBTables = map[string]*dynamodb.CreateTableInput{
 				AttributeName: aws.String("Code"),
 				AttributeType: aws.String("S"),
 			},
+			{
+				AttributeName: aws.String("Room"),
+				AttributeType: aws.String("S"),
+			},
 			{
 				AttributeName: aws.String("LastUpdate"),
 				AttributeType: aws.String("N"),
@@ -33,6 +45,22 @@ var DynamoDBTables = map[string]*dynamodb.CreateTableInput{
 			},
 		},
 		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("room"),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{
+						AttributeName: aws.String("Room"),
+						KeyType:       aws.String("HASH"),
+					},
+					{
+						AttributeName: aws.String("Created"),
+						KeyType:       aws.String("RANGE"),
+					},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: aws.String("ALL"),
+				},
+			},
 			{
 				IndexName: aws.String("updated"),
 				KeySchema: []*dynamodb.KeySchemaElement{
@@ -83,6 +111,127 @@ var DynamoDBTables = map[string]*dynamodb.CreateTableInput{
 			},
 		},
 		BillingMode: aws.String("PAY_PER_REQUEST"),
-		// TableName:   set inline below
+		// TableName:   set by DynamoDBAccessCodesTables
+	},
+}
+
+// DynamoDBTimeToLive is a map whose keys are DynamoDB table names and whose values are `dynamodb.TimeToLiveSpecification`
+// instances. DynamoDB's native TimeToLive feature is used to remove access codes once their expiry date has passed, rather
+// than scanning the table for expired access codes.
+var DynamoDBTimeToLive = map[string]*dynamodb.TimeToLiveSpecification{
+	DefaultDynamoDBAccessCodesTable: &dynamodb.TimeToLiveSpecification{
+		AttributeName: aws.String("Expires"),
+		Enabled:       aws.Bool(true),
 	},
 }
+
+// DynamoDBAccessCodesTables returns copies of the access codes table definitions in `DynamoDBTables` and `DynamoDBTimeToLive`
+// keyed by 'table_name', which is typically the host of an "awsdynamodb://" URI. If 'table_name' is empty the default
+// "AccessCodes" table name is used.
+func DynamoDBAccessCodesTables(table_name string) (map[string]*dynamodb.CreateTableInput, map[string]*dynamodb.TimeToLiveSpecification) {
+
+	if table_name == "" {
+		table_name = DefaultDynamoDBAccessCodesTable
+	}
+
+	table_def := *DynamoDBTables[DefaultDynamoDBAccessCodesTable]
+	table_def.TableName = aws.String(table_name)
+
+	ttl_spec := *DynamoDBTimeToLive[DefaultDynamoDBAccessCodesTable]
+
+	tables := map[string]*dynamodb.CreateTableInput{
+		table_name: &table_def,
+	}
+
+	specs := map[string]*dynamodb.TimeToLiveSpecification{
+		table_name: &ttl_spec,
+	}
+
+	return tables, specs
+}
+
+// DynamoDBTimeToLiveEnabled returns a boolean value indicating whether TimeToLive is enabled (or being enabled) for 'table_name'.
+func DynamoDBTimeToLiveEnabled(ctx context.Context, client DynamoDBTimeToLiveClient, table_name string) (bool, error) {
+
+	describe_ttl := &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(table_name),
+	}
+
+	rsp, err := client.DescribeTimeToLiveWithContext(ctx, describe_ttl)
+
+	if err != nil {
+		return false, fmt.Errorf("Failed to describe time to live for table '%s', %w", table_name, err)
+	}
+
+	desc := rsp.TimeToLiveDescription
+
+	if desc == nil {
+		return false, nil
+	}
+
+	switch aws.StringValue(desc.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// type DynamoDBTimeToLiveClient is an interface defining the subset of the DynamoDB API used to enable TimeToLive for tables.
+// It is satisfied by `dynamodb.DynamoDB` and can be implemented by test doubles.
+type DynamoDBTimeToLiveClient interface {
+	WaitUntilTableExistsWithContext(aws.Context, *dynamodb.DescribeTableInput, ...request.WaiterOption) error
+	DescribeTimeToLiveWithContext(aws.Context, *dynamodb.DescribeTimeToLiveInput, ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLiveWithContext(aws.Context, *dynamodb.UpdateTimeToLiveInput, ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+// EnableDynamoDBTimeToLive enables TimeToLive for each of the tables in 'specs', waiting for newly created tables to become
+// active first. Tables whose TimeToLive is already enabled (or being enabled) for the same attribute are left unchanged.
+func EnableDynamoDBTimeToLive(ctx context.Context, client DynamoDBTimeToLiveClient, specs map[string]*dynamodb.TimeToLiveSpecification) error {
+
+	for table_name, spec := range specs {
+
+		describe_table := &dynamodb.DescribeTableInput{
+			TableName: aws.String(table_name),
+		}
+
+		err := client.WaitUntilTableExistsWithContext(ctx, describe_table)
+
+		if err != nil {
+			return fmt.Errorf("Failed to wait for table '%s', %w", table_name, err)
+		}
+
+		describe_ttl := &dynamodb.DescribeTimeToLiveInput{
+			TableName: aws.String(table_name),
+		}
+
+		rsp, err := client.DescribeTimeToLiveWithContext(ctx, describe_ttl)
+
+		if err != nil {
+			return fmt.Errorf("Failed to describe time to live for table '%s', %w", table_name, err)
+		}
+
+		desc := rsp.TimeToLiveDescription
+
+		if desc != nil && aws.StringValue(desc.AttributeName) == aws.StringValue(spec.AttributeName) {
+
+			switch aws.StringValue(desc.TimeToLiveStatus) {
+			case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+				continue
+			}
+		}
+
+		update_ttl := &dynamodb.UpdateTimeToLiveInput{
+			TableName:               aws.String(table_name),
+			TimeToLiveSpecification: spec,
+		}
+
+		_, err = client.UpdateTimeToLiveWithContext(ctx, update_ttl)
+
+		if err != nil {
+			return fmt.Errorf("Failed to enable time to live for table '%s', %w", table_name, err)
+		}
+	}
+
+	return nil
+}
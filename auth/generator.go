@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-roster"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultAccessCodeGeneratorURI is the URI of the `AccessCodeGenerator` used when none is specified.
+const DefaultAccessCodeGeneratorURI string = "random://"
+
+// type AccessCodeGenerator is an interface for creating new access codes.
+type AccessCodeGenerator interface {
+	// Generate returns a new access code.
+	Generate(context.Context) (string, error)
+}
+
+// type AccessCodeGeneratorInitializeFunc is a function used to initialize an implementation of the `AccessCodeGenerator` interface.
+type AccessCodeGeneratorInitializeFunc func(ctx context.Context, uri string) (AccessCodeGenerator, error)
+
+var generators roster.Roster
+
+func ensureAccessCodeGeneratorRoster() error {
+
+	if generators == nil {
+
+		r, err := roster.NewDefaultRoster()
+
+		if err != nil {
+			return err
+		}
+
+		generators = r
+	}
+
+	return nil
+}
+
+// RegisterAccessCodeGenerator registers 'scheme' as a key pointing to 'f' in `NewAccessCodeGenerator` lookups.
+func RegisterAccessCodeGenerator(ctx context.Context, scheme string, f AccessCodeGeneratorInitializeFunc) error {
+
+	err := ensureAccessCodeGeneratorRoster()
+
+	if err != nil {
+		return err
+	}
+
+	return generators.Register(ctx, scheme, f)
+}
+
+// AccessCodeGeneratorSchemes returns the sorted list of URI schemes that have been registered with `RegisterAccessCodeGenerator`.
+func AccessCodeGeneratorSchemes() []string {
+
+	ctx := context.Background()
+	schemes := []string{}
+
+	err := ensureAccessCodeGeneratorRoster()
+
+	if err != nil {
+		return schemes
+	}
+
+	for _, dr := range generators.Drivers(ctx) {
+		scheme := fmt.Sprintf("%s://", strings.ToLower(dr))
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewAccessCodeGenerator returns a new `AccessCodeGenerator` instance derived from 'uri' whose scheme
+// must have been registered using the `RegisterAccessCodeGenerator` method.
+func NewAccessCodeGenerator(ctx context.Context, uri string) (AccessCodeGenerator, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	scheme := u.Scheme
+
+	err = ensureAccessCodeGeneratorRoster()
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := generators.Driver(ctx, scheme)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported access code generator '%s', %w", scheme, err)
+	}
+
+	f := i.(AccessCodeGeneratorInitializeFunc)
+	return f(ctx, uri)
+}
+
+// intQueryParameter returns the integer value of the 'key' parameter in 'q', or 'default_value' if it is not present.
+// An error is returned if the value can not be parsed or is outside the range of 'min' to 'max' (inclusive).
+func intQueryParameter(q url.Values, key string, default_value int, min int, max int) (int, error) {
+
+	if !q.Has(key) {
+		return default_value, nil
+	}
+
+	v, err := strconv.Atoi(q.Get(key))
+
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ?%s= parameter, %w", key, err)
+	}
+
+	if v < min || v > max {
+		return 0, fmt.Errorf("Invalid ?%s= parameter, value must be between %d and %d", key, min, max)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// type PINAccessCodeGenerator implements the `AccessCodeGenerator` interface for short numeric access codes
+// that visitors can enter on a keypad. PINs are short enough to be guessed by trying every possible code so
+// the number of invalid attempts should be limited, for example using a `Throttle`.
+type PINAccessCodeGenerator struct {
+	AccessCodeGenerator
+	length int
+}
+
+func init() {
+	ctx := context.Background()
+	RegisterAccessCodeGenerator(ctx, "pin", NewPINAccessCodeGenerator)
+}
+
+// NewPINAccessCodeGenerator returns a new `PINAccessCodeGenerator` instance configured by 'uri' which
+// is expected to take the form of:
+//
+//	pin://?length={LENGTH}
+//
+// Where {LENGTH} is the optional number of digits in each access code. The default is 6.
+func NewPINAccessCodeGenerator(ctx context.Context, uri string) (AccessCodeGenerator, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	length, err := intQueryParameter(u.Query(), "length", 6, 4, 12)
+
+	if err != nil {
+		return nil, err
+	}
+
+	g := &PINAccessCodeGenerator{
+		length: length,
+	}
+
+	return g, nil
+}
+
+// Generate returns a new numeric access code. Access codes may begin with one or more zeros.
+func (g *PINAccessCodeGenerator) Generate(ctx context.Context) (string, error) {
+
+	var sb strings.Builder
+
+	for i := 0; i < g.length; i++ {
+
+		d, err := randomInt(10)
+
+		if err != nil {
+			return "", err
+		}
+
+		sb.WriteString(fmt.Sprintf("%d", d))
+	}
+
+	return sb.String(), nil
+}
+
+// randomInt returns a cryptographically secure random number between 0 and 'max' (exclusive).
+func randomInt(max int) (int, error) {
+
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+
+	if err != nil {
+		return 0, fmt.Errorf("Failed to generate random number, %w", err)
+	}
+
+	return int(n.Int64()), nil
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-string/random"
+	"net/url"
+)
+
+// type RandomAccessCodeGenerator implements the `AccessCodeGenerator` interface for access codes consisting
+// of random alphanumeric strings.
+type RandomAccessCodeGenerator struct {
+	AccessCodeGenerator
+	length int
+}
+
+func init() {
+	ctx := context.Background()
+	RegisterAccessCodeGenerator(ctx, "random", NewRandomAccessCodeGenerator)
+}
+
+// NewRandomAccessCodeGenerator returns a new `RandomAccessCodeGenerator` instance configured by 'uri' which
+// is expected to take the form of:
+//
+//	random://?length={LENGTH}
+//
+// Where {LENGTH} is the optional number of characters in each access code. The default is 16.
+func NewRandomAccessCodeGenerator(ctx context.Context, uri string) (AccessCodeGenerator, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	length, err := intQueryParameter(u.Query(), "length", 16, 8, 64)
+
+	if err != nil {
+		return nil, err
+	}
+
+	g := &RandomAccessCodeGenerator{
+		length: length,
+	}
+
+	return g, nil
+}
+
+// Generate returns a new random alphanumeric access code.
+func (g *RandomAccessCodeGenerator) Generate(ctx context.Context) (string, error) {
+
+	opts := random.DefaultOptions()
+	opts.Length = g.length
+	opts.AlphaNumeric = true
+
+	return random.String(opts)
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The list of colours used as the first word in access codes created by `WordsAccessCodeGenerator`.
+var accessCodeColours = []string{
+	"amber", "black", "blue", "bronze", "brown", "coral", "gold", "green",
+	"grey", "indigo", "lemon", "orange", "pink", "purple", "red", "silver",
+}
+
+// The list of nouns used as the second word in access codes created by `WordsAccessCodeGenerator`.
+var accessCodeNouns = []string{
+	"anchor", "arrow", "badge", "balloon", "bridge", "cabin", "camera", "canyon",
+	"castle", "cloud", "comet", "compass", "engine", "falcon", "feather", "ferry",
+	"forest", "garden", "glider", "hangar", "harbor", "helmet", "island", "jacket",
+	"jet", "kite", "ladder", "lantern", "meadow", "mountain", "ocean", "orbit",
+	"owl", "parrot", "pilot", "planet", "plane", "propeller", "radar", "rainbow",
+	"river", "rocket", "runway", "sail", "satellite", "shadow", "signal", "suitcase",
+	"sunset", "ticket", "tower", "trail", "train", "tunnel", "turtle", "valley",
+	"wagon", "whale", "window", "wing", "wizard", "yacht", "zebra", "zeppelin",
+}
+
+// The list of numbers used as the third word in access codes created by `WordsAccessCodeGenerator`.
+var accessCodeNumbers = []string{
+	"one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+}
+
+// type WordsAccessCodeGenerator implements the `AccessCodeGenerator` interface for human-friendly access codes
+// made of a colour, a noun and a number, for example "red-plane-seven".
+type WordsAccessCodeGenerator struct {
+	AccessCodeGenerator
+	separator string
+}
+
+func init() {
+	ctx := context.Background()
+	RegisterAccessCodeGenerator(ctx, "words", NewWordsAccessCodeGenerator)
+}
+
+// NewWordsAccessCodeGenerator returns a new `WordsAccessCodeGenerator` instance configured by 'uri' which
+// is expected to take the form of:
+//
+//	words://?separator={SEPARATOR}
+//
+// Where {SEPARATOR} is the optional string used to join the words in each access code. The default is "-".
+func NewWordsAccessCodeGenerator(ctx context.Context, uri string) (AccessCodeGenerator, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	separator := "-"
+
+	if q.Has("separator") {
+		separator = q.Get("separator")
+	}
+
+	g := &WordsAccessCodeGenerator{
+		separator: separator,
+	}
+
+	return g, nil
+}
+
+// Generate returns a new access code made of a random colour, noun and number.
+func (g *WordsAccessCodeGenerator) Generate(ctx context.Context) (string, error) {
+
+	lists := [][]string{
+		accessCodeColours,
+		accessCodeNouns,
+		accessCodeNumbers,
+	}
+
+	words := make([]string, len(lists))
+
+	for i, l := range lists {
+
+		idx, err := randomInt(len(l))
+
+		if err != nil {
+			return "", err
+		}
+
+		words[i] = l[idx]
+	}
+
+	return strings.Join(words, g.separator), nil
+}
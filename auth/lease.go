@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+	"time"
+)
+
+// The prefix used to derive the primary key for lease records stored in the same collection as `RelayCode` records.
+const leaseKeyPrefix string = "lease:"
+
+// type relayLease is a struct containing a lease record. Leases are used to ensure that only one server instance at a time
+// performs a task, for example minting new access codes for a room. Lease records are stored in the same collection as
+// `RelayCode` records and are keyed by their `Code` property, which is the name of the lease prefixed by "lease:". Apart
+// from their primary key lease records share no properties with `RelayCode` records so they are never returned by queries
+// for access codes.
+type relayLease struct {
+	// The primary key for the lease record.
+	Code string
+	// The unique identifier of the server instance holding the lease.
+	LeaseHolder string
+	// The Unix timestamp when the lease expires.
+	LeaseExpires int64
+	// The document revision used by gocloud.dev/docstore for optimistic locking.
+	DocstoreRevision interface{}
+}
+
+// AcquireLeaseWithCollection attempts to acquire (or renew) the lease named 'name' in 'col' for 'holder' for 'ttl'
+// seconds and returns a boolean value indicating whether it was successful. A lease can only be acquired if it does
+// not exist, has expired or is already held by 'holder'. Leases are created and updated using conditional writes so
+// that only one holder can acquire a lease at a time.
+func AcquireLeaseWithCollection(ctx context.Context, col *docstore.Collection, name string, holder string, ttl int) (bool, error) {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	lease := &relayLease{
+		Code: leaseKeyPrefix + name,
+	}
+
+	err := col.Get(ctx, lease)
+
+	if err != nil {
+
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			return false, fmt.Errorf("Failed to retrieve lease '%s', %w", name, err)
+		}
+
+		lease.LeaseHolder = holder
+		lease.LeaseExpires = ts + int64(ttl)
+
+		err = col.Create(ctx, lease)
+
+		if err != nil {
+
+			if gcerrors.Code(err) == gcerrors.AlreadyExists {
+				return false, nil
+			}
+
+			return false, fmt.Errorf("Failed to create lease '%s', %w", name, err)
+		}
+
+		return true, nil
+	}
+
+	if lease.LeaseHolder != holder && lease.LeaseExpires >= ts {
+		return false, nil
+	}
+
+	lease.LeaseHolder = holder
+	lease.LeaseExpires = ts + int64(ttl)
+
+	// Note that 'lease' (including its revision) is passed to col.Replace so that the
+	// update will fail if another holder has acquired the lease since it was retrieved.
+
+	err = col.Replace(ctx, lease)
+
+	if err != nil {
+
+		if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed to update lease '%s', %w", name, err)
+	}
+
+	return true, nil
+}
+
+// ReleaseLeaseWithCollection releases the lease named 'name' in 'col' if it is held by 'holder'.
+func ReleaseLeaseWithCollection(ctx context.Context, col *docstore.Collection, name string, holder string) error {
+
+	lease := &relayLease{
+		Code: leaseKeyPrefix + name,
+	}
+
+	err := col.Get(ctx, lease)
+
+	if err != nil {
+
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+
+		return fmt.Errorf("Failed to retrieve lease '%s', %w", name, err)
+	}
+
+	if lease.LeaseHolder != holder {
+		return nil
+	}
+
+	err = col.Delete(ctx, lease)
+
+	if err != nil {
+
+		if gcerrors.Code(err) == gcerrors.FailedPrecondition || gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+
+		return fmt.Errorf("Failed to release lease '%s', %w", name, err)
+	}
+
+	return nil
+}
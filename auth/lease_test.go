@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"gocloud.dev/docstore/memdocstore"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The number of holders which attempt to acquire the same lease concurrently.
+const testLeaseContenders int = 16
+
+// newTestLeaseStores returns a `MemoryStore`, a `DocstoreAccessCodeStore` backed by an in-memory collection and a
+// `SQLAccessCodeStore` backed by a temporary SQLite database, keyed by name.
+func newTestLeaseStores(t *testing.T) map[string]Store {
+
+	ctx := context.Background()
+
+	col, err := memdocstore.OpenCollection("Code", nil)
+
+	if err != nil {
+		t.Fatalf("Failed to create collection, %v", err)
+	}
+
+	sqlite_path := filepath.Join(t.TempDir(), "relay.db")
+	sqlite_uri := fmt.Sprintf("sqlite://%s?create-tables=true&_pragma=busy_timeout(5000)", sqlite_path)
+
+	sqlite_store, err := NewStore(ctx, sqlite_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store, %v", err)
+	}
+
+	stores := map[string]Store{
+		"memory":   NewMemoryStore(),
+		"docstore": NewDocstoreAccessCodeStoreWithCollection(col),
+		"sqlite":   sqlite_store,
+	}
+
+	t.Cleanup(func() {
+
+		for _, s := range stores {
+			s.Close()
+		}
+	})
+
+	return stores
+}
+
+func TestAcquireLeaseContention(t *testing.T) {
+
+	for name, store := range newTestLeaseStores(t) {
+
+		store := store
+
+		t.Run(name, func(t *testing.T) {
+
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			wg := new(sync.WaitGroup)
+			mu := new(sync.Mutex)
+
+			acquired := make([]string, 0)
+			errs := make([]error, 0)
+
+			for i := 0; i < testLeaseContenders; i++ {
+
+				wg.Add(1)
+
+				go func(holder string) {
+
+					defer wg.Done()
+
+					ok, err := store.AcquireLease(ctx, "mint", holder, 60)
+
+					mu.Lock()
+					defer mu.Unlock()
+
+					if err != nil {
+						errs = append(errs, err)
+						return
+					}
+
+					if ok {
+						acquired = append(acquired, holder)
+					}
+
+				}(fmt.Sprintf("holder-%d", i))
+			}
+
+			wg.Wait()
+
+			if len(errs) > 0 {
+				t.Fatalf("Failed to acquire lease, %v", errs[0])
+			}
+
+			if len(acquired) != 1 {
+				t.Fatalf("Expected exactly one holder to acquire the lease, got %d (%v)", len(acquired), acquired)
+			}
+
+			holder := acquired[0]
+
+			ok, err := store.AcquireLease(ctx, "mint", holder, 60)
+
+			if err != nil || !ok {
+				t.Fatalf("Expected '%s' to renew the lease, got %t (%v)", holder, ok, err)
+			}
+
+			ok, err = store.AcquireLease(ctx, "mint", "other", 60)
+
+			if err != nil || ok {
+				t.Fatalf("Expected lease held by '%s' not to be acquired by another holder, got %t (%v)", holder, ok, err)
+			}
+
+			// Other leases are independent
+
+			ok, err = store.AcquireLease(ctx, "other", "other", 60)
+
+			if err != nil || !ok {
+				t.Fatalf("Expected a different lease to be acquired, got %t (%v)", ok, err)
+			}
+
+			// Releasing a lease held by another holder does nothing
+
+			err = store.ReleaseLease(ctx, "mint", "other")
+
+			if err != nil {
+				t.Fatalf("Failed to release lease, %v", err)
+			}
+
+			ok, err = store.AcquireLease(ctx, "mint", "other", 60)
+
+			if err != nil || ok {
+				t.Fatalf("Expected lease to be held by '%s' after another holder released it, got %t (%v)", holder, ok, err)
+			}
+
+			err = store.ReleaseLease(ctx, "mint", holder)
+
+			if err != nil {
+				t.Fatalf("Failed to release lease, %v", err)
+			}
+
+			ok, err = store.AcquireLease(ctx, "mint", "other", 60)
+
+			if err != nil || !ok {
+				t.Fatalf("Expected released lease to be acquired by another holder, got %t (%v)", ok, err)
+			}
+		})
+	}
+}
+
+func TestAcquireLeaseExpiry(t *testing.T) {
+
+	for name, store := range newTestLeaseStores(t) {
+
+		store := store
+
+		t.Run(name, func(t *testing.T) {
+
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// Leases are recorded with a precision of one second, so a lease with a time-to-live of zero
+			// expires at the start of the next second
+
+			ok, err := store.AcquireLease(ctx, "mint", "expired", 0)
+
+			if err != nil || !ok {
+				t.Fatalf("Expected lease to be acquired, got %t (%v)", ok, err)
+			}
+
+			deadline := time.Now().Add(3 * time.Second)
+
+			for {
+
+				ok, err = store.AcquireLease(ctx, "mint", "next", 60)
+
+				if err != nil {
+					t.Fatalf("Failed to acquire lease, %v", err)
+				}
+
+				if ok {
+					break
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected expired lease to be taken over")
+				}
+
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			ok, err = store.AcquireLease(ctx, "mint", "expired", 60)
+
+			if err != nil || ok {
+				t.Fatalf("Expected previous holder not to renew a lease which was taken over, got %t (%v)", ok, err)
+			}
+		})
+	}
+}
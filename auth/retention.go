@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-roster"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRetentionPolicyURI is the URI of the `RetentionPolicy` used when none is specified and the `Store` does not
+// remove expired access codes itself.
+const DefaultRetentionPolicyURI string = "prune://"
+
+// type RetentionPolicy is an interface for removing expired access codes from a `Store`.
+type RetentionPolicy interface {
+	// Interval returns the amount of time to wait between applying the policy. If zero the policy is only applied once, when the server starts.
+	Interval() time.Duration
+	// Apply removes the access codes whose expiry date is less than a Unix timestamp from a `Store`.
+	Apply(context.Context, Store, int64) error
+}
+
+// type ExpiringStore is an optional interface for `Store` implementations whose underlying database removes expired
+// access codes itself, for example DynamoDB tables with TimeToLive enabled.
+type ExpiringStore interface {
+	// ExpiresAccessCodes returns a boolean value indicating whether the underlying database removes expired access codes itself.
+	ExpiresAccessCodes() bool
+}
+
+// type RetentionPolicyInitializeFunc is a function used to initialize an implementation of the `RetentionPolicy` interface.
+type RetentionPolicyInitializeFunc func(ctx context.Context, uri string) (RetentionPolicy, error)
+
+var retention_policies roster.Roster
+
+func ensureRetentionPolicyRoster() error {
+
+	if retention_policies == nil {
+
+		r, err := roster.NewDefaultRoster()
+
+		if err != nil {
+			return err
+		}
+
+		retention_policies = r
+	}
+
+	return nil
+}
+
+// RegisterRetentionPolicy registers 'scheme' as a key pointing to 'f' in `NewRetentionPolicy` lookups.
+func RegisterRetentionPolicy(ctx context.Context, scheme string, f RetentionPolicyInitializeFunc) error {
+
+	err := ensureRetentionPolicyRoster()
+
+	if err != nil {
+		return err
+	}
+
+	return retention_policies.Register(ctx, scheme, f)
+}
+
+// RetentionPolicySchemes returns the sorted list of URI schemes that have been registered with `RegisterRetentionPolicy`.
+func RetentionPolicySchemes() []string {
+
+	ctx := context.Background()
+	schemes := []string{}
+
+	err := ensureRetentionPolicyRoster()
+
+	if err != nil {
+		return schemes
+	}
+
+	for _, dr := range retention_policies.Drivers(ctx) {
+		scheme := fmt.Sprintf("%s://", strings.ToLower(dr))
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewRetentionPolicy returns a new `RetentionPolicy` instance derived from 'uri' whose scheme
+// must have been registered using the `RegisterRetentionPolicy` method.
+func NewRetentionPolicy(ctx context.Context, uri string) (RetentionPolicy, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	scheme := u.Scheme
+
+	err = ensureRetentionPolicyRoster()
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := retention_policies.Driver(ctx, scheme)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported retention policy '%s', %w", scheme, err)
+	}
+
+	f := i.(RetentionPolicyInitializeFunc)
+	return f(ctx, uri)
+}
+
+// NewRetentionPolicyForStore returns a new `RetentionPolicy` instance derived from 'uri'. If 'uri' is empty the
+// retention policy is chosen based on 'store': "none://" if 'store' implements the `ExpiringStore` interface and
+// removes expired access codes itself, or `DefaultRetentionPolicyURI` otherwise.
+func NewRetentionPolicyForStore(ctx context.Context, uri string, store Store) (RetentionPolicy, error) {
+
+	if uri == "" {
+
+		uri = DefaultRetentionPolicyURI
+
+		expiring_store, ok := store.(ExpiringStore)
+
+		if ok && expiring_store.ExpiresAccessCodes() {
+			uri = "none://"
+		}
+	}
+
+	return NewRetentionPolicy(ctx, uri)
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// type NoneRetentionPolicy implements the `RetentionPolicy` interface but does nothing. It is used when the underlying
+// database removes expired access codes itself.
+type NoneRetentionPolicy struct {
+	RetentionPolicy
+}
+
+func init() {
+	ctx := context.Background()
+	RegisterRetentionPolicy(ctx, "none", NewNoneRetentionPolicy)
+}
+
+// NewNoneRetentionPolicy returns a new `NoneRetentionPolicy` instance.
+func NewNoneRetentionPolicy(ctx context.Context, uri string) (RetentionPolicy, error) {
+	p := &NoneRetentionPolicy{}
+	return p, nil
+}
+
+// Interval returns zero.
+func (p *NoneRetentionPolicy) Interval() time.Duration {
+	return 0
+}
+
+// Apply does nothing.
+func (p *NoneRetentionPolicy) Apply(ctx context.Context, store Store, expires int64) error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// type PruneRetentionPolicy implements the `RetentionPolicy` interface by periodically invoking the `Prune` method of a `Store`.
+type PruneRetentionPolicy struct {
+	RetentionPolicy
+	interval time.Duration
+}
+
+func init() {
+	ctx := context.Background()
+	RegisterRetentionPolicy(ctx, "prune", NewPruneRetentionPolicy)
+}
+
+// NewPruneRetentionPolicy returns a new `PruneRetentionPolicy` instance derived from 'uri' which is expected to take the form of:
+//
+//	prune://?interval={SECONDS}
+//
+// Where {SECONDS} is the number of seconds to wait between pruning expired access codes. Default is 7200 (two hours).
+func NewPruneRetentionPolicy(ctx context.Context, uri string) (RetentionPolicy, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	interval, err := intQueryParameter(q, "interval", 7200, 60, 604800)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PruneRetentionPolicy{
+		interval: time.Duration(interval) * time.Second,
+	}
+
+	return p, nil
+}
+
+// Interval returns the amount of time to wait between pruning expired access codes.
+func (p *PruneRetentionPolicy) Interval() time.Duration {
+	return p.interval
+}
+
+// Apply removes the access codes whose expiry date is less than 'expires' from 'store'.
+func (p *PruneRetentionPolicy) Apply(ctx context.Context, store Store, expires int64) error {
+	return store.Prune(ctx, expires)
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gocloud.dev/docstore"
+	"io"
+	"strings"
+	"time"
+)
+
+// The prefix for signed access codes, used to identify the version of the signed access code format.
+const signedAccessCodePrefix string = "s1"
+
+// type signedRelayCode is a struct containing the properties of a `RelayCode` that are encoded in a signed access code.
+type signedRelayCode struct {
+	Room    string `json:"r"`
+	Created int64  `json:"c"`
+	Expires int64  `json:"e"`
+	Nonce   string `json:"n"`
+}
+
+// type Signer is a struct for creating and verifying stateless access codes signed with an HMAC-SHA256 shared secret.
+// Signed access codes encode the room, creation and expiry dates of a `RelayCode` so that they can be verified
+// without consulting the database.
+type Signer struct {
+	secrets [][]byte
+}
+
+// NewSigner returns a new `Signer` instance for 'secrets'. The first secret is used to sign new access codes and
+// all of the secrets are used to verify access codes. Secrets can be rotated by adding a new secret to the start
+// of the list and removing the oldest secret once all the access codes it signed have expired.
+func NewSigner(secrets []string) (*Signer, error) {
+
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("No secrets defined")
+	}
+
+	keys := make([][]byte, len(secrets))
+
+	for i, s := range secrets {
+
+		if s == "" {
+			return nil, fmt.Errorf("Invalid secret at offset %d, secret is empty", i)
+		}
+
+		keys[i] = []byte(s)
+	}
+
+	s := &Signer{
+		secrets: keys,
+	}
+
+	return s, nil
+}
+
+// Sign returns a signed access code encoding the room, creation and expiry dates of 'rc'.
+func (s *Signer) Sign(rc *RelayCode) (string, error) {
+
+	nonce := make([]byte, 8)
+	_, err := io.ReadFull(rand.Reader, nonce)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create nonce, %w", err)
+	}
+
+	src := signedRelayCode{
+		Room:    rc.Room,
+		Created: rc.Created,
+		Expires: rc.Expires,
+		Nonce:   base64.RawURLEncoding.EncodeToString(nonce),
+	}
+
+	enc_src, err := json.Marshal(src)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal relay code, %w", err)
+	}
+
+	payload := fmt.Sprintf("%s.%s", signedAccessCodePrefix, base64.RawURLEncoding.EncodeToString(enc_src))
+	sig := signPayload(s.secrets[0], payload)
+
+	return fmt.Sprintf("%s.%s", payload, base64.RawURLEncoding.EncodeToString(sig)), nil
+}
+
+// Verify ensures that 'code' was signed by one of the signer's secrets and returns a `RelayCode` derived from
+// the properties it encodes. If 'code' is not a valid signed access code the error returned will wrap `ErrInvalidCode`.
+func (s *Signer) Verify(code string) (*RelayCode, error) {
+
+	parts := strings.Split(code, ".")
+
+	if len(parts) != 3 || parts[0] != signedAccessCodePrefix {
+		return nil, fmt.Errorf("%w, code is not a signed access code", ErrInvalidCode)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to decode signature", ErrInvalidCode)
+	}
+
+	payload := strings.Join(parts[0:2], ".")
+	verified := false
+
+	for _, secret := range s.secrets {
+
+		if hmac.Equal(sig, signPayload(secret, payload)) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("%w, invalid signature", ErrInvalidCode)
+	}
+
+	enc_src, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to decode payload", ErrInvalidCode)
+	}
+
+	var src signedRelayCode
+	err = json.Unmarshal(enc_src, &src)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to unmarshal payload", ErrInvalidCode)
+	}
+
+	rc := &RelayCode{
+		Room:    src.Room,
+		Code:    code,
+		Created: src.Created,
+		Expires: src.Expires,
+	}
+
+	return rc, nil
+}
+
+// NewSignedRelayCodeWithStore creates (and returns) a new `RelayCode` instance for 'room' in 'store' whose access
+// code is signed by 'signer'.
+func NewSignedRelayCodeWithStore(ctx context.Context, store Store, signer *Signer, room string, ttl int) (*RelayCode, error) {
+
+	rc, err := newSignedRelayCode(signer, room, ttl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Put(ctx, rc)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to store new relay code, %w", err)
+	}
+
+	return rc, nil
+}
+
+// ValidateSignedRelayCodeWithStore verifies the signature of 'code' and ensures that it is valid for 'room' and has
+// not outlived its expiry date by more than its time-to-live. Unlike `ValidateRelayCodeWithStore` these checks are
+// performed without consulting the database. The only database operation is retrieving the "last used" state for
+// 'code' from 'store' by its primary key, to determine whether the code has been revoked or superseded by a newer
+// code which is in use, and does not require a query. Errors are reported in the same way as `ValidateRelayCodeWithStore`.
+func ValidateSignedRelayCodeWithStore(ctx context.Context, store Store, signer *Signer, room string, code string) (*RelayCode, error) {
+
+	err := verifySignedRelayCode(signer, room, code)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := store.Get(ctx, code)
+
+	if err != nil {
+
+		if errors.Is(err, ErrCodeNotFound) {
+			return nil, fmt.Errorf("%w, code does not exist", ErrInvalidCode)
+		}
+
+		return nil, err
+	}
+
+	if rc.Revoked != 0 {
+		return rc, fmt.Errorf("%w, code was revoked at %d", ErrRevokedCode, rc.Revoked)
+	}
+
+	if rc.Superseded != 0 {
+		return rc, fmt.Errorf("%w, code was superseded at %d", ErrExpiredCode, rc.Superseded)
+	}
+
+	return rc, nil
+}
+
+// SupersedeRelayCodesWithCollection marks all the `RelayCode` records in 'col' for the same room as 'rc' and created
+// at or before 'rc' (excluding 'rc' itself) as superseded. This is used to record that 'rc' is now in use, and that
+// older codes are no longer valid, for signed access codes which are validated without querying the database.
+func SupersedeRelayCodesWithCollection(ctx context.Context, col *docstore.Collection, rc *RelayCode) error {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	q := col.Query()
+	q = q.Where("Room", "=", rc.Room)
+	q = q.Where("Created", "<=", rc.Created)
+
+	iter := q.Get(ctx)
+	defer iter.Stop()
+
+	for {
+
+		var other_code RelayCode
+		err := iter.Next(ctx, &other_code)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to iterate through codes, %w", err)
+		}
+
+		if other_code.Code == rc.Code || other_code.Superseded != 0 {
+			continue
+		}
+
+		mod := docstore.Mods{"Superseded": ts}
+		err = col.Update(ctx, &RelayCode{Code: other_code.Code}, mod)
+
+		if err != nil {
+			return fmt.Errorf("Failed to supersede code '%s', %w", other_code.Code, err)
+		}
+	}
+
+	return nil
+}
+
+// newSignedRelayCode returns a new `RelayCode` instance for 'room' whose access code is signed by 'signer'.
+func newSignedRelayCode(signer *Signer, room string, ttl int) (*RelayCode, error) {
+
+	now := time.Now()
+	created := now.Unix()
+	expires := created + int64(ttl)
+
+	rc := &RelayCode{
+		Room:    room,
+		Created: created,
+		Expires: expires,
+	}
+
+	code, err := signer.Sign(rc)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign relay code, %w", err)
+	}
+
+	rc.Code = code
+	return rc, nil
+}
+
+// verifySignedRelayCode verifies the signature of 'code' and ensures that it is valid for 'room' and has not
+// outlived its expiry date by more than its time-to-live.
+func verifySignedRelayCode(signer *Signer, room string, code string) error {
+
+	signed_code, err := signer.Verify(code)
+
+	if err != nil {
+		return err
+	}
+
+	if signed_code.Room != room {
+		return fmt.Errorf("%w, code is not valid for room '%s'", ErrInvalidCode, room)
+	}
+
+	// Signed codes are valid (if they have not been superseded) until they are (n) seconds
+	// past their expiry date, where (n) is their time-to-live. This mirrors the way that
+	// unsigned codes are pruned from the database.
+
+	now := time.Now()
+	ts := now.Unix()
+
+	if ts > signed_code.Expires+(signed_code.Expires-signed_code.Created) {
+		return fmt.Errorf("%w, code expired at %d", ErrExpiredCode, signed_code.Expires)
+	}
+
+	return nil
+}
+
+// signPayload returns the HMAC-SHA256 signature of 'payload' using 'secret'.
+func signPayload(secret []byte, payload string) []byte {
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
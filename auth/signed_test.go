@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"gocloud.dev/docstore/memdocstore"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTestCode returns a new `RelayCode` for 'room', created 'age' seconds ago with a time-to-live of 'ttl' seconds,
+// whose access code is signed by 'signer'.
+func signTestCode(t *testing.T, signer *Signer, room string, age int64, ttl int64) *RelayCode {
+
+	now := time.Now()
+
+	rc := &RelayCode{
+		Room:    room,
+		Created: now.Unix() - age,
+		Expires: now.Unix() - age + ttl,
+	}
+
+	code, err := signer.Sign(rc)
+
+	if err != nil {
+		t.Fatalf("Failed to sign code, %v", err)
+	}
+
+	rc.Code = code
+	return rc
+}
+
+func TestSignerRoundTrip(t *testing.T) {
+
+	signer, err := NewSigner([]string{"s3cr3t"})
+
+	if err != nil {
+		t.Fatalf("Failed to create signer, %v", err)
+	}
+
+	rc := signTestCode(t, signer, "gallery", 0, 300)
+
+	signed_code, err := signer.Verify(rc.Code)
+
+	if err != nil {
+		t.Fatalf("Failed to verify signed code, %v", err)
+	}
+
+	if signed_code.Room != rc.Room || signed_code.Created != rc.Created || signed_code.Expires != rc.Expires || signed_code.Code != rc.Code {
+		t.Fatalf("Expected verified code to match signed code, got %v (expected %v)", signed_code, rc)
+	}
+
+	// Each code has its own nonce
+
+	other := signTestCode(t, signer, "gallery", 0, 300)
+
+	if other.Code == rc.Code {
+		t.Fatalf("Expected codes signed with the same properties to differ")
+	}
+
+	_, err = NewSigner([]string{})
+
+	if err == nil {
+		t.Fatalf("Expected signer without secrets to fail")
+	}
+
+	_, err = NewSigner([]string{"s3cr3t", ""})
+
+	if err == nil {
+		t.Fatalf("Expected signer with an empty secret to fail")
+	}
+}
+
+func TestSignerRotation(t *testing.T) {
+
+	old_signer, err := NewSigner([]string{"old"})
+
+	if err != nil {
+		t.Fatalf("Failed to create signer, %v", err)
+	}
+
+	rotated_signer, err := NewSigner([]string{"new", "old"})
+
+	if err != nil {
+		t.Fatalf("Failed to create signer, %v", err)
+	}
+
+	new_signer, err := NewSigner([]string{"new"})
+
+	if err != nil {
+		t.Fatalf("Failed to create signer, %v", err)
+	}
+
+	old_code := signTestCode(t, old_signer, DefaultRoom, 0, 300)
+
+	// Codes signed with the previous secret are still valid while it is listed
+
+	_, err = rotated_signer.Verify(old_code.Code)
+
+	if err != nil {
+		t.Fatalf("Expected code signed with the second secret to verify, %v", err)
+	}
+
+	// New codes are signed with the first secret
+
+	new_code := signTestCode(t, rotated_signer, DefaultRoom, 0, 300)
+
+	_, err = new_signer.Verify(new_code.Code)
+
+	if err != nil {
+		t.Fatalf("Expected new code to be signed with the first secret, %v", err)
+	}
+
+	_, err = old_signer.Verify(new_code.Code)
+
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Expected new code not to verify with the previous secret, got %v", err)
+	}
+
+	// Once the previous secret is removed its codes are no longer valid
+
+	_, err = new_signer.Verify(old_code.Code)
+
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Expected code signed with a removed secret to be invalid, got %v", err)
+	}
+}
+
+func TestSignerTampered(t *testing.T) {
+
+	signer, err := NewSigner([]string{"s3cr3t"})
+
+	if err != nil {
+		t.Fatalf("Failed to create signer, %v", err)
+	}
+
+	rc := signTestCode(t, signer, DefaultRoom, 0, 300)
+	parts := strings.Split(rc.Code, ".")
+
+	// A payload for another room, with a later expiry date, signed with the original signature
+
+	forged := `{"r":"other","c":1,"e":9999999999,"n":"AAAAAAAAAAA"}`
+	forged_payload := base64.RawURLEncoding.EncodeToString([]byte(forged))
+
+	// A signature with its first byte changed
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		t.Fatalf("Failed to decode signature, %v", err)
+	}
+
+	sig[0] ^= 0xff
+	tampered_sig := base64.RawURLEncoding.EncodeToString(sig)
+
+	tests := map[string]string{
+		"payload":   strings.Join([]string{parts[0], forged_payload, parts[2]}, "."),
+		"signature": strings.Join([]string{parts[0], parts[1], tampered_sig}, "."),
+		"encoding":  strings.Join([]string{parts[0], parts[1], "!!!"}, "."),
+		"prefix":    strings.Join([]string{"s2", parts[1], parts[2]}, "."),
+		"truncated": strings.Join(parts[0:2], "."),
+		"unsigned":  "123456",
+	}
+
+	for name, code := range tests {
+
+		_, err := signer.Verify(code)
+
+		if !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("Expected %s code '%s' to be invalid, got %v", name, code, err)
+		}
+	}
+}
+
+func TestValidateSignedRelayCodeWithStore(t *testing.T) {
+
+	ctx := context.Background()
+
+	signer, err := NewSigner([]string{"s3cr3t"})
+
+	if err != nil {
+		t.Fatalf("Failed to create signer, %v", err)
+	}
+
+	store := NewMemoryStore()
+
+	put := func(rc *RelayCode) {
+
+		err := store.Put(ctx, rc)
+
+		if err != nil {
+			t.Fatalf("Failed to store code, %v", err)
+		}
+	}
+
+	current := signTestCode(t, signer, "gallery", 0, 300)
+	put(current)
+
+	rc, err := ValidateSignedRelayCodeWithStore(ctx, store, signer, "gallery", current.Code)
+
+	if err != nil || rc == nil || rc.Code != current.Code {
+		t.Fatalf("Expected current code to be valid, got %v (%v)", rc, err)
+	}
+
+	// Codes are only valid for the room they were signed for
+
+	_, err = ValidateSignedRelayCodeWithStore(ctx, store, signer, DefaultRoom, current.Code)
+
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Expected code used in the wrong room to be invalid, got %v", err)
+	}
+
+	// Codes which were never stored are not valid, even with a valid signature
+
+	missing := signTestCode(t, signer, "gallery", 0, 300)
+
+	_, err = ValidateSignedRelayCodeWithStore(ctx, store, signer, "gallery", missing.Code)
+
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("Expected code which does not exist to be invalid, got %v", err)
+	}
+
+	// Codes remain valid for their time-to-live after they expire
+
+	grace := signTestCode(t, signer, "gallery", 90, 60)
+	put(grace)
+
+	_, err = ValidateSignedRelayCodeWithStore(ctx, store, signer, "gallery", grace.Code)
+
+	if err != nil {
+		t.Fatalf("Expected code within its grace window to be valid, %v", err)
+	}
+
+	expired := signTestCode(t, signer, "gallery", 150, 60)
+	put(expired)
+
+	_, err = ValidateSignedRelayCodeWithStore(ctx, store, signer, "gallery", expired.Code)
+
+	if !errors.Is(err, ErrExpiredCode) {
+		t.Fatalf("Expected code past its grace window to be expired, got %v", err)
+	}
+
+	// Codes which have been revoked or superseded are refused even though their signature is valid
+
+	revoked := signTestCode(t, signer, "museum", 20, 300)
+	put(revoked)
+
+	err = store.Revoke(ctx, signTestCode(t, signer, "museum", 10, 300))
+
+	if err != nil {
+		t.Fatalf("Failed to revoke codes, %v", err)
+	}
+
+	_, err = ValidateSignedRelayCodeWithStore(ctx, store, signer, "museum", revoked.Code)
+
+	if !errors.Is(err, ErrRevokedCode) {
+		t.Fatalf("Expected revoked code to be refused, got %v", err)
+	}
+
+	superseded := signTestCode(t, signer, "lobby", 20, 300)
+	put(superseded)
+
+	err = store.Supersede(ctx, signTestCode(t, signer, "lobby", 10, 300))
+
+	if err != nil {
+		t.Fatalf("Failed to supersede codes, %v", err)
+	}
+
+	_, err = ValidateSignedRelayCodeWithStore(ctx, store, signer, "lobby", superseded.Code)
+
+	if !errors.Is(err, ErrExpiredCode) {
+		t.Fatalf("Expected superseded code to be refused, got %v", err)
+	}
+}
+
+func TestSupersedeRelayCodesWithCollection(t *testing.T) {
+
+	ctx := context.Background()
+
+	signer, err := NewSigner([]string{"s3cr3t"})
+
+	if err != nil {
+		t.Fatalf("Failed to create signer, %v", err)
+	}
+
+	col, err := memdocstore.OpenCollection("Code", nil)
+
+	if err != nil {
+		t.Fatalf("Failed to create collection, %v", err)
+	}
+
+	defer col.Close()
+
+	store := NewDocstoreAccessCodeStoreWithCollection(col)
+
+	older := signTestCode(t, signer, "gallery", 20, 300)
+	current := signTestCode(t, signer, "gallery", 10, 300)
+	newer := signTestCode(t, signer, "gallery", 0, 300)
+	other := signTestCode(t, signer, "lobby", 20, 300)
+
+	for _, rc := range []*RelayCode{older, current, newer, other} {
+
+		err := store.Put(ctx, rc)
+
+		if err != nil {
+			t.Fatalf("Failed to store code, %v", err)
+		}
+	}
+
+	err = SupersedeRelayCodesWithCollection(ctx, col, current)
+
+	if err != nil {
+		t.Fatalf("Failed to supersede codes, %v", err)
+	}
+
+	tests := []struct {
+		rc       *RelayCode
+		expected error
+	}{
+		{older, ErrExpiredCode},
+		{current, nil},
+		{newer, nil},
+		{other, nil},
+	}
+
+	for _, test := range tests {
+
+		_, err := ValidateSignedRelayCodeWithStore(ctx, store, signer, test.rc.Room, test.rc.Code)
+
+		if test.expected == nil && err != nil {
+			t.Fatalf("Expected code created at %d in '%s' to be valid, %v", test.rc.Created, test.rc.Room, err)
+		}
+
+		if test.expected != nil && !errors.Is(err, test.expected) {
+			t.Fatalf("Expected code created at %d in '%s' to be superseded, got %v", test.rc.Created, test.rc.Room, err)
+		}
+	}
+}
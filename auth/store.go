@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-roster"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ErrCodeNotFound is returned by `AccessCodeStore` implementations when an access code does not exist.
+var ErrCodeNotFound = errors.New("Access code not found")
+
+// ErrCodeExists is returned by `AccessCodeStore` implementations when storing an access code which already exists.
+var ErrCodeExists = errors.New("Access code already exists")
+
+// type AccessCodeStore is an interface for storing and retrieving `RelayCode` records.
+type AccessCodeStore interface {
+	// Put stores a new `RelayCode`. If the access code already exists the error returned will wrap `ErrCodeExists`.
+	Put(context.Context, *RelayCode) error
+	// Get returns the `RelayCode` for an access code. If the access code does not exist the error returned will wrap `ErrCodeNotFound`.
+	Get(context.Context, string) (*RelayCode, error)
+	// Current returns the most recently created `RelayCode` for a room that was created within (n) seconds of the current
+	// time, or nil if there is no such code.
+	Current(context.Context, string, int) (*RelayCode, error)
+	// MarkUsed records the Unix timestamp when an access code was last used. A timestamp of zero marks the access code
+	// as unused. If the access code does not exist the error returned will wrap `ErrCodeNotFound`.
+	MarkUsed(context.Context, string, int64) error
+	// Prune removes all the `RelayCode` records whose expiry date is less than a Unix timestamp.
+	Prune(context.Context, int64) error
+	// Close closes the underlying database connection.
+	Close() error
+}
+
+// type Store is an interface for the operations used to create, validate and manage access codes. It extends the
+// `AccessCodeStore` interface with methods for operations which span multiple access codes, or which need to be
+// performed atomically, and which are implemented differently by each database. Handlers should depend on this
+// interface rather than a specific database so that alternative databases, or in-memory fakes, can be used.
+type Store interface {
+	AccessCodeStore
+	// Next returns the oldest `RelayCode` for the same room as 'rc' that was created after 'rc', or nil if there is no newer code.
+	Next(context.Context, *RelayCode) (*RelayCode, error)
+	// Revoke marks all the unrevoked `RelayCode` records for the same room as 'rc' and created at or before 'rc'
+	// (excluding 'rc' itself) as revoked.
+	Revoke(context.Context, *RelayCode) error
+	// Supersede marks all the `RelayCode` records for the same room as 'rc' and created at or before 'rc'
+	// (excluding 'rc' itself) as superseded.
+	Supersede(context.Context, *RelayCode) error
+	// Claim atomically records 'session' as the (hashed) session token for 'rc', which is expected to have been
+	// retrieved from the store. If 'rc' has already been claimed, including by a concurrent request, the error
+	// returned will wrap `ErrClaimedCode`.
+	Claim(context.Context, *RelayCode, string) error
+	// AcquireLease attempts to acquire (or renew) the lease named 'name' for 'holder' for 'ttl' seconds and returns
+	// a boolean value indicating whether it was successful. A lease can only be acquired if it does not exist, has
+	// expired or is already held by 'holder'. Acquiring a lease must be atomic so that only one holder can acquire a
+	// lease at a time.
+	AcquireLease(context.Context, string, string, int) (bool, error)
+	// ReleaseLease releases the lease named 'name' if it is held by 'holder'.
+	ReleaseLease(context.Context, string, string) error
+}
+
+// type AccessCodeStoreInitializeFunc is a function used to initialize an implementation of the `AccessCodeStore` interface.
+type AccessCodeStoreInitializeFunc func(ctx context.Context, uri string) (AccessCodeStore, error)
+
+var stores roster.Roster
+
+func ensureAccessCodeStoreRoster() error {
+
+	if stores == nil {
+
+		r, err := roster.NewDefaultRoster()
+
+		if err != nil {
+			return err
+		}
+
+		stores = r
+	}
+
+	return nil
+}
+
+// RegisterAccessCodeStore registers 'scheme' as a key pointing to 'f' in `NewAccessCodeStore` lookups.
+func RegisterAccessCodeStore(ctx context.Context, scheme string, f AccessCodeStoreInitializeFunc) error {
+
+	err := ensureAccessCodeStoreRoster()
+
+	if err != nil {
+		return err
+	}
+
+	return stores.Register(ctx, scheme, f)
+}
+
+// AccessCodeStoreSchemes returns the sorted list of URI schemes that have been registered with `RegisterAccessCodeStore`.
+func AccessCodeStoreSchemes() []string {
+
+	ctx := context.Background()
+	schemes := []string{}
+
+	err := ensureAccessCodeStoreRoster()
+
+	if err != nil {
+		return schemes
+	}
+
+	for _, dr := range stores.Drivers(ctx) {
+		scheme := fmt.Sprintf("%s://", strings.ToLower(dr))
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewAccessCodeStore returns a new `AccessCodeStore` instance derived from 'uri' whose scheme
+// must have been registered using the `RegisterAccessCodeStore` method.
+func NewAccessCodeStore(ctx context.Context, uri string) (AccessCodeStore, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	scheme := u.Scheme
+
+	err = ensureAccessCodeStoreRoster()
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := stores.Driver(ctx, scheme)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported access code store '%s', %w", scheme, err)
+	}
+
+	f := i.(AccessCodeStoreInitializeFunc)
+	return f(ctx, uri)
+}
+
+// NewStore returns a new `Store` instance derived from 'uri' using the `NewAccessCodeStore` method. An error is
+// returned if the `AccessCodeStore` implementation for 'uri' does not also implement the `Store` interface.
+func NewStore(ctx context.Context, uri string) (Store, error) {
+
+	s, err := NewAccessCodeStore(ctx, uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := s.(Store)
+
+	if !ok {
+		s.Close()
+		return nil, fmt.Errorf("Access code store for '%s' does not implement the auth.Store interface", uri)
+	}
+
+	return store, nil
+}
@@ -0,0 +1,461 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// The maximum number of access codes (the current code and the code it replaced) cached for each room.
+const maxCachedRelayCodes int = 2
+
+// type cachedRoom is a struct containing the newest access codes for a room, ordered by creation date.
+type cachedRoom struct {
+	codes []RelayCode
+}
+
+// type CachedStore implements the `Store` interface by wrapping another `Store` instance and caching the current and
+// previous access codes for each room in memory. Reads (`Get`, `Current` and `Next`) for those codes are served from
+// the cache, falling back to the underlying store on a miss. Writes are always made to the underlying store.
+//
+// When the access codes for a room are modified the `Notify` function, if defined, is invoked so that other server
+// instances sharing the same underlying store can invalidate their caches by calling the `Invalidate` method. Until
+// that notification is received other instances may serve stale access codes. In order to limit the number of
+// notifications, marking an access code as used only triggers a notification if it changes whether the code is in use.
+// Notification failures are logged rather than returned, since the underlying store has already been modified.
+type CachedStore struct {
+	AccessCodeStore
+	store   Store
+	rooms   map[string]*cachedRoom
+	version int64
+	mu      *sync.Mutex
+	// An optional function invoked with the name of a room after the access codes for that room have been modified.
+	Notify func(context.Context, string) error
+	// The logger used to report failures to notify other server instances.
+	Logger *log.Logger
+}
+
+// NewCachedStore returns a new `CachedStore` instance wrapping 'store'.
+func NewCachedStore(store Store) *CachedStore {
+
+	s := &CachedStore{
+		store:  store,
+		rooms:  make(map[string]*cachedRoom),
+		mu:     new(sync.Mutex),
+		Logger: log.Default(),
+	}
+
+	return s
+}
+
+// Invalidate removes the cached access codes for 'room'. If 'room' is empty the cached access codes for all rooms are removed.
+func (s *CachedStore) Invalidate(room string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.invalidate(room)
+}
+
+// Put stores 'rc' in the underlying store and adds it to the cache.
+func (s *CachedStore) Put(ctx context.Context, rc *RelayCode) error {
+
+	err := s.store.Put(ctx, rc)
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+
+	r, ok := s.rooms[rc.Room]
+
+	if ok {
+
+		if len(r.codes) == 0 || rc.Created >= r.codes[len(r.codes)-1].Created {
+			r.codes = append(r.codes, *rc)
+
+			if len(r.codes) > maxCachedRelayCodes {
+				r.codes = r.codes[len(r.codes)-maxCachedRelayCodes:]
+			}
+		} else {
+			s.invalidate(rc.Room)
+		}
+	}
+
+	s.mu.Unlock()
+
+	s.notify(ctx, rc.Room)
+	return nil
+}
+
+// Get returns the `RelayCode` for 'code' from the cache or, if it is not cached, from the underlying store.
+func (s *CachedStore) Get(ctx context.Context, code string) (*RelayCode, error) {
+
+	rc := s.lookup(code)
+
+	if rc != nil {
+		return rc, nil
+	}
+
+	rc, err := s.store.Get(ctx, code)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the room so that subsequent lookups for 'rc', if it is the current code, are cached
+
+	err = s.load(ctx, rc.Room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// Current returns the most recently created `RelayCode` for 'room' created within the last 'ttl' seconds.
+func (s *CachedStore) Current(ctx context.Context, room string, ttl int) (*RelayCode, error) {
+
+	err := s.load(ctx, room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ts := now.Unix()
+
+	s.mu.Lock()
+
+	r, ok := s.rooms[room]
+
+	if !ok {
+		s.mu.Unlock()
+
+		// The room was invalidated while it was being loaded
+		return s.store.Current(ctx, room, ttl)
+	}
+
+	if len(r.codes) == 0 {
+		s.mu.Unlock()
+		return nil, nil
+	}
+
+	current := r.codes[len(r.codes)-1]
+	s.mu.Unlock()
+
+	if current.Created <= ts-int64(ttl) {
+		return nil, nil
+	}
+
+	return &current, nil
+}
+
+// MarkUsed sets the last update time for 'code' to 'ts' in the underlying store and the cache. If 'code' is not
+// cached it is retrieved from the underlying store first, so that other server instances are only notified (for the
+// code's room) when marking the code changes whether it is in use.
+func (s *CachedStore) MarkUsed(ctx context.Context, code string, ts int64) error {
+
+	rc := s.lookup(code)
+
+	if rc == nil {
+
+		stored_code, err := s.store.Get(ctx, code)
+
+		if err != nil {
+			return err
+		}
+
+		rc = stored_code
+	}
+
+	err := s.store.MarkUsed(ctx, code, ts)
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+
+	r, ok := s.rooms[rc.Room]
+
+	if ok {
+
+		for i, other_code := range r.codes {
+
+			if other_code.Code == code {
+				r.codes[i].LastUpdate = ts
+			}
+		}
+	}
+
+	s.mu.Unlock()
+
+	if (rc.LastUpdate == 0) == (ts == 0) {
+		return nil
+	}
+
+	s.notify(ctx, rc.Room)
+	return nil
+}
+
+// Prune removes all the `RelayCode` records whose expiry date is less than 'expires' from the underlying store and
+// clears the cache.
+func (s *CachedStore) Prune(ctx context.Context, expires int64) error {
+
+	err := s.store.Prune(ctx, expires)
+
+	if err != nil {
+		return err
+	}
+
+	s.Invalidate("")
+	return nil
+}
+
+// Next returns the oldest `RelayCode` for the same room as 'rc' that was created after 'rc', or nil if there is no newer code.
+func (s *CachedStore) Next(ctx context.Context, rc *RelayCode) (*RelayCode, error) {
+
+	err := s.load(ctx, rc.Room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+
+	r, ok := s.rooms[rc.Room]
+
+	if ok {
+
+		for i, other_code := range r.codes {
+
+			if other_code.Code != rc.Code {
+				continue
+			}
+
+			var next_code *RelayCode
+
+			if i < len(r.codes)-1 {
+				c := r.codes[i+1]
+				next_code = &c
+			}
+
+			s.mu.Unlock()
+			return next_code, nil
+		}
+	}
+
+	version := s.version
+	s.mu.Unlock()
+
+	next_code, err := s.store.Next(ctx, rc)
+
+	if err != nil || next_code == nil {
+		return next_code, err
+	}
+
+	// If the next code is the oldest cached code then 'rc' is the code it replaced and can be cached
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok = s.rooms[rc.Room]
+
+	if ok && s.version == version && len(r.codes) > 0 && len(r.codes) < maxCachedRelayCodes && r.codes[0].Code == next_code.Code {
+		r.codes = append([]RelayCode{*rc}, r.codes...)
+	}
+
+	return next_code, nil
+}
+
+// Revoke marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as revoked
+// in the underlying store and invalidates the cache for that room.
+func (s *CachedStore) Revoke(ctx context.Context, rc *RelayCode) error {
+
+	err := s.store.Revoke(ctx, rc)
+
+	if err != nil {
+		return err
+	}
+
+	s.Invalidate(rc.Room)
+	s.notify(ctx, rc.Room)
+
+	return nil
+}
+
+// Supersede marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as superseded
+// in the underlying store and invalidates the cache for that room.
+func (s *CachedStore) Supersede(ctx context.Context, rc *RelayCode) error {
+
+	err := s.store.Supersede(ctx, rc)
+
+	if err != nil {
+		return err
+	}
+
+	s.Invalidate(rc.Room)
+	s.notify(ctx, rc.Room)
+
+	return nil
+}
+
+// Claim records 'session' as the session token for 'rc'. Since cached codes may be stale the code is retrieved from
+// the underlying store, rather than the cache, before it is claimed.
+func (s *CachedStore) Claim(ctx context.Context, rc *RelayCode, session string) error {
+
+	stored_code, err := s.store.Get(ctx, rc.Code)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.store.Claim(ctx, stored_code, session)
+
+	if err != nil {
+		return err
+	}
+
+	rc.Session = session
+
+	s.mu.Lock()
+
+	r, ok := s.rooms[rc.Room]
+
+	if ok {
+
+		for i, other_code := range r.codes {
+
+			if other_code.Code == rc.Code {
+				r.codes[i].Session = session
+			}
+		}
+	}
+
+	s.mu.Unlock()
+
+	s.notify(ctx, rc.Room)
+	return nil
+}
+
+// AcquireLease attempts to acquire (or renew) the lease named 'name' for 'holder' for 'ttl' seconds in the underlying store.
+func (s *CachedStore) AcquireLease(ctx context.Context, name string, holder string, ttl int) (bool, error) {
+	return s.store.AcquireLease(ctx, name, holder, ttl)
+}
+
+// ReleaseLease releases the lease named 'name' in the underlying store if it is held by 'holder'.
+func (s *CachedStore) ReleaseLease(ctx context.Context, name string, holder string) error {
+	return s.store.ReleaseLease(ctx, name, holder)
+}
+
+// ExpiresAccessCodes returns a boolean value indicating whether the underlying store removes expired access codes itself.
+func (s *CachedStore) ExpiresAccessCodes() bool {
+
+	expiring_store, ok := s.store.(ExpiringStore)
+	return ok && expiring_store.ExpiresAccessCodes()
+}
+
+// Close closes the underlying store.
+func (s *CachedStore) Close() error {
+	return s.store.Close()
+}
+
+// lookup returns a copy of the cached `RelayCode` for 'code', or nil if it is not cached.
+func (s *CachedStore) lookup(code string) *RelayCode {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rooms {
+
+		for _, rc := range r.codes {
+
+			if rc.Code == code {
+				return &rc
+			}
+		}
+	}
+
+	return nil
+}
+
+// load retrieves the newest access code for 'room' from the underlying store and adds it to the cache, if the
+// room is not already cached.
+func (s *CachedStore) load(ctx context.Context, room string) error {
+
+	s.mu.Lock()
+
+	_, ok := s.rooms[room]
+	version := s.version
+
+	s.mu.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	rc, err := s.store.Current(ctx, room, math.MaxInt32)
+
+	if err != nil {
+		return fmt.Errorf("Failed to load current code for room '%s', %w", room, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Don't cache the result if the room was modified (or loaded) while it was being retrieved
+
+	_, ok = s.rooms[room]
+
+	if ok || s.version != version {
+		return nil
+	}
+
+	r := &cachedRoom{
+		codes: make([]RelayCode, 0),
+	}
+
+	if rc != nil {
+		r.codes = append(r.codes, *rc)
+	}
+
+	s.rooms[room] = r
+	return nil
+}
+
+// invalidate removes the cached access codes for 'room', or all rooms if 'room' is empty. The caller is expected to hold s.mu.
+func (s *CachedStore) invalidate(room string) {
+
+	// Any codes which are being loaded for a room when it is invalidated are discarded
+
+	s.version += 1
+
+	if room == "" {
+		s.rooms = make(map[string]*cachedRoom)
+		return
+	}
+
+	delete(s.rooms, room)
+}
+
+// notify invokes the `Notify` function, if defined, for 'room'. Failures are logged, rather than returned, since
+// they do not affect the underlying store; other server instances will serve stale access codes until their caches
+// are next invalidated.
+func (s *CachedStore) notify(ctx context.Context, room string) {
+
+	if s.Notify == nil {
+		return
+	}
+
+	err := s.Notify(ctx, room)
+
+	if err != nil && s.Logger != nil {
+		s.Logger.Printf("Failed to notify cache invalidation for room '%s', %v", room, err)
+	}
+}
@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/go-pubsub/subscriber"
+	_ "gocloud.dev/pubsub/mempubsub"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The maximum amount of time to wait for a cache invalidation to be delivered over pubsub.
+const testCacheWait time.Duration = 2 * time.Second
+
+// type countingStore is a `Store` which counts the number of reads made to the `MemoryStore` it wraps. If 'block'
+// is not nil the first call to `Current` signals 'blocked' after reading the current code and then waits until
+// 'block' is closed before returning it.
+type countingStore struct {
+	*MemoryStore
+	gets     int
+	currents int
+	block    chan struct{}
+	blocked  chan struct{}
+	mu       *sync.Mutex
+}
+
+func newCountingStore() *countingStore {
+
+	s := &countingStore{
+		MemoryStore: NewMemoryStore(),
+		mu:          new(sync.Mutex),
+	}
+
+	return s
+}
+
+func (s *countingStore) Get(ctx context.Context, code string) (*RelayCode, error) {
+
+	s.mu.Lock()
+	s.gets += 1
+	s.mu.Unlock()
+
+	return s.MemoryStore.Get(ctx, code)
+}
+
+func (s *countingStore) Current(ctx context.Context, room string, ttl int) (*RelayCode, error) {
+
+	rc, err := s.MemoryStore.Current(ctx, room, ttl)
+
+	s.mu.Lock()
+	s.currents += 1
+	block := s.block
+	s.block = nil
+	s.mu.Unlock()
+
+	if block != nil {
+		close(s.blocked)
+		<-block
+	}
+
+	return rc, err
+}
+
+func (s *countingStore) reads() (int, int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.gets, s.currents
+}
+
+// putTestCode stores a new `RelayCode` for 'room' with access code 'code', created 'age' seconds ago, in 'store'.
+func putTestCode(t *testing.T, store Store, room string, code string, age int64) *RelayCode {
+
+	now := time.Now()
+
+	rc := &RelayCode{
+		Room:    room,
+		Code:    code,
+		Created: now.Unix() - age,
+		Expires: now.Unix() - age + 300,
+	}
+
+	err := store.Put(context.Background(), rc)
+
+	if err != nil {
+		t.Fatalf("Failed to store code '%s', %v", code, err)
+	}
+
+	return rc
+}
+
+func TestCachedStoreHit(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := newCountingStore()
+	putTestCode(t, store, DefaultRoom, "a", 10)
+
+	cache := NewCachedStore(store)
+
+	rc, err := cache.Current(ctx, DefaultRoom, 300)
+
+	if err != nil {
+		t.Fatalf("Failed to get current code, %v", err)
+	}
+
+	if rc == nil || rc.Code != "a" {
+		t.Fatalf("Expected current code to be 'a', got %v", rc)
+	}
+
+	gets, currents := store.reads()
+
+	// Subsequent reads for the current code are served from the cache
+
+	for i := 0; i < 3; i++ {
+
+		rc, err := cache.Current(ctx, DefaultRoom, 300)
+
+		if err != nil || rc == nil || rc.Code != "a" {
+			t.Fatalf("Expected cached current code to be 'a', got %v (%v)", rc, err)
+		}
+
+		rc, err = cache.Get(ctx, "a")
+
+		if err != nil || rc == nil || rc.Code != "a" {
+			t.Fatalf("Expected cached code 'a', got %v (%v)", rc, err)
+		}
+	}
+
+	next_gets, next_currents := store.reads()
+
+	if next_gets != gets || next_currents != currents {
+		t.Fatalf("Expected cache hits not to read the underlying store, got %d gets and %d queries (was %d and %d)", next_gets, next_currents, gets, currents)
+	}
+
+	// Codes created by the same instance are added to the cache
+
+	putTestCode(t, cache, DefaultRoom, "b", 0)
+
+	rc, err = cache.Current(ctx, DefaultRoom, 300)
+
+	if err != nil || rc == nil || rc.Code != "b" {
+		t.Fatalf("Expected current code to be 'b', got %v (%v)", rc, err)
+	}
+
+	next_code, err := cache.Next(ctx, &RelayCode{Room: DefaultRoom, Code: "a"})
+
+	if err != nil || next_code == nil || next_code.Code != "b" {
+		t.Fatalf("Expected next code to be 'b', got %v (%v)", next_code, err)
+	}
+
+	next_gets, next_currents = store.reads()
+
+	if next_gets != gets || next_currents != currents {
+		t.Fatalf("Expected cache hits not to read the underlying store, got %d gets and %d queries (was %d and %d)", next_gets, next_currents, gets, currents)
+	}
+}
+
+func TestCachedStoreMiss(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := newCountingStore()
+	putTestCode(t, store, DefaultRoom, "a", 20)
+	putTestCode(t, store, DefaultRoom, "b", 10)
+	putTestCode(t, store, DefaultRoom, "c", 0)
+
+	cache := NewCachedStore(store)
+
+	// Only the current code is loaded so older codes fall through to the underlying store
+
+	rc, err := cache.Get(ctx, "a")
+
+	if err != nil || rc == nil || rc.Code != "a" {
+		t.Fatalf("Expected code 'a', got %v (%v)", rc, err)
+	}
+
+	gets, _ := store.reads()
+
+	if gets != 1 {
+		t.Fatalf("Expected a miss to read the underlying store once, got %d", gets)
+	}
+
+	rc, err = cache.Get(ctx, "a")
+
+	if err != nil || rc == nil || rc.Code != "a" {
+		t.Fatalf("Expected code 'a', got %v (%v)", rc, err)
+	}
+
+	gets, _ = store.reads()
+
+	if gets != 2 {
+		t.Fatalf("Expected a code which is not cached to be read from the underlying store again, got %d reads", gets)
+	}
+
+	_, err = cache.Get(ctx, "missing")
+
+	if !errors.Is(err, ErrCodeNotFound) {
+		t.Fatalf("Expected missing code to return ErrCodeNotFound, got %v", err)
+	}
+
+	// Codes which are not cached are never mistaken for the current code
+
+	rc, err = cache.Current(ctx, DefaultRoom, 300)
+
+	if err != nil || rc == nil || rc.Code != "c" {
+		t.Fatalf("Expected current code to be 'c', got %v (%v)", rc, err)
+	}
+}
+
+func TestCachedStoreInvalidatePubSub(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The gocloud.dev constructors are used directly since the "mem" scheme is only registered with go-pubsub if
+	// mempubsub is initialized first. Topics are shared by name, and can not be reopened once they are shut down,
+	// so each run uses a new topic.
+
+	uri := fmt.Sprintf("mem://cache-invalidation-%d", time.Now().UnixNano())
+
+	pub, err := publisher.NewGoCloudPublisher(ctx, uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create publisher, %v", err)
+	}
+
+	defer pub.Close()
+
+	sub, err := subscriber.NewGoCloudSubscriber(ctx, uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create subscriber, %v", err)
+	}
+
+	defer sub.Close()
+
+	store := NewMemoryStore()
+	putTestCode(t, store, DefaultRoom, "a", 10)
+
+	// Two server instances sharing the same underlying store, the first of which notifies the second when
+	// it modifies the access codes for a room
+
+	instance_a := NewCachedStore(store)
+	instance_b := NewCachedStore(store)
+
+	instance_a.Notify = func(ctx context.Context, room string) error {
+		return pub.Publish(ctx, room)
+	}
+
+	msg_ch := make(chan string)
+	invalidated := make(chan string)
+
+	go sub.Listen(ctx, msg_ch)
+
+	go func() {
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case room := <-msg_ch:
+				instance_b.Invalidate(room)
+				invalidated <- room
+			}
+		}
+	}()
+
+	for _, s := range []*CachedStore{instance_a, instance_b} {
+
+		rc, err := s.Current(ctx, DefaultRoom, 300)
+
+		if err != nil || rc == nil || rc.Code != "a" {
+			t.Fatalf("Expected current code to be 'a', got %v (%v)", rc, err)
+		}
+	}
+
+	putTestCode(t, instance_a, DefaultRoom, "b", 0)
+
+	select {
+	case room := <-invalidated:
+
+		if room != DefaultRoom {
+			t.Fatalf("Expected room '%s' to be invalidated, got '%s'", DefaultRoom, room)
+		}
+
+	case <-time.After(testCacheWait):
+		t.Fatalf("Timed out waiting for cache invalidation")
+	}
+
+	rc, err := instance_b.Current(ctx, DefaultRoom, 300)
+
+	if err != nil || rc == nil || rc.Code != "b" {
+		t.Fatalf("Expected second instance's current code to be 'b' after invalidation, got %v (%v)", rc, err)
+	}
+}
+
+func TestCachedStoreInvalidateDuringLoad(t *testing.T) {
+
+	ctx := context.Background()
+
+	block := make(chan struct{})
+
+	store := newCountingStore()
+	store.block = block
+	store.blocked = make(chan struct{})
+
+	putTestCode(t, store, DefaultRoom, "a", 10)
+
+	cache := NewCachedStore(store)
+	cache.Logger = log.New(io.Discard, "", 0)
+
+	type result struct {
+		rc  *RelayCode
+		err error
+	}
+
+	done := make(chan result)
+
+	go func() {
+		rc, err := cache.Current(ctx, DefaultRoom, 300)
+		done <- result{rc, err}
+	}()
+
+	// Wait until the load has read the (soon to be stale) current code, then create a newer code and
+	// invalidate the room as though another server instance had created it
+
+	select {
+	case <-store.blocked:
+		// pass
+	case <-time.After(testCacheWait):
+		t.Fatalf("Timed out waiting for load to start")
+	}
+
+	putTestCode(t, store, DefaultRoom, "b", 0)
+	cache.Invalidate(DefaultRoom)
+
+	close(block)
+
+	var r result
+
+	select {
+	case r = <-done:
+		// pass
+	case <-time.After(testCacheWait):
+		t.Fatalf("Timed out waiting for load to complete")
+	}
+
+	if r.err != nil || r.rc == nil || r.rc.Code != "b" {
+		t.Fatalf("Expected a load which raced with an invalidation to return 'b', got %v (%v)", r.rc, r.err)
+	}
+
+	if cache.lookup("a") != nil {
+		t.Fatalf("Expected stale code 'a' not to be cached")
+	}
+
+	rc, err := cache.Current(ctx, DefaultRoom, 300)
+
+	if err != nil || rc == nil || rc.Code != "b" {
+		t.Fatalf("Expected current code to be 'b', got %v (%v)", rc, err)
+	}
+}
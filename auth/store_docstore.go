@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	aa_dynamodb "github.com/aaronland/go-aws-dynamodb"
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+	"net/url"
+)
+
+// type DocstoreAccessCodeStore implements the `AccessCodeStore` and `Store` interfaces for `RelayCode` records stored in a gocloud.dev/docstore collection.
+type DocstoreAccessCodeStore struct {
+	AccessCodeStore
+	collection *docstore.Collection
+	expires    bool
+}
+
+func init() {
+
+	ctx := context.Background()
+
+	for _, scheme := range []string{"mem", "awsdynamodb"} {
+		RegisterAccessCodeStore(ctx, scheme, NewDocstoreAccessCodeStore)
+	}
+}
+
+// NewDocstoreAccessCodeStore returns a new `DocstoreAccessCodeStore` instance for the collection derived from 'uri' by the
+// `NewAccessCodesDatabase` method. Only the "mem" and "awsdynamodb" schemes are registered by default. Other
+// gocloud.dev/docstore drivers can be used by calling `RegisterAccessCodeStore` with this method in your own code.
+func NewDocstoreAccessCodeStore(ctx context.Context, uri string) (AccessCodeStore, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	col, err := NewAccessCodesDatabase(ctx, uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewDocstoreAccessCodeStoreWithCollection(col)
+
+	// DynamoDB removes expired access codes itself if TimeToLive has been enabled for the table (for
+	// example by cmd/relay-tables). If its status can't be determined assume that it hasn't been.
+
+	if u.Scheme == "awsdynamodb" {
+
+		client, err := aa_dynamodb.NewClientWithURI(ctx, uri)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create DynamoDB client, %w", err)
+		}
+
+		table := u.Host
+
+		if table == "" {
+			table = DefaultDynamoDBAccessCodesTable
+		}
+
+		enabled, err := DynamoDBTimeToLiveEnabled(ctx, client, table)
+
+		if err == nil {
+			s.expires = enabled
+		}
+	}
+
+	return s, nil
+}
+
+// NewDocstoreAccessCodeStoreWithCollection returns a new `DocstoreAccessCodeStore` instance for 'col'.
+func NewDocstoreAccessCodeStoreWithCollection(col *docstore.Collection) *DocstoreAccessCodeStore {
+
+	s := &DocstoreAccessCodeStore{
+		collection: col,
+	}
+
+	return s
+}
+
+// Collection returns the underlying `docstore.Collection` instance.
+func (s *DocstoreAccessCodeStore) Collection() *docstore.Collection {
+	return s.collection
+}
+
+// Put stores 'rc' in the collection.
+func (s *DocstoreAccessCodeStore) Put(ctx context.Context, rc *RelayCode) error {
+
+	err := s.collection.Create(ctx, rc)
+
+	if err != nil {
+
+		if gcerrors.Code(err) == gcerrors.AlreadyExists {
+			return fmt.Errorf("%w, '%s'", ErrCodeExists, rc.Code)
+		}
+
+		return fmt.Errorf("Failed to store code, %w", err)
+	}
+
+	return nil
+}
+
+// Get returns the `RelayCode` for 'code' from the collection.
+func (s *DocstoreAccessCodeStore) Get(ctx context.Context, code string) (*RelayCode, error) {
+
+	rc := &RelayCode{
+		Code: code,
+	}
+
+	err := s.collection.Get(ctx, rc)
+
+	if err != nil {
+
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, fmt.Errorf("%w, '%s'", ErrCodeNotFound, code)
+		}
+
+		return nil, fmt.Errorf("Failed to retrieve code, %w", err)
+	}
+
+	return rc, nil
+}
+
+// Current returns the most recently created `RelayCode` for 'room' created within the last 'ttl' seconds.
+func (s *DocstoreAccessCodeStore) Current(ctx context.Context, room string, ttl int) (*RelayCode, error) {
+	return currentRelayCodeWithCollection(ctx, s.collection, room, ttl)
+}
+
+// MarkUsed sets the last update time for 'code' to 'ts'.
+func (s *DocstoreAccessCodeStore) MarkUsed(ctx context.Context, code string, ts int64) error {
+
+	mod := docstore.Mods{"LastUpdate": ts}
+	err := s.collection.Update(ctx, &RelayCode{Code: code}, mod)
+
+	if err != nil {
+
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return fmt.Errorf("%w, '%s'", ErrCodeNotFound, code)
+		}
+
+		return fmt.Errorf("Failed to update code, %w", err)
+	}
+
+	return nil
+}
+
+// Prune removes all the `RelayCode` records whose expiry date is less than 'expires' from the collection.
+func (s *DocstoreAccessCodeStore) Prune(ctx context.Context, expires int64) error {
+	return PruneAccessCodesDatabase(ctx, s.collection, expires)
+}
+
+// Next returns the oldest `RelayCode` for the same room as 'rc' that was created after 'rc', or nil if there is no newer code.
+func (s *DocstoreAccessCodeStore) Next(ctx context.Context, rc *RelayCode) (*RelayCode, error) {
+	return NextRelayCodeWithCollection(ctx, s.collection, rc)
+}
+
+// Revoke marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as revoked.
+func (s *DocstoreAccessCodeStore) Revoke(ctx context.Context, rc *RelayCode) error {
+	return RevokeRelayCodesWithCollection(ctx, s.collection, rc)
+}
+
+// Supersede marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as superseded.
+func (s *DocstoreAccessCodeStore) Supersede(ctx context.Context, rc *RelayCode) error {
+	return SupersedeRelayCodesWithCollection(ctx, s.collection, rc)
+}
+
+// Claim records 'session' as the session token for 'rc' using the document revision of 'rc' to ensure that it
+// has not been claimed since it was retrieved.
+func (s *DocstoreAccessCodeStore) Claim(ctx context.Context, rc *RelayCode, session string) error {
+	return claimRelayCodeWithCollection(ctx, s.collection, rc, session)
+}
+
+// AcquireLease attempts to acquire (or renew) the lease named 'name' for 'holder' for 'ttl' seconds.
+func (s *DocstoreAccessCodeStore) AcquireLease(ctx context.Context, name string, holder string, ttl int) (bool, error) {
+	return AcquireLeaseWithCollection(ctx, s.collection, name, holder, ttl)
+}
+
+// ReleaseLease releases the lease named 'name' if it is held by 'holder'.
+func (s *DocstoreAccessCodeStore) ReleaseLease(ctx context.Context, name string, holder string) error {
+	return ReleaseLeaseWithCollection(ctx, s.collection, name, holder)
+}
+
+// ExpiresAccessCodes returns a boolean value indicating whether the underlying database removes expired access codes
+// itself, which is true for DynamoDB tables opened with `NewDocstoreAccessCodeStore`.
+func (s *DocstoreAccessCodeStore) ExpiresAccessCodes() bool {
+	return s.expires
+}
+
+// Close closes the underlying collection.
+func (s *DocstoreAccessCodeStore) Close() error {
+	return s.collection.Close()
+}
@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// type MemoryStore implements the `AccessCodeStore` and `Store` interfaces for `RelayCode` records stored in memory.
+// It has no external dependencies and is intended for testing and for embedding the relay in other applications.
+type MemoryStore struct {
+	AccessCodeStore
+	codes  map[string]RelayCode
+	leases map[string]relayLease
+	mu     *sync.RWMutex
+}
+
+// NewMemoryStore returns a new (empty) `MemoryStore` instance.
+func NewMemoryStore() *MemoryStore {
+
+	s := &MemoryStore{
+		codes:  make(map[string]RelayCode),
+		leases: make(map[string]relayLease),
+		mu:     new(sync.RWMutex),
+	}
+
+	return s
+}
+
+// Put stores a copy of 'rc'.
+func (s *MemoryStore) Put(ctx context.Context, rc *RelayCode) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.codes[rc.Code]
+
+	if exists {
+		return fmt.Errorf("%w, '%s'", ErrCodeExists, rc.Code)
+	}
+
+	s.codes[rc.Code] = *rc
+	return nil
+}
+
+// Get returns a copy of the `RelayCode` for 'code'.
+func (s *MemoryStore) Get(ctx context.Context, code string) (*RelayCode, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rc, exists := s.codes[code]
+
+	if !exists {
+		return nil, fmt.Errorf("%w, '%s'", ErrCodeNotFound, code)
+	}
+
+	return &rc, nil
+}
+
+// Current returns the most recently created `RelayCode` for 'room' created within the last 'ttl' seconds.
+func (s *MemoryStore) Current(ctx context.Context, room string, ttl int) (*RelayCode, error) {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var current *RelayCode
+
+	for _, rc := range s.codes {
+
+		if rc.Room != room || rc.Created <= ts-int64(ttl) {
+			continue
+		}
+
+		if current == nil || rc.Created > current.Created {
+			c := rc
+			current = &c
+		}
+	}
+
+	return current, nil
+}
+
+// MarkUsed sets the last update time for 'code' to 'ts'.
+func (s *MemoryStore) MarkUsed(ctx context.Context, code string, ts int64) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rc, exists := s.codes[code]
+
+	if !exists {
+		return fmt.Errorf("%w, '%s'", ErrCodeNotFound, code)
+	}
+
+	rc.LastUpdate = ts
+	s.codes[code] = rc
+
+	return nil
+}
+
+// Prune removes all the `RelayCode` records whose expiry date is less than 'expires'.
+func (s *MemoryStore) Prune(ctx context.Context, expires int64) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for code, rc := range s.codes {
+
+		if rc.Expires < expires {
+			delete(s.codes, code)
+		}
+	}
+
+	return nil
+}
+
+// Next returns the oldest `RelayCode` for the same room as 'rc' that was created after 'rc', or nil if there is no newer code.
+func (s *MemoryStore) Next(ctx context.Context, rc *RelayCode) (*RelayCode, error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var next_code *RelayCode
+
+	for _, other_code := range s.codes {
+
+		if other_code.Room != rc.Room || other_code.Created <= rc.Created {
+			continue
+		}
+
+		if next_code == nil || other_code.Created < next_code.Created {
+			c := other_code
+			next_code = &c
+		}
+	}
+
+	return next_code, nil
+}
+
+// Revoke marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as revoked.
+func (s *MemoryStore) Revoke(ctx context.Context, rc *RelayCode) error {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for code, other_code := range s.codes {
+
+		if other_code.Room != rc.Room || other_code.Created > rc.Created || code == rc.Code || other_code.Revoked != 0 {
+			continue
+		}
+
+		other_code.Revoked = ts
+		s.codes[code] = other_code
+	}
+
+	return nil
+}
+
+// Supersede marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as superseded.
+func (s *MemoryStore) Supersede(ctx context.Context, rc *RelayCode) error {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for code, other_code := range s.codes {
+
+		if other_code.Room != rc.Room || other_code.Created > rc.Created || code == rc.Code || other_code.Superseded != 0 {
+			continue
+		}
+
+		other_code.Superseded = ts
+		s.codes[code] = other_code
+	}
+
+	return nil
+}
+
+// Claim records 'session' as the session token for 'rc' if, and only if, it has not already been claimed.
+func (s *MemoryStore) Claim(ctx context.Context, rc *RelayCode, session string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.codes[rc.Code]
+
+	if !exists {
+		return fmt.Errorf("%w, '%s'", ErrCodeNotFound, rc.Code)
+	}
+
+	if stored.Session != "" {
+		return fmt.Errorf("%w, code was claimed by another controller", ErrClaimedCode)
+	}
+
+	stored.Session = session
+	s.codes[rc.Code] = stored
+
+	rc.Session = session
+	return nil
+}
+
+// AcquireLease attempts to acquire (or renew) the lease named 'name' for 'holder' for 'ttl' seconds.
+func (s *MemoryStore) AcquireLease(ctx context.Context, name string, holder string, ttl int) (bool, error) {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease, exists := s.leases[name]
+
+	if exists && lease.LeaseHolder != holder && lease.LeaseExpires >= ts {
+		return false, nil
+	}
+
+	s.leases[name] = relayLease{
+		Code:         leaseKeyPrefix + name,
+		LeaseHolder:  holder,
+		LeaseExpires: ts + int64(ttl),
+	}
+
+	return true, nil
+}
+
+// ReleaseLease releases the lease named 'name' if it is held by 'holder'.
+func (s *MemoryStore) ReleaseLease(ctx context.Context, name string, holder string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease, exists := s.leases[name]
+
+	if exists && lease.LeaseHolder == holder {
+		delete(s.leases, name)
+	}
+
+	return nil
+}
+
+// Close is a no-op.
+func (s *MemoryStore) Close() error {
+	return nil
+}
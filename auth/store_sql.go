@@ -0,0 +1,546 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The default name of the table used to store `RelayCode` records in a SQL database.
+const DefaultSQLAccessCodesTable string = "access_codes"
+
+// The SQL dialects supported by `SQLAccessCodeStore`.
+const (
+	sqlDialectSQLite   string = "sqlite"
+	sqlDialectPostgres string = "postgres"
+)
+
+// The database/sql driver names to look for, in order of preference, for each SQL dialect.
+var sqlDriverNames = map[string][]string{
+	sqlDialectSQLite:   []string{"sqlite", "sqlite3"},
+	sqlDialectPostgres: []string{"postgres", "pgx"},
+}
+
+var re_sql_table = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// SQLTables is a map of SQL dialects to the statements used to create the tables (and indices) used by
+// `SQLAccessCodeStore`. This is the SQL equivalent of `DynamoDBTables`. Table names are substituted using the
+// "{TABLE}" placeholder.
+var SQLTables = map[string][]string{
+	sqlDialectSQLite: []string{
+		`CREATE TABLE IF NOT EXISTS {TABLE} (
+			code TEXT PRIMARY KEY,
+			room TEXT NOT NULL,
+			created INTEGER NOT NULL,
+			last_update INTEGER NOT NULL DEFAULT 0,
+			expires INTEGER NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			superseded INTEGER NOT NULL DEFAULT 0,
+			session TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS {TABLE}_room ON {TABLE} (room, created)`,
+		`CREATE INDEX IF NOT EXISTS {TABLE}_expires ON {TABLE} (expires)`,
+		`CREATE TABLE IF NOT EXISTS {TABLE}_leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires INTEGER NOT NULL
+		)`,
+	},
+	sqlDialectPostgres: []string{
+		`CREATE TABLE IF NOT EXISTS {TABLE} (
+			code TEXT PRIMARY KEY,
+			room TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			last_update BIGINT NOT NULL DEFAULT 0,
+			expires BIGINT NOT NULL,
+			revoked BIGINT NOT NULL DEFAULT 0,
+			superseded BIGINT NOT NULL DEFAULT 0,
+			session TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS {TABLE}_room ON {TABLE} (room, created)`,
+		`CREATE INDEX IF NOT EXISTS {TABLE}_expires ON {TABLE} (expires)`,
+		`CREATE TABLE IF NOT EXISTS {TABLE}_leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+	},
+}
+
+// type SQLAccessCodeStore implements the `AccessCodeStore` and `Store` interfaces for `RelayCode` records stored in a SQLite or
+// Postgres database using the database/sql package. This package does not import any database drivers; you will need
+// to import a SQLite (for example modernc.org/sqlite or github.com/mattn/go-sqlite3) or Postgres (for example
+// github.com/lib/pq or github.com/jackc/pgx/v5/stdlib) driver in your own code.
+type SQLAccessCodeStore struct {
+	AccessCodeStore
+	db      *sql.DB
+	dialect string
+	table   string
+}
+
+func init() {
+
+	ctx := context.Background()
+
+	for _, scheme := range []string{"sqlite", "sqlite3", "postgres", "postgresql"} {
+		RegisterAccessCodeStore(ctx, scheme, NewSQLAccessCodeStore)
+	}
+}
+
+// NewSQLAccessCodeStore returns a new `SQLAccessCodeStore` instance derived from 'uri' which is expected to take the form of:
+//
+//	sqlite://{PATH}?{PARAMETERS}
+//	postgres://{USER}:{PASSWORD}@{HOST}:{PORT}/{DATABASE}?{PARAMETERS}
+//
+// Where {PARAMETERS} may be:
+// * `?driver=` The name of the database/sql driver to use. Default is the first registered driver for the dialect
+// ("sqlite" or "sqlite3" for SQLite; "postgres" or "pgx" for Postgres).
+// * `?table=` The name of the table to store access codes in. Default is "access_codes".
+// * `?create-tables=` A boolean flag indicating whether the table (and indices) should be created if they do not exist. Default is false.
+// Tables can also be created using the `SQLTableManager` implementation of the `TableManager` interface (or cmd/relay-tables).
+//
+// Any other parameters are passed to the database/sql driver.
+func NewSQLAccessCodeStore(ctx context.Context, uri string) (AccessCodeStore, error) {
+
+	s, create_tables, err := openSQLAccessCodeStore(ctx, uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if create_tables {
+
+		err = s.CreateTables(ctx)
+
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		return s, nil
+	}
+
+	_, err = s.db.ExecContext(ctx, s.query(`SELECT code FROM {TABLE} WHERE 1 = 0`))
+
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to query table '%s' (create it using cmd/relay-tables or the ?create-tables=true parameter), %w", s.table, err)
+	}
+
+	return s, nil
+}
+
+// openSQLAccessCodeStore returns a new `SQLAccessCodeStore` instance derived from 'uri' (as described in `NewSQLAccessCodeStore`)
+// and a boolean value indicating whether the URI's `?create-tables=` parameter was set. Tables are not created.
+func openSQLAccessCodeStore(ctx context.Context, uri string) (*SQLAccessCodeStore, bool, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	var dialect string
+
+	switch u.Scheme {
+	case "sqlite", "sqlite3":
+		dialect = sqlDialectSQLite
+	case "postgres", "postgresql":
+		dialect = sqlDialectPostgres
+	default:
+		return nil, false, fmt.Errorf("Unsupported scheme, %s", u.Scheme)
+	}
+
+	driver := q.Get("driver")
+
+	if driver == "" {
+
+		d, err := sqlDriverName(dialect)
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		driver = d
+	}
+
+	table := DefaultSQLAccessCodesTable
+
+	if q.Has("table") {
+		table = q.Get("table")
+	}
+
+	if !re_sql_table.MatchString(table) {
+		return nil, false, fmt.Errorf("Invalid ?table= parameter")
+	}
+
+	create_tables, err := createTablesQueryParameter(q)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	q.Del("driver")
+	q.Del("table")
+	q.Del("create-tables")
+
+	var dsn string
+
+	switch dialect {
+	case sqlDialectSQLite:
+
+		dsn = u.Host + u.Path
+
+		if dsn == "" {
+			return nil, false, fmt.Errorf("Missing database path")
+		}
+
+	default:
+
+		u.RawQuery = ""
+		dsn = u.String()
+	}
+
+	if len(q) > 0 {
+		dsn = fmt.Sprintf("%s?%s", dsn, q.Encode())
+	}
+
+	db, err := sql.Open(driver, dsn)
+
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to open database, %w", err)
+	}
+
+	err = db.PingContext(ctx)
+
+	if err != nil {
+		db.Close()
+		return nil, false, fmt.Errorf("Failed to connect to database, %w", err)
+	}
+
+	if dialect == sqlDialectSQLite {
+		// SQLite only supports a single writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLAccessCodeStore{
+		db:      db,
+		dialect: dialect,
+		table:   table,
+	}
+
+	return s, create_tables, nil
+}
+
+// CreateTables creates the table (and indices) used to store access codes if they do not already exist.
+func (s *SQLAccessCodeStore) CreateTables(ctx context.Context) error {
+
+	for _, stmt := range SQLTables[s.dialect] {
+
+		stmt = strings.ReplaceAll(stmt, "{TABLE}", s.table)
+		_, err := s.db.ExecContext(ctx, stmt)
+
+		if err != nil {
+			return fmt.Errorf("Failed to create tables, %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Put stores 'rc' in the database.
+func (s *SQLAccessCodeStore) Put(ctx context.Context, rc *RelayCode) error {
+
+	q := s.query(`INSERT INTO {TABLE} (code, room, created, last_update, expires, revoked, superseded, session)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (code) DO NOTHING`)
+
+	rsp, err := s.db.ExecContext(ctx, q, rc.Code, rc.Room, rc.Created, rc.LastUpdate, rc.Expires, rc.Revoked, rc.Superseded, rc.Session)
+
+	if err != nil {
+		return fmt.Errorf("Failed to store code, %w", err)
+	}
+
+	count, err := rsp.RowsAffected()
+
+	if err != nil {
+		return fmt.Errorf("Failed to determine rows affected, %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w, '%s'", ErrCodeExists, rc.Code)
+	}
+
+	return nil
+}
+
+// Get returns the `RelayCode` for 'code' from the database.
+func (s *SQLAccessCodeStore) Get(ctx context.Context, code string) (*RelayCode, error) {
+
+	q := s.query(`SELECT code, room, created, last_update, expires, revoked, superseded, session FROM {TABLE} WHERE code = ?`)
+	row := s.db.QueryRowContext(ctx, q, code)
+
+	rc, err := scanRelayCode(row)
+
+	if err != nil {
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w, '%s'", ErrCodeNotFound, code)
+		}
+
+		return nil, fmt.Errorf("Failed to retrieve code, %w", err)
+	}
+
+	return rc, nil
+}
+
+// Current returns the most recently created `RelayCode` for 'room' created within the last 'ttl' seconds.
+func (s *SQLAccessCodeStore) Current(ctx context.Context, room string, ttl int) (*RelayCode, error) {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	q := s.query(`SELECT code, room, created, last_update, expires, revoked, superseded, session FROM {TABLE}
+		WHERE room = ? AND created > ? ORDER BY created DESC LIMIT 1`)
+
+	row := s.db.QueryRowContext(ctx, q, room, ts-int64(ttl))
+
+	rc, err := scanRelayCode(row)
+
+	if err != nil {
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed to retrieve current code, %w", err)
+	}
+
+	return rc, nil
+}
+
+// MarkUsed sets the last update time for 'code' to 'ts'.
+func (s *SQLAccessCodeStore) MarkUsed(ctx context.Context, code string, ts int64) error {
+
+	q := s.query(`UPDATE {TABLE} SET last_update = ? WHERE code = ?`)
+	rsp, err := s.db.ExecContext(ctx, q, ts, code)
+
+	if err != nil {
+		return fmt.Errorf("Failed to update code, %w", err)
+	}
+
+	count, err := rsp.RowsAffected()
+
+	if err != nil {
+		return fmt.Errorf("Failed to determine rows affected, %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w, '%s'", ErrCodeNotFound, code)
+	}
+
+	return nil
+}
+
+// Prune removes all the `RelayCode` records whose expiry date is less than 'expires' from the database.
+func (s *SQLAccessCodeStore) Prune(ctx context.Context, expires int64) error {
+
+	q := s.query(`DELETE FROM {TABLE} WHERE expires < ?`)
+	_, err := s.db.ExecContext(ctx, q, expires)
+
+	if err != nil {
+		return fmt.Errorf("Failed to prune codes, %w", err)
+	}
+
+	return nil
+}
+
+// Next returns the oldest `RelayCode` for the same room as 'rc' that was created after 'rc', or nil if there is no newer code.
+func (s *SQLAccessCodeStore) Next(ctx context.Context, rc *RelayCode) (*RelayCode, error) {
+
+	q := s.query(`SELECT code, room, created, last_update, expires, revoked, superseded, session FROM {TABLE}
+		WHERE room = ? AND created > ? ORDER BY created ASC LIMIT 1`)
+
+	row := s.db.QueryRowContext(ctx, q, rc.Room, rc.Created)
+
+	next_code, err := scanRelayCode(row)
+
+	if err != nil {
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed to retrieve next code, %w", err)
+	}
+
+	return next_code, nil
+}
+
+// Revoke marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as revoked.
+func (s *SQLAccessCodeStore) Revoke(ctx context.Context, rc *RelayCode) error {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	q := s.query(`UPDATE {TABLE} SET revoked = ? WHERE room = ? AND created <= ? AND code != ? AND revoked = 0`)
+	_, err := s.db.ExecContext(ctx, q, ts, rc.Room, rc.Created, rc.Code)
+
+	if err != nil {
+		return fmt.Errorf("Failed to revoke codes, %w", err)
+	}
+
+	return nil
+}
+
+// Supersede marks the codes for the same room as 'rc' and created at or before 'rc' (excluding 'rc' itself) as superseded.
+func (s *SQLAccessCodeStore) Supersede(ctx context.Context, rc *RelayCode) error {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	q := s.query(`UPDATE {TABLE} SET superseded = ? WHERE room = ? AND created <= ? AND code != ? AND superseded = 0`)
+	_, err := s.db.ExecContext(ctx, q, ts, rc.Room, rc.Created, rc.Code)
+
+	if err != nil {
+		return fmt.Errorf("Failed to supersede codes, %w", err)
+	}
+
+	return nil
+}
+
+// Claim records 'session' as the session token for 'rc' if, and only if, it has not already been claimed.
+func (s *SQLAccessCodeStore) Claim(ctx context.Context, rc *RelayCode, session string) error {
+
+	q := s.query(`UPDATE {TABLE} SET session = ? WHERE code = ? AND session = ''`)
+	rsp, err := s.db.ExecContext(ctx, q, session, rc.Code)
+
+	if err != nil {
+		return fmt.Errorf("Failed to claim code, %w", err)
+	}
+
+	count, err := rsp.RowsAffected()
+
+	if err != nil {
+		return fmt.Errorf("Failed to determine rows affected, %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w, code was claimed by another controller", ErrClaimedCode)
+	}
+
+	rc.Session = session
+	return nil
+}
+
+// AcquireLease attempts to acquire (or renew) the lease named 'name' for 'holder' for 'ttl' seconds. Leases are
+// stored in a separate "{TABLE}_leases" table and are acquired using a single conditional "upsert" statement.
+func (s *SQLAccessCodeStore) AcquireLease(ctx context.Context, name string, holder string, ttl int) (bool, error) {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	q := s.query(`INSERT INTO {TABLE}_leases (name, holder, expires) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires = excluded.expires
+		WHERE {TABLE}_leases.holder = excluded.holder OR {TABLE}_leases.expires < ?`)
+
+	rsp, err := s.db.ExecContext(ctx, q, name, holder, ts+int64(ttl), ts)
+
+	if err != nil {
+		return false, fmt.Errorf("Failed to acquire lease '%s', %w", name, err)
+	}
+
+	count, err := rsp.RowsAffected()
+
+	if err != nil {
+		return false, fmt.Errorf("Failed to determine rows affected, %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// ReleaseLease releases the lease named 'name' if it is held by 'holder'.
+func (s *SQLAccessCodeStore) ReleaseLease(ctx context.Context, name string, holder string) error {
+
+	q := s.query(`DELETE FROM {TABLE}_leases WHERE name = ? AND holder = ?`)
+	_, err := s.db.ExecContext(ctx, q, name, holder)
+
+	if err != nil {
+		return fmt.Errorf("Failed to release lease '%s', %w", name, err)
+	}
+
+	return nil
+}
+
+// Close closes the underlying database connection.
+func (s *SQLAccessCodeStore) Close() error {
+	return s.db.Close()
+}
+
+// query substitutes the table name for "{TABLE}" in 'q' and, for Postgres, replaces "?" placeholders with
+// numbered ("$1", "$2", etc.) placeholders.
+func (s *SQLAccessCodeStore) query(q string) string {
+
+	q = strings.ReplaceAll(q, "{TABLE}", s.table)
+
+	if s.dialect != sqlDialectPostgres {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+
+	for _, r := range q {
+
+		if r == '?' {
+			n += 1
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// scanRelayCode returns a new `RelayCode` instance derived from 'row'.
+func scanRelayCode(row *sql.Row) (*RelayCode, error) {
+
+	var rc RelayCode
+
+	err := row.Scan(&rc.Code, &rc.Room, &rc.Created, &rc.LastUpdate, &rc.Expires, &rc.Revoked, &rc.Superseded, &rc.Session)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc, nil
+}
+
+// sqlDriverName returns the name of the first registered database/sql driver for 'dialect'.
+func sqlDriverName(dialect string) (string, error) {
+
+	registered := make(map[string]bool)
+
+	for _, name := range sql.Drivers() {
+		registered[name] = true
+	}
+
+	candidates := sqlDriverNames[dialect]
+
+	for _, name := range candidates {
+
+		if registered[name] {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("No database/sql driver registered for %s, expected one of: %s", dialect, strings.Join(candidates, ", "))
+}
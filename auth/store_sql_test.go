@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSQLStore returns a `SQLAccessCodeStore` backed by a temporary SQLite database.
+func newTestSQLStore(t *testing.T) *SQLAccessCodeStore {
+
+	ctx := context.Background()
+
+	sqlite_path := filepath.Join(t.TempDir(), "relay.db")
+	sqlite_uri := fmt.Sprintf("sqlite://%s?create-tables=true", sqlite_path)
+
+	s, err := NewSQLAccessCodeStore(ctx, sqlite_uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store, %v", err)
+	}
+
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	return s.(*SQLAccessCodeStore)
+}
+
+func TestSQLAccessCodeStore(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := newTestSQLStore(t)
+
+	a := putTestCode(t, store, "gallery", "a", 20)
+	b := putTestCode(t, store, "gallery", "b", 10)
+	c := putTestCode(t, store, "gallery", "c", 0)
+	x := putTestCode(t, store, "lobby", "x", 20)
+
+	err := store.Put(ctx, &RelayCode{Room: "lobby", Code: "a", Created: a.Created, Expires: a.Expires})
+
+	if !errors.Is(err, ErrCodeExists) {
+		t.Fatalf("Expected duplicate code to return ErrCodeExists, got %v", err)
+	}
+
+	// Get
+
+	rc, err := store.Get(ctx, "a")
+
+	if err != nil {
+		t.Fatalf("Failed to get code, %v", err)
+	}
+
+	if *rc != *a {
+		t.Fatalf("Expected stored code %v, got %v", a, rc)
+	}
+
+	_, err = store.Get(ctx, "missing")
+
+	if !errors.Is(err, ErrCodeNotFound) {
+		t.Fatalf("Expected missing code to return ErrCodeNotFound, got %v", err)
+	}
+
+	// Current
+
+	rc, err = store.Current(ctx, "gallery", 300)
+
+	if err != nil || rc == nil || rc.Code != c.Code {
+		t.Fatalf("Expected current code to be 'c', got %v (%v)", rc, err)
+	}
+
+	rc, err = store.Current(ctx, "empty", 300)
+
+	if err != nil || rc != nil {
+		t.Fatalf("Expected no current code for empty room, got %v (%v)", rc, err)
+	}
+
+	// Next
+
+	rc, err = store.Next(ctx, a)
+
+	if err != nil || rc == nil || rc.Code != b.Code {
+		t.Fatalf("Expected next code to be 'b', got %v (%v)", rc, err)
+	}
+
+	rc, err = store.Next(ctx, c)
+
+	if err != nil || rc != nil {
+		t.Fatalf("Expected no next code for the newest code, got %v (%v)", rc, err)
+	}
+
+	// MarkUsed
+
+	err = store.MarkUsed(ctx, "a", 1234)
+
+	if err != nil {
+		t.Fatalf("Failed to mark code as used, %v", err)
+	}
+
+	rc, err = store.Get(ctx, "a")
+
+	if err != nil || rc.LastUpdate != 1234 {
+		t.Fatalf("Expected last update to be 1234, got %v (%v)", rc, err)
+	}
+
+	err = store.MarkUsed(ctx, "missing", 1234)
+
+	if !errors.Is(err, ErrCodeNotFound) {
+		t.Fatalf("Expected marking a missing code to return ErrCodeNotFound, got %v", err)
+	}
+
+	// Revoke and Supersede only modify older codes in the same room
+
+	err = store.Revoke(ctx, b)
+
+	if err != nil {
+		t.Fatalf("Failed to revoke codes, %v", err)
+	}
+
+	err = store.Supersede(ctx, c)
+
+	if err != nil {
+		t.Fatalf("Failed to supersede codes, %v", err)
+	}
+
+	tests := []struct {
+		code       string
+		revoked    bool
+		superseded bool
+	}{
+		{a.Code, true, true},
+		{b.Code, false, true},
+		{c.Code, false, false},
+		{x.Code, false, false},
+	}
+
+	for _, test := range tests {
+
+		rc, err := store.Get(ctx, test.code)
+
+		if err != nil {
+			t.Fatalf("Failed to get code '%s', %v", test.code, err)
+		}
+
+		if (rc.Revoked != 0) != test.revoked {
+			t.Fatalf("Expected code '%s' revoked to be %t, got %d", test.code, test.revoked, rc.Revoked)
+		}
+
+		if (rc.Superseded != 0) != test.superseded {
+			t.Fatalf("Expected code '%s' superseded to be %t, got %d", test.code, test.superseded, rc.Superseded)
+		}
+	}
+
+	// Claim
+
+	rc, err = store.Get(ctx, "c")
+
+	if err != nil {
+		t.Fatalf("Failed to get code, %v", err)
+	}
+
+	err = store.Claim(ctx, rc, "session-1")
+
+	if err != nil || rc.Session != "session-1" {
+		t.Fatalf("Failed to claim code, %v", err)
+	}
+
+	other, err := store.Get(ctx, "c")
+
+	if err != nil || other.Session != "session-1" {
+		t.Fatalf("Expected claimed code to be stored with its session, got %v (%v)", other, err)
+	}
+
+	other.Session = ""
+	err = store.Claim(ctx, other, "session-2")
+
+	if !errors.Is(err, ErrClaimedCode) {
+		t.Fatalf("Expected second claim to return ErrClaimedCode, got %v", err)
+	}
+
+	// Prune
+
+	err = store.Prune(ctx, b.Expires)
+
+	if err != nil {
+		t.Fatalf("Failed to prune codes, %v", err)
+	}
+
+	for _, code := range []string{a.Code, x.Code} {
+
+		_, err = store.Get(ctx, code)
+
+		if !errors.Is(err, ErrCodeNotFound) {
+			t.Fatalf("Expected code '%s' to be pruned, got %v", code, err)
+		}
+	}
+
+	for _, code := range []string{b.Code, c.Code} {
+
+		_, err = store.Get(ctx, code)
+
+		if err != nil {
+			t.Fatalf("Expected code '%s' not to be pruned, %v", code, err)
+		}
+	}
+}
+
+func TestSQLAccessCodeStoreQuery(t *testing.T) {
+
+	q := `UPDATE {TABLE} SET session = ? WHERE code = ? AND session = ''`
+
+	tests := map[string]string{
+		sqlDialectSQLite:   `UPDATE codes SET session = ? WHERE code = ? AND session = ''`,
+		sqlDialectPostgres: `UPDATE codes SET session = $1 WHERE code = $2 AND session = ''`,
+	}
+
+	for dialect, expected := range tests {
+
+		s := &SQLAccessCodeStore{
+			dialect: dialect,
+			table:   "codes",
+		}
+
+		str_q := s.query(q)
+
+		if str_q != expected {
+			t.Fatalf("Expected %s query '%s', got '%s'", dialect, expected, str_q)
+		}
+	}
+}
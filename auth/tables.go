@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"github.com/aaronland/go-roster"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// type TableDescription is a struct describing a database table used to store access codes.
+type TableDescription struct {
+	// The name of the table.
+	Name string `json:"name"`
+	// A boolean value indicating whether the table exists.
+	Exists bool `json:"exists"`
+	// Backend-specific details about the table, for example its indices or status.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// type TableManager is an interface for creating, describing, migrating and dropping the database tables used to
+// store access codes. Table managers operate on the same URIs as `NewAccessCodeStore` but, unlike access code stores,
+// do not require that the tables already exist.
+type TableManager interface {
+	// Create creates the tables (and indices) used to store access codes if they do not already exist.
+	Create(context.Context) error
+	// Describe returns a description of each of the tables used to store access codes.
+	Describe(context.Context) ([]*TableDescription, error)
+	// Migrate creates the tables used to store access codes if they do not exist, or updates existing tables to add any
+	// indices (or other properties) they are missing.
+	Migrate(context.Context) error
+	// Drop removes the tables used to store access codes, and all the access codes they contain.
+	Drop(context.Context) error
+	// Close closes the underlying database connection.
+	Close() error
+}
+
+// type TableManagerInitializeFunc is a function used to initialize an implementation of the `TableManager` interface.
+type TableManagerInitializeFunc func(ctx context.Context, uri string) (TableManager, error)
+
+var table_managers roster.Roster
+
+func ensureTableManagerRoster() error {
+
+	if table_managers == nil {
+
+		r, err := roster.NewDefaultRoster()
+
+		if err != nil {
+			return err
+		}
+
+		table_managers = r
+	}
+
+	return nil
+}
+
+// RegisterTableManager registers 'scheme' as a key pointing to 'f' in `NewTableManager` lookups.
+func RegisterTableManager(ctx context.Context, scheme string, f TableManagerInitializeFunc) error {
+
+	err := ensureTableManagerRoster()
+
+	if err != nil {
+		return err
+	}
+
+	return table_managers.Register(ctx, scheme, f)
+}
+
+// TableManagerSchemes returns the sorted list of URI schemes that have been registered with `RegisterTableManager`.
+func TableManagerSchemes() []string {
+
+	ctx := context.Background()
+	schemes := []string{}
+
+	err := ensureTableManagerRoster()
+
+	if err != nil {
+		return schemes
+	}
+
+	for _, dr := range table_managers.Drivers(ctx) {
+		scheme := fmt.Sprintf("%s://", strings.ToLower(dr))
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewTableManager returns a new `TableManager` instance derived from 'uri' whose scheme
+// must have been registered using the `RegisterTableManager` method.
+func NewTableManager(ctx context.Context, uri string) (TableManager, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	scheme := u.Scheme
+
+	err = ensureTableManagerRoster()
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := table_managers.Driver(ctx, scheme)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported table manager '%s', %w", scheme, err)
+	}
+
+	f := i.(TableManagerInitializeFunc)
+	return f(ctx, uri)
+}
+
+// createTablesQueryParameter returns the boolean value of the "create-tables" parameter in 'q', or false if it is not present.
+func createTablesQueryParameter(q url.Values) (bool, error) {
+
+	if !q.Has("create-tables") {
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(q.Get("create-tables"))
+
+	if err != nil {
+		return false, fmt.Errorf("Invalid ?create-tables= parameter, %w", err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aa_dynamodb "github.com/aaronland/go-aws-dynamodb"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"net/url"
+	"time"
+)
+
+// The amount of time to wait between checks for DynamoDB tables (and indices) to become active.
+const dynamoDBTablePollInterval time.Duration = 5 * time.Second
+
+// type DynamoDBTableManager implements the `TableManager` interface for access codes stored in a DynamoDB table.
+type DynamoDBTableManager struct {
+	TableManager
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+func init() {
+	ctx := context.Background()
+	RegisterTableManager(ctx, "awsdynamodb", NewDynamoDBTableManager)
+}
+
+// NewDynamoDBTableManager returns a new `DynamoDBTableManager` instance derived from 'uri' which is expected to be the same
+// "awsdynamodb://" URI passed to `NewAccessCodesDatabase`. The name of the table is derived from the URI's host.
+func NewDynamoDBTableManager(ctx context.Context, uri string) (TableManager, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	client, err := aa_dynamodb.NewClientWithURI(ctx, uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create DynamoDB client, %w", err)
+	}
+
+	m := NewDynamoDBTableManagerWithClient(client, u.Host)
+	return m, nil
+}
+
+// NewDynamoDBTableManagerWithClient returns a new `DynamoDBTableManager` instance for the table named 'table' using 'client'.
+// If 'table' is empty the default "AccessCodes" table name is used.
+func NewDynamoDBTableManagerWithClient(client *dynamodb.DynamoDB, table string) *DynamoDBTableManager {
+
+	if table == "" {
+		table = DefaultDynamoDBAccessCodesTable
+	}
+
+	m := &DynamoDBTableManager{
+		client: client,
+		table:  table,
+	}
+
+	return m
+}
+
+// Create creates the access codes table, waits for it to become active and enables TimeToLive for it. If the table already
+// exists only TimeToLive is enabled.
+func (m *DynamoDBTableManager) Create(ctx context.Context) error {
+
+	tables, specs := DynamoDBAccessCodesTables(m.table)
+
+	table, err := m.describeTable(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if table == nil {
+
+		_, err := m.client.CreateTableWithContext(ctx, tables[m.table])
+
+		if err != nil {
+			return fmt.Errorf("Failed to create table '%s', %w", m.table, err)
+		}
+	}
+
+	err = EnableDynamoDBTimeToLive(ctx, m.client, specs)
+
+	if err != nil {
+		return fmt.Errorf("Failed to enable DynamoDB time to live, %w", err)
+	}
+
+	return nil
+}
+
+// Describe returns a description of the access codes table including its status, indices and TimeToLive settings.
+func (m *DynamoDBTableManager) Describe(ctx context.Context) ([]*TableDescription, error) {
+
+	table, err := m.describeTable(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &TableDescription{
+		Name:   m.table,
+		Exists: table != nil,
+	}
+
+	if table == nil {
+		return []*TableDescription{desc}, nil
+	}
+
+	indices := make([]string, 0)
+
+	for _, idx := range table.GlobalSecondaryIndexes {
+		indices = append(indices, fmt.Sprintf("%s (%s)", aws.StringValue(idx.IndexName), aws.StringValue(idx.IndexStatus)))
+	}
+
+	details := map[string]interface{}{
+		"status":  aws.StringValue(table.TableStatus),
+		"items":   aws.Int64Value(table.ItemCount),
+		"indices": indices,
+	}
+
+	if table.BillingModeSummary != nil {
+		details["billing_mode"] = aws.StringValue(table.BillingModeSummary.BillingMode)
+	}
+
+	ttl_rsp, err := m.client.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(m.table),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to describe time to live for table '%s', %w", m.table, err)
+	}
+
+	if ttl_rsp.TimeToLiveDescription != nil {
+		details["time_to_live"] = map[string]string{
+			"attribute": aws.StringValue(ttl_rsp.TimeToLiveDescription.AttributeName),
+			"status":    aws.StringValue(ttl_rsp.TimeToLiveDescription.TimeToLiveStatus),
+		}
+	}
+
+	desc.Details = details
+	return []*TableDescription{desc}, nil
+}
+
+// Migrate creates the access codes table if it does not exist. Otherwise it adds any global secondary indices which are
+// defined in `DynamoDBTables` but missing from the table, one at a time, and enables TimeToLive for the table.
+func (m *DynamoDBTableManager) Migrate(ctx context.Context) error {
+
+	table, err := m.describeTable(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if table == nil {
+		return m.Create(ctx)
+	}
+
+	tables, specs := DynamoDBAccessCodesTables(m.table)
+	def := tables[m.table]
+
+	existing := make(map[string]bool)
+
+	for _, idx := range table.GlobalSecondaryIndexes {
+		existing[aws.StringValue(idx.IndexName)] = true
+	}
+
+	for _, idx := range def.GlobalSecondaryIndexes {
+
+		if existing[aws.StringValue(idx.IndexName)] {
+			continue
+		}
+
+		// DynamoDB only allows one index to be created at a time so wait for the table (and any
+		// indices it is creating) to become active before each update
+
+		err := m.waitUntilActive(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		update := &dynamodb.UpdateTableInput{
+			TableName:            aws.String(m.table),
+			AttributeDefinitions: def.AttributeDefinitions,
+			GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+				{
+					Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+						IndexName:  idx.IndexName,
+						KeySchema:  idx.KeySchema,
+						Projection: idx.Projection,
+					},
+				},
+			},
+		}
+
+		_, err = m.client.UpdateTableWithContext(ctx, update)
+
+		if err != nil {
+			return fmt.Errorf("Failed to create index '%s' for table '%s', %w", aws.StringValue(idx.IndexName), m.table, err)
+		}
+	}
+
+	err = m.waitUntilActive(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	err = EnableDynamoDBTimeToLive(ctx, m.client, specs)
+
+	if err != nil {
+		return fmt.Errorf("Failed to enable DynamoDB time to live, %w", err)
+	}
+
+	return nil
+}
+
+// Drop deletes the access codes table, if it exists, and waits for it to be removed.
+func (m *DynamoDBTableManager) Drop(ctx context.Context) error {
+
+	_, err := m.client.DeleteTableWithContext(ctx, &dynamodb.DeleteTableInput{
+		TableName: aws.String(m.table),
+	})
+
+	if err != nil {
+
+		if isDynamoDBResourceNotFound(err) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed to delete table '%s', %w", m.table, err)
+	}
+
+	err = m.client.WaitUntilTableNotExistsWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(m.table),
+	})
+
+	if err != nil {
+		return fmt.Errorf("Failed to wait for table '%s' to be deleted, %w", m.table, err)
+	}
+
+	return nil
+}
+
+// Close is a no-op since DynamoDB clients do not hold open connections.
+func (m *DynamoDBTableManager) Close() error {
+	return nil
+}
+
+// describeTable returns the description of the access codes table, or nil if it does not exist.
+func (m *DynamoDBTableManager) describeTable(ctx context.Context) (*dynamodb.TableDescription, error) {
+
+	rsp, err := m.client.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(m.table),
+	})
+
+	if err != nil {
+
+		if isDynamoDBResourceNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed to describe table '%s', %w", m.table, err)
+	}
+
+	return rsp.Table, nil
+}
+
+// waitUntilActive waits until the access codes table and all of its global secondary indices are active.
+func (m *DynamoDBTableManager) waitUntilActive(ctx context.Context) error {
+
+	ticker := time.NewTicker(dynamoDBTablePollInterval)
+	defer ticker.Stop()
+
+	for {
+
+		table, err := m.describeTable(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if table == nil {
+			return fmt.Errorf("Table '%s' does not exist", m.table)
+		}
+
+		active := aws.StringValue(table.TableStatus) == dynamodb.TableStatusActive
+
+		for _, idx := range table.GlobalSecondaryIndexes {
+
+			if aws.StringValue(idx.IndexStatus) != dynamodb.IndexStatusActive {
+				active = false
+			}
+		}
+
+		if active {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			// pass
+		}
+	}
+}
+
+// isDynamoDBResourceNotFound returns a boolean value indicating whether 'err' is a DynamoDB "ResourceNotFoundException" error.
+func isDynamoDBResourceNotFound(err error) bool {
+
+	var aws_err awserr.Error
+
+	if !errors.As(err, &aws_err) {
+		return false
+	}
+
+	return aws_err.Code() == dynamodb.ErrCodeResourceNotFoundException
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	aa_dynamodb "github.com/aaronland/go-aws-dynamodb"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// The name of the environment variable containing the endpoint of a DynamoDB instance (for example dynamodb-local
+// running on http://localhost:8000) to test against. If it is not set the DynamoDB tests are skipped.
+const testDynamoDBEndpointEnvVar string = "RELAY_TEST_DYNAMODB_ENDPOINT"
+
+func TestDynamoDBTableManagerTimeToLive(t *testing.T) {
+
+	endpoint := os.Getenv(testDynamoDBEndpointEnvVar)
+
+	if endpoint == "" {
+		t.Skipf("%s is not set", testDynamoDBEndpointEnvVar)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	table := fmt.Sprintf("RelayTest%d", time.Now().UnixNano())
+
+	q := url.Values{}
+	q.Set("region", "us-east-1")
+	q.Set("partition_key", "Code")
+	q.Set("credentials", "static:local:local:local")
+	q.Set("endpoint", endpoint)
+
+	uri := fmt.Sprintf("awsdynamodb://%s?%s", table, q.Encode())
+
+	m, err := NewTableManager(ctx, uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create table manager, %v", err)
+	}
+
+	defer m.Close()
+
+	err = m.Create(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to create table, %v", err)
+	}
+
+	dropped := false
+
+	defer func() {
+
+		if !dropped {
+			m.Drop(context.Background())
+		}
+	}()
+
+	client, err := aa_dynamodb.NewClientWithURI(ctx, uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create DynamoDB client, %v", err)
+	}
+
+	enabled, err := DynamoDBTimeToLiveEnabled(ctx, client, table)
+
+	if err != nil {
+		t.Fatalf("Failed to determine whether time to live is enabled, %v", err)
+	}
+
+	if !enabled {
+		t.Fatalf("Expected time to live to be enabled for table '%s'", table)
+	}
+
+	store, err := NewStore(ctx, uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create store, %v", err)
+	}
+
+	defer store.Close()
+
+	expiring_store, ok := store.(ExpiringStore)
+
+	if !ok || !expiring_store.ExpiresAccessCodes() {
+		t.Fatalf("Expected store for table '%s' to expire access codes itself", table)
+	}
+
+	retention, err := NewRetentionPolicyForStore(ctx, "", store)
+
+	if err != nil {
+		t.Fatalf("Failed to create retention policy, %v", err)
+	}
+
+	_, ok = retention.(*NoneRetentionPolicy)
+
+	if !ok {
+		t.Fatalf("Expected none:// retention policy, got %T", retention)
+	}
+
+	err = m.Drop(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to drop table, %v", err)
+	}
+
+	dropped = true
+
+	tables, err := m.Describe(ctx)
+
+	if err != nil {
+		t.Fatalf("Failed to describe table, %v", err)
+	}
+
+	if len(tables) != 1 || tables[0].Exists {
+		t.Fatalf("Expected table '%s' to have been dropped", table)
+	}
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// type MemoryTableManager implements the `TableManager` interface for in-memory gocloud.dev/docstore collections. Since
+// in-memory collections are created when they are opened, and only exist for the lifetime of a process, all of its
+// methods are no-ops.
+type MemoryTableManager struct {
+	TableManager
+	collection string
+}
+
+func init() {
+	ctx := context.Background()
+	RegisterTableManager(ctx, "mem", NewMemoryTableManager)
+}
+
+// NewMemoryTableManager returns a new `MemoryTableManager` instance derived from 'uri' which is expected to be the same
+// "mem://" URI passed to `NewAccessCodesDatabase`.
+func NewMemoryTableManager(ctx context.Context, uri string) (TableManager, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	m := &MemoryTableManager{
+		collection: u.Host,
+	}
+
+	return m, nil
+}
+
+// Create is a no-op since in-memory collections are created when they are opened.
+func (m *MemoryTableManager) Create(ctx context.Context) error {
+	return nil
+}
+
+// Describe returns a description of the in-memory collection noting that it is not persisted.
+func (m *MemoryTableManager) Describe(ctx context.Context) ([]*TableDescription, error) {
+
+	desc := &TableDescription{
+		Name:   m.collection,
+		Exists: false,
+		Details: map[string]interface{}{
+			"persistent": false,
+		},
+	}
+
+	return []*TableDescription{desc}, nil
+}
+
+// Migrate is a no-op since in-memory collections are created when they are opened.
+func (m *MemoryTableManager) Migrate(ctx context.Context) error {
+	return nil
+}
+
+// Drop is a no-op since in-memory collections are removed when the process that opened them exits.
+func (m *MemoryTableManager) Drop(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op.
+func (m *MemoryTableManager) Close() error {
+	return nil
+}
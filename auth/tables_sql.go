@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// sqlAddedColumns is a map of SQL dialects to the columns of the access codes table, and their definitions, which may
+// be missing from tables created by earlier versions of this package. Columns are added, in order, by `SQLTableManager.Migrate`.
+var sqlAddedColumns = map[string][][2]string{
+	sqlDialectSQLite: [][2]string{
+		{"last_update", "INTEGER NOT NULL DEFAULT 0"},
+		{"revoked", "INTEGER NOT NULL DEFAULT 0"},
+		{"superseded", "INTEGER NOT NULL DEFAULT 0"},
+		{"session", "TEXT NOT NULL DEFAULT ''"},
+	},
+	sqlDialectPostgres: [][2]string{
+		{"last_update", "BIGINT NOT NULL DEFAULT 0"},
+		{"revoked", "BIGINT NOT NULL DEFAULT 0"},
+		{"superseded", "BIGINT NOT NULL DEFAULT 0"},
+		{"session", "TEXT NOT NULL DEFAULT ''"},
+	},
+}
+
+// type SQLTableManager implements the `TableManager` interface for access codes stored in a SQLite or Postgres database
+// by `SQLAccessCodeStore`.
+type SQLTableManager struct {
+	TableManager
+	store *SQLAccessCodeStore
+}
+
+func init() {
+
+	ctx := context.Background()
+
+	for _, scheme := range []string{"sqlite", "sqlite3", "postgres", "postgresql"} {
+		RegisterTableManager(ctx, scheme, NewSQLTableManager)
+	}
+}
+
+// NewSQLTableManager returns a new `SQLTableManager` instance derived from 'uri' which takes the same form, and parameters,
+// as the URIs passed to `NewSQLAccessCodeStore`. The `?create-tables=` parameter is ignored.
+func NewSQLTableManager(ctx context.Context, uri string) (TableManager, error) {
+
+	s, _, err := openSQLAccessCodeStore(ctx, uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SQLTableManager{
+		store: s,
+	}
+
+	return m, nil
+}
+
+// Create creates the access codes and leases tables (and indices) if they do not already exist.
+func (m *SQLTableManager) Create(ctx context.Context) error {
+	return m.store.CreateTables(ctx)
+}
+
+// Describe returns a description of the access codes and leases tables including their columns, indices and number of rows.
+func (m *SQLTableManager) Describe(ctx context.Context) ([]*TableDescription, error) {
+
+	descriptions := make([]*TableDescription, 0)
+
+	for _, table := range m.tables() {
+
+		columns, err := m.columns(ctx, table)
+
+		if err != nil {
+			return nil, err
+		}
+
+		desc := &TableDescription{
+			Name:   table,
+			Exists: len(columns) > 0,
+		}
+
+		if desc.Exists {
+
+			indices, err := m.indices(ctx, table)
+
+			if err != nil {
+				return nil, err
+			}
+
+			var count int64
+
+			row := m.store.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+			err = row.Scan(&count)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to count rows for table '%s', %w", table, err)
+			}
+
+			desc.Details = map[string]interface{}{
+				"dialect": m.store.dialect,
+				"columns": columns,
+				"indices": indices,
+				"rows":    count,
+			}
+		}
+
+		descriptions = append(descriptions, desc)
+	}
+
+	return descriptions, nil
+}
+
+// Migrate creates the access codes and leases tables (and indices) if they do not exist and adds any columns which are
+// missing from an existing access codes table.
+func (m *SQLTableManager) Migrate(ctx context.Context) error {
+
+	err := m.store.CreateTables(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	columns, err := m.columns(ctx, m.store.table)
+
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+
+	for _, name := range columns {
+		existing[name] = true
+	}
+
+	for _, col := range sqlAddedColumns[m.store.dialect] {
+
+		if existing[col[0]] {
+			continue
+		}
+
+		q := m.store.query(fmt.Sprintf("ALTER TABLE {TABLE} ADD COLUMN %s %s", col[0], col[1]))
+		_, err := m.store.db.ExecContext(ctx, q)
+
+		if err != nil {
+			return fmt.Errorf("Failed to add column '%s' to table '%s', %w", col[0], m.store.table, err)
+		}
+	}
+
+	return nil
+}
+
+// Drop removes the access codes and leases tables, and their indices, if they exist.
+func (m *SQLTableManager) Drop(ctx context.Context) error {
+
+	for _, table := range m.tables() {
+
+		_, err := m.store.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+
+		if err != nil {
+			return fmt.Errorf("Failed to drop table '%s', %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying database connection.
+func (m *SQLTableManager) Close() error {
+	return m.store.Close()
+}
+
+// tables returns the names of the tables used by `SQLAccessCodeStore`.
+func (m *SQLTableManager) tables() []string {
+	return []string{
+		m.store.table,
+		fmt.Sprintf("%s_leases", m.store.table),
+	}
+}
+
+// columns returns the names of the columns in 'table', or an empty list if the table does not exist.
+func (m *SQLTableManager) columns(ctx context.Context, table string) ([]string, error) {
+
+	var q string
+
+	switch m.store.dialect {
+	case sqlDialectPostgres:
+		q = `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 ORDER BY ordinal_position`
+	default:
+		q = `SELECT name FROM pragma_table_info(?) ORDER BY cid`
+	}
+
+	return m.names(ctx, q, m.identifier(table))
+}
+
+// indices returns the names of the indices for 'table'.
+func (m *SQLTableManager) indices(ctx context.Context, table string) ([]string, error) {
+
+	var q string
+
+	switch m.store.dialect {
+	case sqlDialectPostgres:
+		q = `SELECT indexname FROM pg_indexes WHERE schemaname = current_schema() AND tablename = $1 ORDER BY indexname`
+	default:
+		q = `SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? ORDER BY name`
+	}
+
+	return m.names(ctx, q, m.identifier(table))
+}
+
+// identifier returns 'table' as it is stored in the database catalog. Postgres folds unquoted identifiers to lower case.
+func (m *SQLTableManager) identifier(table string) string {
+
+	if m.store.dialect == sqlDialectPostgres {
+		return strings.ToLower(table)
+	}
+
+	return table
+}
+
+// names returns the values of the first column of the rows returned by 'q' for 'table'.
+func (m *SQLTableManager) names(ctx context.Context, q string, table string) ([]string, error) {
+
+	rows, err := m.store.db.QueryContext(ctx, q, table)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query schema for table '%s', %w", table, err)
+	}
+
+	defer rows.Close()
+
+	names := make([]string, 0)
+
+	for rows.Next() {
+
+		var name string
+		err := rows.Scan(&name)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to scan schema for table '%s', %w", table, err)
+		}
+
+		names = append(names, name)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to iterate schema for table '%s', %w", table, err)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// type Throttle is a struct that limits the number of failed attempts to use an access code, for example by the
+// clients at a given address, within a period of time. It is intended for short access codes (like those created by
+// `PINAccessCodeGenerator`) which could otherwise be guessed by trying every possible code.
+type Throttle struct {
+	limit    int
+	window   time.Duration
+	failures map[string]*throttleFailures
+	// The time when expired failures were last removed.
+	swept time.Time
+	mu    *sync.Mutex
+}
+
+// type throttleFailures is a struct containing the number of failed attempts recorded for a key.
+type throttleFailures struct {
+	count int
+	// The time when the failures are forgotten. This is 'window' after the first failure.
+	expires time.Time
+}
+
+// NewThrottle returns a new `Throttle` instance which allows up to 'limit' failed attempts for each key within
+// 'window' of the first failure.
+func NewThrottle(limit int, window time.Duration) *Throttle {
+
+	t := &Throttle{
+		limit:    limit,
+		window:   window,
+		failures: make(map[string]*throttleFailures),
+		swept:    time.Now(),
+		mu:       new(sync.Mutex),
+	}
+
+	return t
+}
+
+// Attempt returns a boolean value indicating whether 'key' may make another attempt. If it may the attempt is recorded
+// as a failure straight away, so that concurrent attempts can not all be allowed before any of them fail. Attempts
+// which succeed should be refunded by calling `Succeed`.
+func (t *Throttle) Attempt(key string) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	t.sweep(now)
+
+	f, ok := t.failures[key]
+
+	if !ok || now.After(f.expires) {
+
+		f = &throttleFailures{
+			expires: now.Add(t.window),
+		}
+
+		t.failures[key] = f
+	}
+
+	if f.count >= t.limit {
+		return false
+	}
+
+	f.count += 1
+	return true
+}
+
+// Succeed refunds an attempt for 'key', previously allowed by `Attempt`, which did not fail.
+func (t *Throttle) Succeed(key string) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+
+	if !ok || time.Now().After(f.expires) {
+		return
+	}
+
+	f.count -= 1
+
+	if f.count <= 0 {
+		delete(t.failures, key)
+	}
+}
+
+// sweep removes the failures which have expired, at most once per window, so that keys which stop making attempts
+// are eventually forgotten. It is assumed that the throttle's lock is already held.
+func (t *Throttle) sweep(now time.Time) {
+
+	if now.Sub(t.swept) < t.window {
+		return
+	}
+
+	for key, f := range t.failures {
+
+		if now.After(f.expires) {
+			delete(t.failures, key)
+		}
+	}
+
+	t.swept = now
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+
+	window := 100 * time.Millisecond
+	th := NewThrottle(3, window)
+
+	for i := 0; i < 3; i++ {
+
+		if !th.Attempt("a") {
+			t.Fatalf("Expected attempt %d to be allowed", i+1)
+		}
+	}
+
+	if th.Attempt("a") {
+		t.Fatalf("Expected attempts to be refused after 3 failures")
+	}
+
+	// Other keys are throttled independently
+
+	if !th.Attempt("b") {
+		t.Fatalf("Expected attempts for another key to be allowed")
+	}
+
+	// Attempts which succeed are refunded
+
+	th.Succeed("b")
+
+	th.mu.Lock()
+	_, ok := th.failures["b"]
+	th.mu.Unlock()
+
+	if ok {
+		t.Fatalf("Expected a successful attempt not to be counted as a failure")
+	}
+
+	// Failures are forgotten once the window has passed
+
+	time.Sleep(window + 20*time.Millisecond)
+
+	if !th.Attempt("a") {
+		t.Fatalf("Expected attempts to be allowed once the window has passed")
+	}
+
+	th.mu.Lock()
+	count := th.failures["a"].count
+	th.mu.Unlock()
+
+	if count != 1 {
+		t.Fatalf("Expected a new window to start with 1 failure, got %d", count)
+	}
+}
+
+func TestThrottleConcurrent(t *testing.T) {
+
+	limit := 5
+	th := NewThrottle(limit, time.Minute)
+
+	// Concurrent attempts, none of which have been checked yet, must not be able to exceed the limit
+
+	start := make(chan struct{})
+	allowed := make(chan bool, 50)
+
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < 50; i++ {
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			<-start
+			allowed <- th.Attempt("a")
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(allowed)
+
+	count := 0
+
+	for ok := range allowed {
+
+		if ok {
+			count += 1
+		}
+	}
+
+	if count != limit {
+		t.Fatalf("Expected %d concurrent attempts to be allowed, got %d", limit, count)
+	}
+}
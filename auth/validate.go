@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gocloud.dev/docstore"
+	"io"
+	"time"
+)
+
+// ErrInvalidCode is returned when an access code does not exist or is not valid for a given room.
+var ErrInvalidCode = errors.New("Invalid access code")
+
+// ErrExpiredCode is returned when an access code has been superseded by a newer access code which is in use.
+var ErrExpiredCode = errors.New("Expired access code")
+
+// ErrRevokedCode is returned when an access code has been explicitly revoked, for example because the access codes for a room were rotated.
+var ErrRevokedCode = errors.New("Revoked access code")
+
+// NextRelayCodeWithCollection returns the oldest `RelayCode` in 'col' for the same room as 'rc' that was
+// created after 'rc'. If there is no newer code then nil is returned.
+func NextRelayCodeWithCollection(ctx context.Context, col *docstore.Collection, rc *RelayCode) (*RelayCode, error) {
+
+	// Note the way we are returning the results in ascending order
+	// This is to ensure that the "last update" checks in ValidateRelayCodeWithStore
+	// always work and don't get unintentionally reset by an updated access
+	// code which is (2+) steps ahead of an expired code but hasn't
+	// been used yet.
+
+	q := col.Query()
+	q = q.Where("Room", "=", rc.Room)
+	q = q.Where("Created", ">", rc.Created)
+
+	// query requires a table scan, but has an ordering requirement;
+	//  add an index or provide Options.RunQueryFallback (code=Unimplemented)
+	q = q.OrderBy("Created", docstore.Ascending)
+
+	iter := q.Get(ctx)
+	defer iter.Stop()
+
+	var next_code RelayCode
+	err := iter.Next(ctx, &next_code)
+
+	// io.EOF is equivalent of "no rows"
+
+	if err == io.EOF {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to iterate through codes, %w", err)
+	}
+
+	return &next_code, nil
+}
+
+// ValidateRelayCodeWithStore retrieves the `RelayCode` for 'code' from 'store' and ensures that it is valid for 'room'
+// and has not been superseded by a newer code which is already in use. If the code does not exist, or belongs to
+// another room, the error returned will wrap `ErrInvalidCode`. If the code has been revoked or superseded the
+// `RelayCode` is returned along with an error wrapping `ErrRevokedCode` or `ErrExpiredCode` respectively.
+func ValidateRelayCodeWithStore(ctx context.Context, store Store, room string, code string) (*RelayCode, error) {
+
+	rc, err := store.Get(ctx, code)
+
+	if err != nil {
+
+		if errors.Is(err, ErrCodeNotFound) {
+			return nil, fmt.Errorf("%w, code does not exist", ErrInvalidCode)
+		}
+
+		return nil, err
+	}
+
+	if rc.Room != room {
+		return nil, fmt.Errorf("%w, code is not valid for room '%s'", ErrInvalidCode, room)
+	}
+
+	if rc.Revoked != 0 {
+		return rc, fmt.Errorf("%w, code was revoked at %d", ErrRevokedCode, rc.Revoked)
+	}
+
+	next_code, err := store.Next(ctx, rc)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to determine next code, %w", err)
+	}
+
+	// There is a newer code. If it's in use then this code is no longer valid
+
+	if next_code != nil && next_code.LastUpdate > rc.Created {
+		return rc, fmt.Errorf("%w, another code ('%s') is in use", ErrExpiredCode, next_code.Code)
+	}
+
+	return rc, nil
+}
+
+// ValidateRelayCode validates 'code' for 'room' using `ValidateSignedRelayCodeWithStore` if 'signer' is not nil
+// or `ValidateRelayCodeWithStore` otherwise.
+func ValidateRelayCode(ctx context.Context, store Store, signer *Signer, room string, code string) (*RelayCode, error) {
+
+	if signer != nil {
+		return ValidateSignedRelayCodeWithStore(ctx, store, signer, room, code)
+	}
+
+	return ValidateRelayCodeWithStore(ctx, store, room, code)
+}
+
+// RevokeRelayCodesWithCollection marks all the unrevoked `RelayCode` records in 'col' for the same room as 'rc'
+// and created at or before 'rc' (excluding 'rc' itself) as revoked.
+func RevokeRelayCodesWithCollection(ctx context.Context, col *docstore.Collection, rc *RelayCode) error {
+
+	now := time.Now()
+	ts := now.Unix()
+
+	q := col.Query()
+	q = q.Where("Room", "=", rc.Room)
+	q = q.Where("Created", "<=", rc.Created)
+
+	iter := q.Get(ctx)
+	defer iter.Stop()
+
+	for {
+
+		var other_code RelayCode
+		err := iter.Next(ctx, &other_code)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to iterate through codes, %w", err)
+		}
+
+		if other_code.Code == rc.Code || other_code.Revoked != 0 {
+			continue
+		}
+
+		mod := docstore.Mods{"Revoked": ts}
+		err = col.Update(ctx, &RelayCode{Code: other_code.Code}, mod)
+
+		if err != nil {
+			return fmt.Errorf("Failed to revoke code '%s', %w", other_code.Code, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+// relay-tables creates, describes, migrates and drops the database tables used to store access codes.
+package main
+
+import (
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "gocloud.dev/docstore/awsdynamodb"
+	_ "gocloud.dev/docstore/memdocstore"
+	_ "modernc.org/sqlite"
+)
+
+import (
+	"context"
+	app "github.com/sfomuseum/www-multiscreen-starter/app/tables"
+	"log"
+)
+
+func main() {
+
+	ctx := context.Background()
+	logger := log.Default()
+
+	err := app.Run(ctx, logger)
+
+	if err != nil {
+		logger.Fatalf("Failed to run application, %v", err)
+	}
+}
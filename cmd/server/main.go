@@ -2,9 +2,11 @@
 package main
 
 import (
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "gocloud.dev/docstore/awsdynamodb"
 	_ "gocloud.dev/docstore/memdocstore"
 	_ "gocloud.dev/pubsub/mempubsub"
+	_ "modernc.org/sqlite"
 )
 
 import (
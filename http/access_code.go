@@ -4,10 +4,8 @@ import (
 	"github.com/sfomuseum/go-pubsub/publisher"
 	"github.com/sfomuseum/www-multiscreen-starter/auth"
 	"github.com/sfomuseum/www-multiscreen-starter/sse"
-	"gocloud.dev/docstore"
 	"log"
 	"net/http"
-	"time"
 )
 
 // AccessCodeHandlerOption defines a struct containing configuration options for the
@@ -15,12 +13,14 @@ import (
 type AccessCodeHandlerOptions struct {
 	// A valid sfomuseum/go-pubsub/publisher.Publisher for broadcasting events.
 	Publisher publisher.Publisher
-	// A valid gocloud.dev/docstore.Collection instance for storing and retrieving access codes.
-	Database *docstore.Collection
+	// A valid auth.Store instance for storing and retrieving access codes.
+	Store auth.Store
 	// A valid *log.Logger  instance
 	Logger *log.Logger
 	// The time to live for access codes
 	TTL int
+	// The name of the room (installation) that access codes are retrieved for.
+	Room string
 }
 
 // AccessCodeHandler returns an HTTP handler that will attempt to retrieve the most
@@ -29,22 +29,9 @@ func AccessCodeHandler(opts *AccessCodeHandlerOptions) (http.Handler, error) {
 
 	fn := func(rsp http.ResponseWriter, req *http.Request) {
 
-		now := time.Now()
-		ts := now.Unix()
-
 		ctx := req.Context()
 
-		q := opts.Database.Query()
-		q = q.Where("Created", ">", ts-int64(opts.TTL))
-
-		// query requires a table scan, but has an ordering requirement; add an index or provide Options.RunQueryFallback (code=Unimplemented)
-		q = q.OrderBy("Created", docstore.Descending)
-
-		iter := q.Get(ctx)
-		defer iter.Stop()
-
-		var rc auth.RelayCode
-		err := iter.Next(ctx, &rc)
+		rc, err := opts.Store.Current(ctx, opts.Room, opts.TTL)
 
 		if err != nil {
 			LogWithRequest(opts.Logger, req, "Failed to retrieve relay code, %v", err)
@@ -52,20 +39,18 @@ func AccessCodeHandler(opts *AccessCodeHandlerOptions) (http.Handler, error) {
 			return
 		}
 
+		if rc == nil {
+			LogWithRequest(opts.Logger, req, "No current relay code for room '%s'", opts.Room)
+			http.Error(rsp, "Not found", http.StatusNotFound)
+			return
+		}
+
 		// START OF reset last update date to 0 - this is mostly for weird edge cases
 		// that pop up during debugging where I restart the (iOS) app before
 		// the most recent access code has expired and I end up with a QR code
 		// that doesn't get hidden (20210816/thisisaaronland)
 
-		update_code := &auth.RelayCode{
-			Code: rc.Code,
-		}
-
-		mod := docstore.Mods{
-			"LastUpdate": 0,
-		}
-
-		err = opts.Database.Update(ctx, update_code, mod)
+		err = opts.Store.MarkUsed(ctx, rc.Code, 0)
 
 		if err != nil {
 			LogWithRequest(opts.Logger, req, "Failed to set last update for '%s', %v", rc.Code, err)
@@ -75,7 +60,7 @@ func AccessCodeHandler(opts *AccessCodeHandlerOptions) (http.Handler, error) {
 
 		// END OF reset last update date to 0
 
-		msg := sse.NewAccessCodeMessage(rc)
+		msg := sse.NewAccessCodeMessage(opts.Room, rc)
 		err = msg.Publish(ctx, opts.Publisher)
 
 		if err != nil {
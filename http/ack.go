@@ -0,0 +1,79 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/sfomuseum/www-multiscreen-starter/ack"
+	"log"
+	"net/http"
+)
+
+// AcknowledgementHandlerOptions defines a struct containing configuration options for the
+// AcknowledgementHandler http.Handler
+type AcknowledgementHandlerOptions struct {
+	// A valid ack.Tracker instance containing messages awaiting acknowledgement.
+	Acknowledgements *ack.Tracker
+	// A valid *log.Logger  instance
+	Logger *log.Logger
+	// The name of the room (installation) that acknowledgements are received from.
+	Room string
+	// The shared secret receivers must present, as a bearer token in the "Authorization" header or as the
+	// `ReceiverTokenParameter` query parameter, in order to acknowledge messages. If empty all requests are refused.
+	ReceiverSecret string
+}
+
+// The maximum size, in bytes, of acknowledgements sent by receivers.
+const maxAcknowledgementBodySize int64 = 1024
+
+// AcknowledgementHandler returns an HTTP handler that accepts POST requests from a receiver containing a
+// JSON-encoded `ack.Acknowledgement` and notifies the controller that sent the matching message. Requests which do
+// not present the receiver secret are refused.
+func AcknowledgementHandler(opts *AcknowledgementHandlerOptions) (http.Handler, error) {
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		if req.Method != "POST" {
+			http.Error(rsp, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !isAuthorizedReceiver(req, opts.ReceiverSecret) {
+			LogWithRequest(opts.Logger, req, "Refusing unauthorized acknowledgement")
+			http.Error(rsp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var a *ack.Acknowledgement
+
+		body := http.MaxBytesReader(rsp, req.Body, maxAcknowledgementBodySize)
+
+		dec := json.NewDecoder(body)
+		err := dec.Decode(&a)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to decode acknowledgement, %v", err)
+			http.Error(rsp, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		err = a.Validate()
+
+		if err != nil {
+			http.Error(rsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ok := opts.Acknowledgements.Acknowledge(opts.Room, a)
+
+		if !ok {
+			LogWithRequest(opts.Logger, req, "No message '%s' awaiting acknowledgement", a.ID)
+			http.Error(rsp, "Not found", http.StatusNotFound)
+			return
+		}
+
+		rsp.Write([]byte("OK"))
+		return
+	}
+
+	h := http.HandlerFunc(fn)
+	return h, nil
+}
@@ -0,0 +1,426 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aaronland/go-string/random"
+	"github.com/gorilla/websocket"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"sync"
+	"time"
+)
+
+// The maximum number of frames to buffer for a controller whose connection has dropped. If more frames are sent
+// the oldest frames are discarded.
+const maxBufferedFrames int = 64
+
+// errSessionEnded is returned when a frame is sent to a controller whose session has ended.
+var errSessionEnded = errors.New("Controller session has ended")
+
+// type websocketController implements the `hub.Controller` interface for controllers connected over WebSockets.
+// A controller may outlive the WebSocket connection it was created for. If the controller has been issued a resume
+// token its connection may be released, in which case frames sent to the controller are buffered until it is resumed
+// by a new connection or a grace period elapses and its session ends.
+type websocketController struct {
+	id           string
+	room         string
+	code         string
+	conn         *websocket.Conn
+	conn_mu      *sync.RWMutex
+	code_mu      *sync.RWMutex
+	write_wait   time.Duration
+	resume_token string
+	detached     bool
+	// A boolean flag indicating whether the frames buffered while the controller was detached are being written
+	// to its new connection. Frames sent in the meantime are added to the buffer so that they are written in order.
+	flushing    bool
+	expired     bool
+	ended       bool
+	buffer      [][]byte
+	grace_timer *time.Timer
+	// A boolean flag indicating whether responses are sent as JSON-encoded `ws.ResponseMessage` frames, as negotiated
+	// by the controller's current connection, rather than bare strings.
+	envelopes bool
+	state_mu  *sync.Mutex
+}
+
+// newWebsocketController returns a new `websocketController` instance for 'conn' in 'room'. 'mu' is the lock
+// used to serialize write operations on 'conn'. If 'envelopes' is true responses are sent as JSON-encoded
+// `ws.ResponseMessage` frames.
+func newWebsocketController(room string, conn *websocket.Conn, mu *sync.RWMutex, write_wait time.Duration, envelopes bool) (*websocketController, error) {
+
+	id, err := newControllerID()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &websocketController{
+		id:         id,
+		room:       room,
+		conn:       conn,
+		conn_mu:    mu,
+		code_mu:    new(sync.RWMutex),
+		write_wait: write_wait,
+		buffer:     make([][]byte, 0),
+		envelopes:  envelopes,
+		state_mu:   new(sync.Mutex),
+	}
+
+	return c, nil
+}
+
+// ID returns the unique identifier for the controller's connection.
+func (c *websocketController) ID() string {
+	return c.id
+}
+
+// Room returns the name of the room (installation) the controller is connected to.
+func (c *websocketController) Room() string {
+	return c.room
+}
+
+// Code returns the access code most recently validated for the controller.
+func (c *websocketController) Code() string {
+
+	c.code_mu.RLock()
+	defer c.code_mu.RUnlock()
+
+	return c.code
+}
+
+// SetCode assigns the access code most recently validated for the controller.
+func (c *websocketController) SetCode(code string) {
+
+	c.code_mu.Lock()
+	defer c.code_mu.Unlock()
+
+	c.code = code
+}
+
+// ResumeToken returns the token used to resume the controller's session, or an empty string if none has been issued.
+func (c *websocketController) ResumeToken() string {
+
+	c.state_mu.Lock()
+	defer c.state_mu.Unlock()
+
+	return c.resume_token
+}
+
+// SetResumeToken assigns the token used to resume the controller's session.
+func (c *websocketController) SetResumeToken(token string) {
+
+	c.state_mu.Lock()
+	defer c.state_mu.Unlock()
+
+	c.resume_token = token
+}
+
+// Send JSON-encodes 'msg' and writes it to the controller's WebSocket connection. If the controller's connection
+// has been released the message is buffered until the controller is resumed.
+func (c *websocketController) Send(ctx context.Context, msg interface{}) error {
+
+	enc, err := json.Marshal(msg)
+
+	if err != nil {
+		return fmt.Errorf("Failed to encode message, %w", err)
+	}
+
+	return c.write(enc)
+}
+
+// SendResponse writes 'rsp' to the controller's WebSocket connection, either as a JSON-encoded frame if the connection
+// negotiated the `ws.ResponseEnvelopeProtocol` subprotocol or as a bare string containing its type. If the controller's
+// connection has been released the response is buffered until the controller is resumed.
+func (c *websocketController) SendResponse(ctx context.Context, rsp *ws.ResponseMessage) error {
+
+	frame, err := c.responseFrame(rsp)
+
+	if err != nil {
+		return err
+	}
+
+	return c.write(frame)
+}
+
+// Expire sends an "expired" message to the controller and then cleanly closes its WebSocket connection. If the controller's
+// connection has been released its session is ended immediately rather than waiting for the grace period to elapse.
+func (c *websocketController) Expire(ctx context.Context) error {
+
+	c.state_mu.Lock()
+
+	c.expired = true
+
+	if c.detached {
+
+		// If the timer has already fired the session is already ending
+		if c.grace_timer.Stop() {
+			c.grace_timer.Reset(0)
+		}
+
+		c.state_mu.Unlock()
+		return nil
+	}
+
+	conn := c.conn
+	mu := c.conn_mu
+
+	c.state_mu.Unlock()
+
+	if conn == nil {
+		return errSessionEnded
+	}
+
+	frame, err := c.responseFrame(ws.NewErrorResponseMessage("expired", "", "Code has expired"))
+
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	deadline := time.Now().Add(c.write_wait)
+
+	conn.SetWriteDeadline(deadline)
+	err = conn.WriteMessage(websocket.TextMessage, frame)
+
+	if err != nil {
+		return fmt.Errorf("Failed to send expiry notice, %w", err)
+	}
+
+	close_msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "expired")
+	err = conn.WriteControl(websocket.CloseMessage, close_msg, deadline)
+
+	if err != nil {
+		return fmt.Errorf("Failed to send close message, %w", err)
+	}
+
+	// Don't wait (forever) for the client to acknowledge the close message
+
+	conn.SetReadDeadline(deadline)
+	return nil
+}
+
+// Release detaches the controller from 'conn', which is expected to be closing. If the controller has been issued a
+// resume token, and has not expired, frames sent to the controller will be buffered for up to 'grace' while waiting
+// for it to be resumed. If the controller is not resumed within 'grace', or cannot be resumed, 'on_end' is invoked.
+// If the controller has already been resumed by another connection this method does nothing.
+func (c *websocketController) Release(conn *websocket.Conn, grace time.Duration, on_end func()) {
+
+	c.state_mu.Lock()
+
+	if c.ended || c.conn != conn {
+		c.state_mu.Unlock()
+		return
+	}
+
+	c.conn = nil
+	c.flushing = false
+
+	if grace <= 0 || c.resume_token == "" || c.expired {
+		c.ended = true
+		c.state_mu.Unlock()
+		on_end()
+		return
+	}
+
+	c.detached = true
+
+	c.grace_timer = time.AfterFunc(grace, func() {
+
+		c.state_mu.Lock()
+		c.ended = true
+		c.detached = false
+		c.buffer = nil
+		c.state_mu.Unlock()
+
+		on_end()
+	})
+
+	c.state_mu.Unlock()
+}
+
+// Resume attaches the controller to 'conn', writes 'msg' (if not nil) followed by any frames that were buffered
+// while the controller was detached and returns true. 'token' is the resume token presented by the controller and
+// 'next_token' replaces it, so that each token can only be used once. 'envelopes' is whether responses are sent over
+// 'conn' as JSON-encoded `ws.ResponseMessage` frames. If the controller is still attached to another connection that
+// connection is closed. If 'token' is not the controller's current resume token, or the controller's session has
+// ended, or it has expired, false is returned.
+func (c *websocketController) Resume(conn *websocket.Conn, mu *sync.RWMutex, envelopes bool, token string, next_token string, msg interface{}) bool {
+
+	c.state_mu.Lock()
+
+	if c.ended || c.expired || c.resume_token == "" || c.resume_token != token {
+		c.state_mu.Unlock()
+		return false
+	}
+
+	if c.detached {
+
+		// The grace period has already elapsed and the session is ending
+		if !c.grace_timer.Stop() {
+			c.state_mu.Unlock()
+			return false
+		}
+
+		c.detached = false
+		c.grace_timer = nil
+	}
+
+	// Controllers often reconnect before the server has noticed that their previous connection
+	// has dropped so take over the session and close the previous connection.
+
+	prev_conn := c.conn
+
+	c.conn = conn
+	c.conn_mu = mu
+	c.envelopes = envelopes
+	c.resume_token = next_token
+	c.flushing = true
+
+	frames := c.buffer
+	c.buffer = make([][]byte, 0)
+
+	c.state_mu.Unlock()
+
+	if prev_conn != nil && prev_conn != conn {
+		prev_conn.Close()
+	}
+
+	if msg != nil {
+
+		enc, err := json.Marshal(msg)
+
+		if err == nil {
+			frames = append([][]byte{enc}, frames...)
+		}
+	}
+
+	// The buffered frames are written without holding the controller's state lock, so that a slow connection does
+	// not block other operations on the controller, until there are no more frames left in the buffer.
+
+	for {
+
+		err := c.writeFrames(conn, mu, frames)
+
+		c.state_mu.Lock()
+
+		// Another connection has resumed the controller and will write the remaining frames
+		if c.conn != conn {
+			c.state_mu.Unlock()
+			break
+		}
+
+		frames = c.buffer
+		c.buffer = make([][]byte, 0)
+
+		if err != nil || len(frames) == 0 {
+			c.flushing = false
+			c.state_mu.Unlock()
+			break
+		}
+
+		c.state_mu.Unlock()
+	}
+
+	return true
+}
+
+// writeFrames writes 'frames' to 'conn', using 'mu' to serialize write operations, stopping at the first error.
+func (c *websocketController) writeFrames(conn *websocket.Conn, mu *sync.RWMutex, frames [][]byte) error {
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, f := range frames {
+
+		conn.SetWriteDeadline(time.Now().Add(c.write_wait))
+		err := conn.WriteMessage(websocket.TextMessage, f)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write writes 'frame' to the controller's WebSocket connection as a text message or, if the controller's
+// connection has been released or the frames buffered while it was released are still being written, adds it to
+// the controller's buffer.
+func (c *websocketController) write(frame []byte) error {
+
+	c.state_mu.Lock()
+
+	if c.ended {
+		c.state_mu.Unlock()
+		return errSessionEnded
+	}
+
+	if c.detached || c.flushing {
+
+		c.buffer = append(c.buffer, frame)
+
+		if len(c.buffer) > maxBufferedFrames {
+			c.buffer = c.buffer[len(c.buffer)-maxBufferedFrames:]
+		}
+
+		c.state_mu.Unlock()
+		return nil
+	}
+
+	conn := c.conn
+	mu := c.conn_mu
+
+	c.state_mu.Unlock()
+
+	if conn == nil {
+		return errSessionEnded
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(c.write_wait))
+	return conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+// responseFrame returns the frame for 'rsp', either a JSON-encoded `ws.ResponseMessage` or a bare string containing
+// its type, depending on the subprotocol negotiated by the controller's current connection.
+func (c *websocketController) responseFrame(rsp *ws.ResponseMessage) ([]byte, error) {
+
+	c.state_mu.Lock()
+	envelopes := c.envelopes
+	c.state_mu.Unlock()
+
+	if !envelopes {
+		return []byte(rsp.Type), nil
+	}
+
+	enc, err := json.Marshal(rsp)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode response, %w", err)
+	}
+
+	return enc, nil
+}
+
+// newControllerID returns a new unique identifier for a controller connection.
+func newControllerID() (string, error) {
+
+	opts := random.DefaultOptions()
+	opts.Length = 16
+	opts.AlphaNumeric = true
+
+	id, err := random.String(opts)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create controller ID, %w", err)
+	}
+
+	return id, nil
+}
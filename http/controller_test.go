@@ -0,0 +1,262 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebsocketConns returns a function which opens a new WebSocket connection to a test server, returning both the
+// server and client ends of the connection.
+func testWebsocketConns(t *testing.T) func() (*websocket.Conn, *websocket.Conn) {
+
+	server_conns := make(chan *websocket.Conn)
+
+	upgrader := websocket.Upgrader{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+
+		conn, err := upgrader.Upgrade(rsp, req, nil)
+
+		if err != nil {
+			t.Errorf("Failed to upgrade connection, %v", err)
+			return
+		}
+
+		server_conns <- conn
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return func() (*websocket.Conn, *websocket.Conn) {
+
+		uri := "ws" + strings.TrimPrefix(srv.URL, "http")
+		client_conn, _, err := websocket.DefaultDialer.Dial(uri, nil)
+
+		if err != nil {
+			t.Fatalf("Failed to dial test server, %v", err)
+		}
+
+		t.Cleanup(func() {
+			client_conn.Close()
+		})
+
+		return <-server_conns, client_conn
+	}
+}
+
+// readTestFrame returns the next frame written to 'conn'.
+func readTestFrame(t *testing.T, conn *websocket.Conn) string {
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, frame, err := conn.ReadMessage()
+
+	if err != nil {
+		t.Fatalf("Failed to read frame, %v", err)
+	}
+
+	return string(frame)
+}
+
+func TestWebsocketControllerResume(t *testing.T) {
+
+	ctx := context.Background()
+
+	dial := testWebsocketConns(t)
+
+	server_conn, _ := dial()
+
+	c, err := newWebsocketController("default", server_conn, new(sync.RWMutex), time.Second, true)
+
+	if err != nil {
+		t.Fatalf("Failed to create controller, %v", err)
+	}
+
+	c.SetResumeToken("token-1")
+
+	ended := make(chan bool, 1)
+
+	c.Release(server_conn, time.Minute, func() {
+		ended <- true
+	})
+
+	// Frames sent while the controller is detached are buffered
+
+	for _, msg := range []string{"a", "b"} {
+
+		err := c.Send(ctx, msg)
+
+		if err != nil {
+			t.Fatalf("Failed to send message while detached, %v", err)
+		}
+	}
+
+	next_conn, next_client := dial()
+	next_mu := new(sync.RWMutex)
+
+	if c.Resume(next_conn, next_mu, true, "not-the-token", "token-2", nil) {
+		t.Fatalf("Expected controller not to be resumed with the wrong token")
+	}
+
+	resumed_msg := ws.NewResumedMessage("token-2", 60)
+
+	if !c.Resume(next_conn, next_mu, true, "token-1", "token-2", resumed_msg) {
+		t.Fatalf("Expected controller to be resumed")
+	}
+
+	// Resume tokens are replaced once they have been used
+
+	if c.ResumeToken() != "token-2" {
+		t.Fatalf("Expected resume token to be replaced, got '%s'", c.ResumeToken())
+	}
+
+	var rsp *ws.ResumeMessage
+	err = json.Unmarshal([]byte(readTestFrame(t, next_client)), &rsp)
+
+	if err != nil || rsp.Type != "resumed" || rsp.Token != "token-2" || rsp.Grace != 60 {
+		t.Fatalf("Expected resumed message with the new token, got %v (%v)", rsp, err)
+	}
+
+	for _, expected := range []string{`"a"`, `"b"`} {
+
+		frame := readTestFrame(t, next_client)
+
+		if frame != expected {
+			t.Fatalf("Expected buffered frame %s, got %s", expected, frame)
+		}
+	}
+
+	// Frames sent once the controller has been resumed are written straight away
+
+	err = c.Send(ctx, "c")
+
+	if err != nil {
+		t.Fatalf("Failed to send message, %v", err)
+	}
+
+	frame := readTestFrame(t, next_client)
+
+	if frame != `"c"` {
+		t.Fatalf("Expected frame \"c\", got %s", frame)
+	}
+
+	// The previous token can not be used again
+
+	other_conn, _ := dial()
+
+	if c.Resume(other_conn, new(sync.RWMutex), true, "token-1", "token-3", nil) {
+		t.Fatalf("Expected controller not to be resumed with a token which has already been used")
+	}
+
+	select {
+	case <-ended:
+		t.Fatalf("Expected resumed session not to end")
+	default:
+		// pass
+	}
+}
+
+func TestWebsocketControllerResumeUnlocked(t *testing.T) {
+
+	ctx := context.Background()
+
+	dial := testWebsocketConns(t)
+
+	server_conn, _ := dial()
+
+	c, err := newWebsocketController("default", server_conn, new(sync.RWMutex), time.Second, true)
+
+	if err != nil {
+		t.Fatalf("Failed to create controller, %v", err)
+	}
+
+	c.SetResumeToken("token-1")
+	c.Release(server_conn, time.Minute, func() {})
+
+	err = c.Send(ctx, "a")
+
+	if err != nil {
+		t.Fatalf("Failed to send message while detached, %v", err)
+	}
+
+	// Hold the new connection's write lock, as a slow write would, while the controller is resumed
+
+	next_conn, next_client := dial()
+	next_mu := new(sync.RWMutex)
+
+	next_mu.Lock()
+
+	resumed := make(chan bool)
+
+	go func() {
+		resumed <- c.Resume(next_conn, next_mu, true, "token-1", "token-2", nil)
+	}()
+
+	// The controller's state is not locked while the buffered frames are waiting to be written
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for c.ResumeToken() != "token-2" {
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for controller to be resumed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Frames sent in the meantime do not wait for the connection and are written after the buffered frames
+
+	sent := make(chan error)
+
+	go func() {
+		sent <- c.Send(ctx, "b")
+	}()
+
+	select {
+	case err := <-sent:
+
+		if err != nil {
+			t.Fatalf("Failed to send message while resuming, %v", err)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out sending message while resuming")
+	}
+
+	next_mu.Unlock()
+
+	if !<-resumed {
+		t.Fatalf("Expected controller to be resumed")
+	}
+
+	for _, expected := range []string{`"a"`, `"b"`} {
+
+		frame := readTestFrame(t, next_client)
+
+		if frame != expected {
+			t.Fatalf("Expected frame %s, got %s", expected, frame)
+		}
+	}
+
+	// Once the buffer has been written frames are written straight away
+
+	err = c.Send(ctx, "c")
+
+	if err != nil {
+		t.Fatalf("Failed to send message, %v", err)
+	}
+
+	frame := readTestFrame(t, next_client)
+
+	if frame != `"c"` {
+		t.Fatalf("Expected frame \"c\", got %s", frame)
+	}
+}
@@ -0,0 +1,56 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ReceiverTokenParameter is the name of the query parameter receivers may use to present their credential when they
+// can not set an "Authorization" header, for example when opening a WebSocket connection from a web browser.
+const ReceiverTokenParameter string = "receiver_token"
+
+// isAuthorizedReceiver returns a boolean value indicating whether 'req' presents 'secret', either as a bearer token in
+// its "Authorization" header or as the `ReceiverTokenParameter` query parameter. If 'secret' is empty all requests
+// are refused.
+func isAuthorizedReceiver(req *http.Request, secret string) bool {
+
+	if secret == "" {
+		return false
+	}
+
+	token := ""
+
+	scheme, credential, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		token = strings.TrimSpace(credential)
+	}
+
+	if token == "" {
+		token = req.URL.Query().Get(ReceiverTokenParameter)
+	}
+
+	if token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// NewReceiverSecret returns a new random shared secret for receivers to present.
+func NewReceiverSecret() (string, error) {
+
+	b := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, b)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create receiver secret, %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,89 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/hub"
+	"github.com/sfomuseum/www-multiscreen-starter/sse"
+	"log"
+)
+
+// ExpireControllersOptions defines a struct containing configuration options for the ExpireControllers method.
+type ExpireControllersOptions struct {
+	// A valid hub.Hub instance containing the controllers connected to the server.
+	Controllers *hub.Hub
+	// A valid auth.Store instance for storing and retrieving access codes.
+	Store auth.Store
+	// An optional auth.Signer instance used to validate signed (stateless) access codes. If nil access codes are validated using Store.
+	Signer *auth.Signer
+	// A valid publisher.Publisher instance used to publish "codeExpired" events.
+	Publisher publisher.Publisher
+	// A valid *log.Logger  instance
+	Logger *log.Logger
+	// The name of the room (installation) whose controllers should be checked.
+	Room string
+	// If true only controllers whose access codes have been revoked are expired. Controllers whose codes have
+	// been superseded by a newer code which is in use are left alone. This is used when the controller queue is
+	// enabled since it, rather than the use of newer codes, determines who is in control.
+	RevokedOnly bool
+}
+
+// ExpireControllers sends an "expired" message to, and closes the connection of, every controller in a room whose
+// access code is no longer valid, publishing a "codeExpired" event for each one. It returns the number of controllers
+// that were expired.
+func ExpireControllers(ctx context.Context, opts *ExpireControllersOptions) int {
+
+	// Multiple controllers may be using the same code so only validate each code once
+
+	expired_codes := make(map[string]bool)
+	count := 0
+
+	for _, c := range opts.Controllers.Controllers(opts.Room) {
+
+		code := c.Code()
+
+		if code == "" {
+			continue
+		}
+
+		is_expired, ok := expired_codes[code]
+
+		if !ok {
+
+			_, err := auth.ValidateRelayCode(ctx, opts.Store, opts.Signer, opts.Room, code)
+
+			is_expired = errors.Is(err, auth.ErrRevokedCode)
+
+			if !opts.RevokedOnly && errors.Is(err, auth.ErrExpiredCode) {
+				is_expired = true
+			}
+
+			expired_codes[code] = is_expired
+		}
+
+		if !is_expired {
+			continue
+		}
+
+		opts.Logger.Printf("Expire controller '%s' in room '%s' using code '%s'", c.ID(), opts.Room, code)
+
+		err := c.Expire(ctx)
+
+		if err != nil {
+			opts.Logger.Printf("Failed to expire controller '%s' in room '%s', %v", c.ID(), opts.Room, err)
+		}
+
+		msg := sse.NewCodeExpiredMessage(opts.Room, c.ID(), code)
+		err = msg.Publish(ctx, opts.Publisher)
+
+		if err != nil {
+			opts.Logger.Printf("Failed to publish code expired event for room '%s', %v", opts.Room, err)
+		}
+
+		count += 1
+	}
+
+	return count
+}
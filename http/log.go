@@ -3,7 +3,9 @@ package http
 import (
 	"fmt"
 	"log"
+	"net"
 	gohttp "net/http"
+	"strings"
 )
 
 // LogWithRequest will prepend the remote address of 'req' to 'msg' before printing to 'logger'.
@@ -11,3 +13,40 @@ func LogWithRequest(logger *log.Logger, req *gohttp.Request, msg string, args ..
 	msg = fmt.Sprintf("%s %s", req.RemoteAddr, msg)
 	logger.Printf(msg, args...)
 }
+
+// remoteAddress returns the remote address of 'req' without its port number.
+func remoteAddress(req *gohttp.Request) string {
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// clientAddress returns the address of the client that sent 'req'. If 'header' is not empty it is the name of a
+// trusted header (for example "X-Forwarded-For") set by the proxy or load balancer in front of the server. Proxies
+// append the address of the client they are forwarding to the header so the last address in the header is used,
+// since any preceding addresses may have been sent by the client itself. If 'header' is empty, or is not present
+// in 'req', the remote address of 'req' is used.
+func clientAddress(req *gohttp.Request, header string) string {
+
+	if header != "" {
+
+		values := req.Header.Values(header)
+
+		if len(values) > 0 {
+
+			addrs := strings.Split(values[len(values)-1], ",")
+			addr := strings.TrimSpace(addrs[len(addrs)-1])
+
+			if addr != "" {
+				return addr
+			}
+		}
+	}
+
+	return remoteAddress(req)
+}
@@ -0,0 +1,404 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/sfomuseum/www-multiscreen-starter/ack"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/hub"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
+	"github.com/sfomuseum/www-multiscreen-starter/sse"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The path prefix for receiver Websocket connections. Since this is also matched by the "/ws/{ROOM}" path used by
+// controllers "receiver" can not be used as a room name.
+const ReceiverWebsocketPrefix string = "/ws/receiver"
+
+// The maximum size, in bytes, of messages sent by receivers. This is larger than the limit for controllers since
+// receivers may publish their state.
+const receiverReadLimit int64 = 8192
+
+// ReceiverWebsocketHandlerOptions defines a struct containing configuration options for use by
+// the http.Handler return by the ReceiverWebsocketHandler method.
+type ReceiverWebsocketHandlerOptions struct {
+	// A valid sse.RoomsBroker instance used to subscribe to the messages dispatched to the room.
+	Broker *sse.RoomsBroker
+	// An optional ack.Tracker instance used to notify controllers when receivers acknowledge messages.
+	Acknowledgements *ack.Tracker
+	// An optional hub.Hub instance containing the controllers that state messages are dispatched to.
+	Controllers *hub.Hub
+	// A valid auth.Store instance used to validate the access codes of controllers before dispatching state messages.
+	Store auth.Store
+	// An optional auth.Signer instance used to validate signed (stateless) access codes. If nil access codes are validated using Store.
+	Signer *auth.Signer
+	// The amount of time to allow for Websocket pong requests.
+	PongWait time.Duration
+	// The amount of time to allow for Websocket ping requests.
+	PingPeriod time.Duration
+	// The amount of time to allow Websocket write operations to complete.
+	WriteWait time.Duration
+	// A custom "check origin" function to pass to the gorilla/websocket.Upgrader method.
+	CheckOrigin func(r *http.Request) bool
+	// A valid *log.Logger  instance
+	Logger *log.Logger
+	// The name of the room (installation) that messages are delivered from.
+	Room string
+	// The shared secret receivers must present, as a bearer token in the "Authorization" header or as the
+	// `ReceiverTokenParameter` query parameter, when they connect in order to acknowledge messages or publish their
+	// state. Receivers which do not may still receive messages. If empty all "ack" and "state" messages are refused.
+	ReceiverSecret string
+}
+
+// ReceiverWebsocketHandler returns an http.Handler that delivers the messages dispatched to a room to receivers over
+// a Websocket connection, as an alternative to SSE. Each message is sent as a text frame containing a JSON-encoded
+// `sse.SSEMessage` with an additional "event_id" property, if the message has an identifier. Receivers which reconnect
+// with a "last_event_id" query parameter (or a "Last-Event-ID" header) are sent the messages they missed first, or a
+// "reset" message if those messages can not be replayed. Receivers may send JSON-encoded `ws.ReceiverMessage` frames
+// to acknowledge messages ("ack"), to publish their state to controllers ("state") or to check the connection ("ping").
+// Receivers must present the receiver secret when they connect in order to send "ack" or "state" messages, otherwise
+// they are answered with an "unauthorized" frame. Receivers which announce a protocol version (see
+// `protocol.Role.NegotiateRequest`) are sent a "hello" message first and messages adapted to that version. Receivers
+// which announce an unsupported version are refused.
+func ReceiverWebsocketHandler(opts *ReceiverWebsocketHandlerOptions) (http.Handler, error) {
+
+	if opts.Broker == nil {
+		return nil, fmt.Errorf("Missing SSE broker")
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  512,
+		WriteBufferSize: 512,
+		CheckOrigin:     opts.CheckOrigin,
+	}
+
+	state_opts := &StateHandlerOptions{
+		Controllers: opts.Controllers,
+		Store:       opts.Store,
+		Signer:      opts.Signer,
+		Logger:      opts.Logger,
+		Room:        opts.Room,
+	}
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		if req.Method != "GET" {
+			http.Error(rsp, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h, err := protocol.Receiver.NegotiateRequest(req)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Refusing receiver, %v", err)
+			http.Error(rsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Browsers can not set headers when opening a Websocket connection so the receiver secret may also be
+		// passed as a query parameter
+
+		authorized := isAuthorizedReceiver(req, opts.ReceiverSecret)
+
+		ctx := req.Context()
+		ctx, cancel := context.WithCancel(ctx)
+
+		defer cancel()
+
+		conn, err := upgrader.Upgrade(rsp, req, nil)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to upgrade receiver websocket connection, %v", err)
+			return
+		}
+
+		defer conn.Close()
+
+		LogWithRequest(opts.Logger, req, "Receiver connected to '%s'", opts.Room)
+
+		defer func() {
+			LogWithRequest(opts.Logger, req, "Receiver disconnected from '%s'", opts.Room)
+		}()
+
+		// Subscribe before replaying so that no messages are missed in between
+
+		sub, err := opts.Broker.Subscribe(opts.Room, h)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to subscribe to '%s', %v", opts.Room, err)
+			return
+		}
+
+		defer sub.Close()
+
+		// Only one goroutine at a time may write to the connection
+
+		mu := new(sync.Mutex)
+
+		write := func(mt int, data []byte) error {
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			conn.SetWriteDeadline(time.Now().Add(opts.WriteWait))
+			return conn.WriteMessage(mt, data)
+		}
+
+		write_event := func(ev *sse.Event) error {
+
+			data, err := receiverFrame(ev)
+
+			if err != nil {
+				return err
+			}
+
+			return write(websocket.TextMessage, data)
+		}
+
+		conn.SetReadLimit(receiverReadLimit)
+
+		conn.SetReadDeadline(time.Now().Add(opts.PongWait))
+
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(opts.PongWait))
+			return nil
+		})
+
+		ping_ticker := time.NewTicker(opts.PingPeriod)
+		defer ping_ticker.Stop()
+
+		go func() {
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ping_ticker.C:
+
+					err := write(websocket.PingMessage, []byte{})
+
+					if err != nil {
+						LogWithRequest(opts.Logger, req, "Failed to send WS ping message, %v", err)
+					}
+				}
+			}
+		}()
+
+		// Read messages sent by the receiver until the connection is closed
+
+		go func() {
+
+			defer cancel()
+
+			for {
+
+				mt, data, err := conn.ReadMessage()
+
+				if err != nil {
+
+					if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) && err != io.EOF {
+						LogWithRequest(opts.Logger, req, "Unexpected error reading receiver message, %v", err)
+					}
+
+					return
+				}
+
+				if mt != websocket.TextMessage {
+					continue
+				}
+
+				var recv_msg *ws.ReceiverMessage
+
+				err = json.Unmarshal(data, &recv_msg)
+
+				if err != nil || recv_msg == nil {
+					LogWithRequest(opts.Logger, req, "Failed to decode receiver message, %v", err)
+					write(websocket.TextMessage, []byte("invalid"))
+					continue
+				}
+
+				if !authorized && (recv_msg.Type == "ack" || recv_msg.Type == "state") {
+					LogWithRequest(opts.Logger, req, "Refusing unauthorized '%s' message", recv_msg.Type)
+					write(websocket.TextMessage, []byte("unauthorized"))
+					continue
+				}
+
+				switch recv_msg.Type {
+				case "ping":
+
+					err := write(websocket.TextMessage, []byte("pong"))
+
+					if err != nil {
+						LogWithRequest(opts.Logger, req, "Failed to send WS pong message, %v", err)
+					}
+
+				case "ack":
+
+					a := &ack.Acknowledgement{
+						ID:     recv_msg.ID,
+						Status: recv_msg.Status,
+						Reason: recv_msg.Reason,
+					}
+
+					err := a.Validate()
+
+					if err != nil {
+						LogWithRequest(opts.Logger, req, "Invalid acknowledgement, %v", err)
+						write(websocket.TextMessage, []byte("invalid"))
+						continue
+					}
+
+					if opts.Acknowledgements == nil || !opts.Acknowledgements.Acknowledge(opts.Room, a) {
+						LogWithRequest(opts.Logger, req, "No message '%s' awaiting acknowledgement", a.ID)
+					}
+
+				case "state":
+
+					if opts.Controllers == nil {
+						continue
+					}
+
+					count := sendState(ctx, state_opts, req, recv_msg.Body)
+					LogWithRequest(opts.Logger, req, "Dispatched receiver state to %d controllers", count)
+
+				default:
+					LogWithRequest(opts.Logger, req, "Unsupported receiver message type '%s'", recv_msg.Type)
+					write(websocket.TextMessage, []byte("invalid"))
+				}
+			}
+		}()
+
+		if h.Announced {
+
+			ev, err := sub.Hello()
+
+			if err == nil {
+				err = write_event(ev)
+			}
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to send hello message, %v", err)
+				return
+			}
+		}
+
+		// Browsers can not set headers when opening a Websocket connection so the last event ID may also
+		// be passed as a query parameter
+
+		last_id := req.URL.Query().Get("last_event_id")
+
+		if last_id == "" {
+			last_id = req.Header.Get("Last-Event-ID")
+		}
+
+		if last_id != "" {
+
+			events, err := sub.Replay(ctx, last_id)
+
+			if err != nil {
+
+				if !errors.Is(err, sse.ErrEventsExpired) {
+					LogWithRequest(opts.Logger, req, "Failed to replay events after '%s', %v", last_id, err)
+				} else {
+
+					LogWithRequest(opts.Logger, req, "Unable to replay events, sending reset, %v", err)
+
+					ev, err := sub.Reset()
+
+					if err == nil {
+						err = write_event(ev)
+					}
+
+					if err != nil {
+						LogWithRequest(opts.Logger, req, "Failed to send reset message, %v", err)
+					}
+				}
+			}
+
+			for _, ev := range events {
+
+				err := write_event(ev)
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to replay event '%s', %v", ev.ID, err)
+					return
+				}
+			}
+
+			if len(events) > 0 {
+				LogWithRequest(opts.Logger, req, "Replayed %d events after '%s'", len(events), last_id)
+			}
+		}
+
+		for {
+
+			ev, err := sub.Next(ctx)
+
+			if err != nil {
+
+				// Receivers which are not keeping up are disconnected so that they reconnect and replay the
+				// messages they missed
+
+				if errors.Is(err, sse.ErrSubscriptionDropped) {
+					LogWithRequest(opts.Logger, req, "Receiver is not keeping up, disconnecting")
+					write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "dropped"))
+				}
+
+				return
+			}
+
+			err = write_event(ev)
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to send event, %v", err)
+				return
+			}
+		}
+	}
+
+	h := http.HandlerFunc(fn)
+	return h, nil
+}
+
+// receiverFrame returns the Websocket frame for 'ev'. If 'ev' has an identifier and contains a JSON-encoded dictionary
+// the identifier is added to it as an "event_id" property so that receivers can send it back when they reconnect.
+func receiverFrame(ev *sse.Event) ([]byte, error) {
+
+	data := []byte(ev.Data)
+
+	if ev.ID == "" {
+		return data, nil
+	}
+
+	var dict map[string]json.RawMessage
+
+	err := json.Unmarshal(data, &dict)
+
+	if err != nil || dict == nil {
+		return data, nil
+	}
+
+	enc_id, err := json.Marshal(ev.ID)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode event ID, %w", err)
+	}
+
+	dict["event_id"] = enc_id
+
+	enc_data, err := json.Marshal(dict)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode event, %w", err)
+	}
+
+	return enc_data, nil
+}
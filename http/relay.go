@@ -0,0 +1,669 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/www-multiscreen-starter/ack"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/hub"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The default amount of time a long-poll request waits for frames to be sent to the controller.
+const DefaultPollTimeout time.Duration = 25 * time.Second
+
+// The default amount of time a controller may go without sending or polling for frames before its session ends.
+const DefaultRelaySessionTimeout time.Duration = 60 * time.Second
+
+// The default maximum number of concurrent HTTP relay sessions for each room.
+const DefaultMaxRelaySessions int = 256
+
+// The default maximum number of concurrent HTTP relay sessions for each client address in a room.
+const DefaultMaxRelaySessionsPerAddress int = 8
+
+// The name of the HTTP header (or query parameter) containing the identifier of a controller's HTTP relay session.
+const RelaySessionHeader string = "X-Relay-Session"
+
+// The name of the HTTP header containing the protocol requested by a controller when it starts an HTTP relay session. If
+// it is `ws.ResponseEnvelopeProtocol` responses are sent as JSON-encoded `ws.ResponseMessage` instances rather than strings.
+const RelayProtocolHeader string = "X-Relay-Protocol"
+
+// The maximum size, in bytes, of the messages controllers POST to the relay endpoint. This is the same limit
+// that is applied to messages sent over WebSocket connections.
+const maxRelayBodySize int64 = 512
+
+// errTooManySessions is returned when a new HTTP relay session would exceed the maximum number of sessions for a room
+// or client address.
+var errTooManySessions = errors.New("Too many relay sessions")
+
+// RelayHandlerOptions defines a struct containing configuration options for use by
+// the http.Handler return by the RelayHandler method.
+type RelayHandlerOptions struct {
+	// A valid publisher.Publisher instance used to relay messages sent to the endpoint.
+	Publisher publisher.Publisher
+	// A valid auth.Store instance where access codes will be stored and retrieved from.
+	Store auth.Store
+	// An optional auth.Signer instance used to validate signed (stateless) access codes. If nil access codes are validated using Store.
+	Signer *auth.Signer
+	// A valid *log.Logger  instance
+	Logger *log.Logger
+	// The name of the room (installation) that messages are relayed to.
+	Room string
+	// An optional ack.Tracker instance used to notify controllers when receivers acknowledge messages.
+	Acknowledgements *ack.Tracker
+	// An optional hub.Hub instance used to track the controllers connected to the handler.
+	Controllers *hub.Hub
+	// An optional hub.Queue instance used to ensure that only one controller at a time may relay messages.
+	Queue *hub.Queue
+	// The amount of time a controller may go without sending a message before a "controllerIdle" event is
+	// published. If zero no idle events are published.
+	IdleThreshold time.Duration
+	// If true access codes may only be used by a single controller. The first controller to send a message with a
+	// valid access code is sent a session token which it must include in subsequent messages.
+	OneTimeCodes bool
+	// The amount of time a long-poll request waits for frames to be sent to the controller. If zero `DefaultPollTimeout` is used.
+	PollTimeout time.Duration
+	// The amount of time a controller may go without sending a message or polling for frames before its session
+	// ends. If zero `DefaultRelaySessionTimeout` is used.
+	SessionTimeout time.Duration
+	// The maximum number of concurrent sessions for the room. Requests which would start a new session once it has
+	// been reached are refused with a "429 Too Many Requests" response. If zero `DefaultMaxRelaySessions` is used.
+	MaxSessions int
+	// The maximum number of concurrent sessions for each client address. Requests which would start a new session
+	// once it has been reached are refused with a "429 Too Many Requests" response. If zero
+	// `DefaultMaxRelaySessionsPerAddress` is used.
+	MaxSessionsPerAddress int
+	// An optional ws.Registry instance used to validate messages before they are relayed. Messages which fail validation
+	// are not relayed and the controller is sent a `ws.RejectedMessage`. If nil messages are not validated.
+	Messages *ws.Registry
+	// An optional auth.Throttle instance used to limit the number of invalid access codes sent by the controllers at
+	// each address, in any room. Controllers which exceed the limit are sent an "invalid" response without their access
+	// codes being checked. If nil invalid access codes are not throttled by address.
+	AccessCodeThrottle *auth.Throttle
+	// An optional auth.Throttle instance used to limit the number of invalid access codes sent by each client address
+	// to this room. Failures are kept when a client reconnects. If nil invalid access codes are not throttled by client.
+	ClientAccessCodeThrottle *auth.Throttle
+	// The name of a trusted header, set by a proxy or load balancer, containing the address of each client (for
+	// example "X-Forwarded-For"). If empty the remote address of each request is used.
+	ClientAddressHeader string
+}
+
+// RelayHandler returns an http.Handler for controllers which can not use WebSockets. Controllers POST the same
+// JSON-encoded `ws.UpdateMessage` they would send over a WebSocket connection, which is validated and published
+// identically, and receive the frames that would be written to their WebSocket connection by long-polling the same
+// endpoint with GET requests. The response to the first POST request contains a session identifier which must be
+// included in subsequent requests using the `RelaySessionHeader` header or a "session" query parameter. Controllers may
+// announce a protocol version in the first POST request (see `protocol.Role.NegotiateRequest`). The number of concurrent
+// sessions is limited, both for the room and for each client address.
+func RelayHandler(opts *RelayHandlerOptions) (http.Handler, error) {
+
+	poll_timeout := opts.PollTimeout
+
+	if poll_timeout == 0 {
+		poll_timeout = DefaultPollTimeout
+	}
+
+	session_timeout := opts.SessionTimeout
+
+	if session_timeout == 0 {
+		session_timeout = DefaultRelaySessionTimeout
+	}
+
+	if session_timeout <= poll_timeout {
+		return nil, fmt.Errorf("Session timeout must be greater than poll timeout")
+	}
+
+	max_sessions := opts.MaxSessions
+
+	if max_sessions == 0 {
+		max_sessions = DefaultMaxRelaySessions
+	}
+
+	max_address_sessions := opts.MaxSessionsPerAddress
+
+	if max_address_sessions == 0 {
+		max_address_sessions = DefaultMaxRelaySessionsPerAddress
+	}
+
+	relay_opts := &relayOptions{
+		Publisher:           opts.Publisher,
+		Store:               opts.Store,
+		Signer:              opts.Signer,
+		Logger:              opts.Logger,
+		Room:                opts.Room,
+		Acknowledgements:    opts.Acknowledgements,
+		Controllers:         opts.Controllers,
+		Queue:               opts.Queue,
+		IdleThreshold:       opts.IdleThreshold,
+		OneTimeCodes:        opts.OneTimeCodes,
+		Messages:            opts.Messages,
+		Throttle:            opts.AccessCodeThrottle,
+		ClientThrottle:      opts.ClientAccessCodeThrottle,
+		ClientAddressHeader: opts.ClientAddressHeader,
+	}
+
+	sessions := make(map[string]*pollingSession)
+	sessions_mu := new(sync.Mutex)
+
+	// The number of sessions for each client address. Sessions are counted until they end, rather than until
+	// they send a message with a valid access code, so that clients can not allocate sessions without limit.
+	address_sessions := make(map[string]int)
+
+	session_id := func(req *http.Request) string {
+
+		id := req.Header.Get(RelaySessionHeader)
+
+		if id == "" {
+			id = req.URL.Query().Get("session")
+		}
+
+		return id
+	}
+
+	get_session := func(req *http.Request) (*pollingSession, bool) {
+
+		id := session_id(req)
+
+		if id == "" {
+			return nil, false
+		}
+
+		sessions_mu.Lock()
+		defer sessions_mu.Unlock()
+
+		s, ok := sessions[id]
+		return s, ok
+	}
+
+	new_session := func(req *http.Request, h *protocol.Handshake) (*pollingSession, error) {
+
+		addr := clientAddress(req, opts.ClientAddressHeader)
+
+		sessions_mu.Lock()
+
+		if len(sessions) >= max_sessions || address_sessions[addr] >= max_address_sessions {
+			sessions_mu.Unlock()
+			return nil, errTooManySessions
+		}
+
+		// Reserve the session for the address while it is created
+
+		address_sessions[addr] += 1
+		sessions_mu.Unlock()
+
+		release := func() {
+
+			sessions_mu.Lock()
+			defer sessions_mu.Unlock()
+
+			address_sessions[addr] -= 1
+
+			if address_sessions[addr] <= 0 {
+				delete(address_sessions, addr)
+			}
+		}
+
+		envelopes := req.Header.Get(RelayProtocolHeader) == ws.ResponseEnvelopeProtocol || h.Has(protocol.Responses)
+
+		controller, err := newPollingController(opts.Room, envelopes)
+
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		// Controller IDs are included in the events published to receivers so sessions are identified using
+		// a separate, secret, token
+
+		id, err := newResumeToken()
+
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		if h.Announced {
+
+			err := controller.Send(ctx, ws.NewHelloMessage(h))
+
+			if err != nil {
+				cancel()
+				release()
+				controller.End()
+				return nil, fmt.Errorf("Failed to send hello message, %w", err)
+			}
+		}
+
+		s := &pollingSession{
+			id:                id,
+			controllerSession: newControllerSession(relay_opts, req, controller),
+			controller:        controller,
+			ctx:               ctx,
+			timeout:           session_timeout,
+			mu:                new(sync.Mutex),
+			update_mu:         new(sync.Mutex),
+		}
+
+		// The session ends if the controller stops sending messages and polling for frames
+
+		s.timer = time.AfterFunc(session_timeout, func() {
+
+			if !s.end() {
+				return
+			}
+
+			LogWithRequest(opts.Logger, req, "Relay session for controller '%s' has ended", controller.ID())
+
+			sessions_mu.Lock()
+			delete(sessions, id)
+			sessions_mu.Unlock()
+
+			release()
+			cancel()
+			s.stop()
+
+			controller.End()
+			endControllerSession(relay_opts, req, controller)
+		})
+
+		sessions_mu.Lock()
+		sessions[id] = s
+		sessions_mu.Unlock()
+
+		if opts.Controllers != nil {
+			opts.Controllers.Add(controller)
+		}
+
+		return s, nil
+	}
+
+	post := func(rsp http.ResponseWriter, req *http.Request) {
+
+		var update_msg *ws.UpdateMessage
+
+		body := http.MaxBytesReader(rsp, req.Body, maxRelayBodySize)
+
+		dec := json.NewDecoder(body)
+		err := dec.Decode(&update_msg)
+
+		if err != nil || update_msg == nil {
+			LogWithRequest(opts.Logger, req, "Failed to decode message, %v", err)
+			http.Error(rsp, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		s, ok := get_session(req)
+
+		// Requests for a session which has ended are refused, as they are when polling, rather than starting
+		// a new session so that controllers know that any frames buffered for the old session have been lost
+
+		if !ok && session_id(req) != "" {
+			http.Error(rsp, "Not found", http.StatusNotFound)
+			return
+		}
+
+		if !ok {
+
+			h, err := protocol.Controller.NegotiateRequest(req)
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Refusing controller, %v", err)
+				http.Error(rsp, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			s, err = new_session(req, h)
+
+			if errors.Is(err, errTooManySessions) {
+				LogWithRequest(opts.Logger, req, "Refusing to create relay session, %v", err)
+				http.Error(rsp, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to create relay session, %v", err)
+				http.Error(rsp, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if !s.begin() {
+			http.Error(rsp, "Gone", http.StatusGone)
+			return
+		}
+
+		defer s.finish()
+
+		if update_msg.Type == "ping" {
+			s.controller.SendResponse(s.ctx, ws.NewOKResponseMessage("pong", update_msg.ID))
+		} else {
+
+			// Messages are handled one at a time, as they are for WebSocket connections
+
+			s.update_mu.Lock()
+			relayUpdate(s.ctx, req, s.controllerSession, update_msg)
+			s.update_mu.Unlock()
+		}
+
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.WriteHeader(http.StatusAccepted)
+
+		enc := json.NewEncoder(rsp)
+		enc.Encode(map[string]string{"session": s.id})
+	}
+
+	poll := func(rsp http.ResponseWriter, req *http.Request) {
+
+		s, ok := get_session(req)
+
+		if !ok {
+			http.Error(rsp, "Not found", http.StatusNotFound)
+			return
+		}
+
+		if !s.begin() {
+			http.Error(rsp, "Gone", http.StatusGone)
+			return
+		}
+
+		defer s.finish()
+
+		ctx, cancel := context.WithTimeout(req.Context(), poll_timeout)
+		defer cancel()
+
+		frames, ok := s.controller.Poll(ctx)
+
+		// The session of a controller which has expired ends once it has been sent its remaining frames
+
+		if !ok && len(frames) == 0 {
+			http.Error(rsp, "Gone", http.StatusGone)
+			return
+		}
+
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.Header().Set("Cache-Control", "no-cache")
+
+		enc := json.NewEncoder(rsp)
+		err := enc.Encode(frames)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to write frames, %v", err)
+		}
+	}
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		switch req.Method {
+		case "POST":
+			post(rsp, req)
+		case "GET":
+			poll(rsp, req)
+		default:
+			http.Error(rsp, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+
+	h := http.HandlerFunc(fn)
+	return h, nil
+}
+
+// type pollingSession is a struct containing the state of a controller's HTTP relay session.
+type pollingSession struct {
+	*controllerSession
+	// The secret identifier the controller includes in its requests.
+	id         string
+	controller *pollingController
+	// The context used to validate and publish the controller's messages. It is cancelled when the session ends.
+	ctx context.Context
+	// The timer which ends the session if the controller stops sending messages and polling for frames.
+	timer *time.Timer
+	// The amount of time the session may go without any requests before it ends.
+	timeout time.Duration
+	// The number of requests for the session currently being handled.
+	active int
+	ended  bool
+	mu     *sync.Mutex
+	// The lock used to ensure that messages are handled one at a time, as they are for WebSocket connections.
+	update_mu *sync.Mutex
+}
+
+// begin stops the session's timer while a request is being handled. It returns false if the session has ended.
+func (s *pollingSession) begin() bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return false
+	}
+
+	s.active += 1
+	s.timer.Stop()
+
+	return true
+}
+
+// finish restarts the session's timer once there are no more requests being handled. If the controller has expired
+// the session ends immediately.
+func (s *pollingSession) finish() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active -= 1
+
+	if s.active > 0 || s.ended {
+		return
+	}
+
+	if s.controller.Expired() {
+		s.timer.Reset(0)
+	} else {
+		s.timer.Reset(s.timeout)
+	}
+}
+
+// end marks the session as ended and returns true, unless a request is being handled or the session has already ended.
+func (s *pollingSession) end() bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active > 0 || s.ended {
+		return false
+	}
+
+	s.ended = true
+	return true
+}
+
+// type pollingController implements the `hub.Controller` interface for controllers which relay messages using HTTP
+// requests. Frames sent to the controller are buffered until it polls for them.
+type pollingController struct {
+	id      string
+	room    string
+	code    string
+	frames  []json.RawMessage
+	expired bool
+	ended   bool
+	// A boolean flag indicating whether responses are sent as JSON-encoded `ws.ResponseMessage` instances rather than strings.
+	envelopes bool
+	// A channel which is signaled when frames are added to the buffer or the controller expires.
+	notify chan struct{}
+	mu     *sync.Mutex
+}
+
+// newPollingController returns a new `pollingController` instance for 'room'. If 'envelopes' is true responses are sent
+// as JSON-encoded `ws.ResponseMessage` instances rather than strings.
+func newPollingController(room string, envelopes bool) (*pollingController, error) {
+
+	id, err := newControllerID()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pollingController{
+		id:        id,
+		room:      room,
+		frames:    make([]json.RawMessage, 0),
+		envelopes: envelopes,
+		notify:    make(chan struct{}, 1),
+		mu:        new(sync.Mutex),
+	}
+
+	return c, nil
+}
+
+// ID returns the unique identifier for the controller's session.
+func (c *pollingController) ID() string {
+	return c.id
+}
+
+// Room returns the name of the room (installation) the controller is connected to.
+func (c *pollingController) Room() string {
+	return c.room
+}
+
+// Code returns the access code most recently validated for the controller.
+func (c *pollingController) Code() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.code
+}
+
+// SetCode assigns the access code most recently validated for the controller.
+func (c *pollingController) SetCode(code string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.code = code
+}
+
+// Send JSON-encodes 'msg' and adds it to the controller's buffer of frames.
+func (c *pollingController) Send(ctx context.Context, msg interface{}) error {
+
+	enc, err := json.Marshal(msg)
+
+	if err != nil {
+		return fmt.Errorf("Failed to encode message, %w", err)
+	}
+
+	return c.write(enc)
+}
+
+// SendResponse adds 'rsp' to the controller's buffer of frames, either as is or as a JSON-encoded string containing its type.
+func (c *pollingController) SendResponse(ctx context.Context, rsp *ws.ResponseMessage) error {
+
+	if c.envelopes {
+		return c.Send(ctx, rsp)
+	}
+
+	enc, err := json.Marshal(rsp.Type)
+
+	if err != nil {
+		return fmt.Errorf("Failed to encode message, %w", err)
+	}
+
+	return c.write(enc)
+}
+
+// Expire adds an "expired" frame to the controller's buffer. Its session ends once it has polled for its remaining frames.
+func (c *pollingController) Expire(ctx context.Context) error {
+
+	c.mu.Lock()
+	c.expired = true
+	c.mu.Unlock()
+
+	return c.SendResponse(ctx, ws.NewErrorResponseMessage("expired", "", "Code has expired"))
+}
+
+// Expired returns a boolean value indicating whether the controller has expired.
+func (c *pollingController) Expired() bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.expired
+}
+
+// End marks the controller's session as ended. Frames sent to the controller after its session has ended are discarded.
+func (c *pollingController) End() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ended = true
+	c.frames = nil
+}
+
+// Poll waits until frames have been sent to the controller, or 'ctx' is cancelled, and returns them. The boolean value
+// is false if the controller has expired, in which case the controller should not poll again.
+func (c *pollingController) Poll(ctx context.Context) ([]json.RawMessage, bool) {
+
+	for {
+
+		c.mu.Lock()
+
+		if len(c.frames) > 0 || c.expired || c.ended {
+
+			frames := c.frames
+			c.frames = make([]json.RawMessage, 0)
+
+			ok := !c.expired && !c.ended
+			c.mu.Unlock()
+
+			return frames, ok
+		}
+
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return []json.RawMessage{}, true
+		case <-c.notify:
+			// pass
+		}
+	}
+}
+
+// write adds 'frame' to the controller's buffer, discarding the oldest frames if there are more than `maxBufferedFrames`.
+func (c *pollingController) write(frame []byte) error {
+
+	c.mu.Lock()
+
+	if c.ended {
+		c.mu.Unlock()
+		return errSessionEnded
+	}
+
+	c.frames = append(c.frames, frame)
+
+	if len(c.frames) > maxBufferedFrames {
+		c.frames = c.frames[len(c.frames)-maxBufferedFrames:]
+	}
+
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+		// pass
+	default:
+		// pass, a poll is already pending
+	}
+
+	return nil
+}
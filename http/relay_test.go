@@ -0,0 +1,468 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// type testPublisher implements the `publisher.Publisher` interface and records the messages it is asked to publish.
+type testPublisher struct {
+	messages []string
+	mu       *sync.Mutex
+}
+
+func newTestPublisher() *testPublisher {
+
+	p := &testPublisher{
+		messages: make([]string, 0),
+		mu:       new(sync.Mutex),
+	}
+
+	return p
+}
+
+func (p *testPublisher) Publish(ctx context.Context, msg string) error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func (p *testPublisher) Close() error {
+	return nil
+}
+
+// newTestRelayStore returns a new `auth.MemoryStore` containing a current access code "123456" for the default room.
+func newTestRelayStore(t *testing.T) *auth.MemoryStore {
+
+	store := auth.NewMemoryStore()
+
+	now := time.Now()
+
+	rc := &auth.RelayCode{
+		Room:    auth.DefaultRoom,
+		Code:    "123456",
+		Created: now.Unix(),
+		Expires: now.Add(5 * time.Minute).Unix(),
+	}
+
+	err := store.Put(context.Background(), rc)
+
+	if err != nil {
+		t.Fatalf("Failed to store access code, %v", err)
+	}
+
+	return store
+}
+
+// testRelayPost POSTs 'body' to 'h', from 'addr', without a session header (starting a new relay session) and returns
+// the responses sent to the controller for the new session.
+func testRelayPost(t *testing.T, h http.Handler, addr string, body string) []*ws.ResponseMessage {
+
+	frames := testRelayFrames(t, h, addr, body)
+	responses := make([]*ws.ResponseMessage, len(frames))
+
+	for i, f := range frames {
+
+		var rsp *ws.ResponseMessage
+		err := json.Unmarshal(f, &rsp)
+
+		if err != nil {
+			t.Fatalf("Failed to decode response, %v", err)
+		}
+
+		responses[i] = rsp
+	}
+
+	return responses
+}
+
+// testRelayFrames POSTs 'body' to 'h', from 'addr', without a session header (starting a new relay session) and
+// returns the JSON-encoded frames sent to the controller for the new session.
+func testRelayFrames(t *testing.T, h http.Handler, addr string, body string) []json.RawMessage {
+
+	req := httptest.NewRequest("POST", "/relay/", strings.NewReader(body))
+	req.RemoteAddr = addr
+	req.Header.Set(RelayProtocolHeader, ws.ResponseEnvelopeProtocol)
+
+	rsp := httptest.NewRecorder()
+	h.ServeHTTP(rsp, req)
+
+	if rsp.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected status for POST request, %d", rsp.Code)
+	}
+
+	var session map[string]string
+
+	err := json.Unmarshal(rsp.Body.Bytes(), &session)
+
+	if err != nil {
+		t.Fatalf("Failed to decode POST response, %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/relay/", nil)
+	req.RemoteAddr = addr
+	req.Header.Set(RelaySessionHeader, session["session"])
+
+	rsp = httptest.NewRecorder()
+	h.ServeHTTP(rsp, req)
+
+	if rsp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status for GET request, %d", rsp.Code)
+	}
+
+	var frames []json.RawMessage
+
+	err = json.Unmarshal(rsp.Body.Bytes(), &frames)
+
+	if err != nil {
+		t.Fatalf("Failed to decode GET response, %v", err)
+	}
+
+	return frames
+}
+
+func TestRelayHandlerThrottleReconnect(t *testing.T) {
+
+	store := newTestRelayStore(t)
+
+	opts := &RelayHandlerOptions{
+		Store:                    store,
+		Logger:                   log.New(io.Discard, "", 0),
+		Room:                     auth.DefaultRoom,
+		PollTimeout:              100 * time.Millisecond,
+		ClientAccessCodeThrottle: auth.NewThrottle(2, time.Minute),
+	}
+
+	h, err := RelayHandler(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create relay handler, %v", err)
+	}
+
+	invalid := `{"type": "update", "code": "000000"}`
+	valid := `{"type": "update", "code": "123456"}`
+
+	// Each POST request without a session header starts a new session, the equivalent of a new WebSocket connection
+
+	for i := 0; i < 2; i++ {
+
+		responses := testRelayPost(t, h, "192.0.2.1:1234", invalid)
+
+		if len(responses) != 1 || responses[0].Type != "invalid" || strings.Contains(responses[0].Reason, "Too many") {
+			t.Fatalf("Expected invalid access code %d to be checked, got %v", i+1, responses)
+		}
+	}
+
+	// A new session from the same address is still throttled, even with a valid access code
+
+	responses := testRelayPost(t, h, "192.0.2.1:5678", valid)
+
+	if len(responses) != 1 || responses[0].Type != "invalid" || !strings.Contains(responses[0].Reason, "Too many") {
+		t.Fatalf("Expected new session to be throttled, got %v", responses)
+	}
+
+	// Other clients are throttled independently
+
+	responses = testRelayPost(t, h, "192.0.2.2:1234", invalid)
+
+	if len(responses) != 1 || strings.Contains(responses[0].Reason, "Too many") {
+		t.Fatalf("Expected another address not to be throttled, got %v", responses)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+
+	tests := []struct {
+		header   string
+		value    string
+		expected string
+	}{
+		{"", "203.0.113.9", "192.0.2.1"},
+		{"X-Forwarded-For", "", "192.0.2.1"},
+		{"X-Forwarded-For", "203.0.113.9", "203.0.113.9"},
+		{"X-Forwarded-For", "198.51.100.7, 203.0.113.9", "203.0.113.9"},
+	}
+
+	for _, test := range tests {
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		if test.value != "" {
+			req.Header.Set("X-Forwarded-For", test.value)
+		}
+
+		addr := clientAddress(req, test.header)
+
+		if addr != test.expected {
+			t.Fatalf("Expected address '%s' for header '%s' (%s), got '%s'", test.expected, test.header, test.value, addr)
+		}
+	}
+}
+
+func TestRelayHandlerMaxSessions(t *testing.T) {
+
+	opts := &RelayHandlerOptions{
+		Store:                 auth.NewMemoryStore(),
+		Logger:                log.New(io.Discard, "", 0),
+		Room:                  auth.DefaultRoom,
+		PollTimeout:           100 * time.Millisecond,
+		MaxSessions:           3,
+		MaxSessionsPerAddress: 2,
+	}
+
+	h, err := RelayHandler(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create relay handler, %v", err)
+	}
+
+	post := func(addr string) int {
+
+		req := httptest.NewRequest("POST", "/relay/", strings.NewReader(`{"type": "update", "code": "000000"}`))
+		req.RemoteAddr = addr
+
+		rsp := httptest.NewRecorder()
+		h.ServeHTTP(rsp, req)
+
+		return rsp.Code
+	}
+
+	// Sessions are counted whether or not their first message has a valid access code
+
+	for i := 0; i < 2; i++ {
+
+		code := post("192.0.2.1:1234")
+
+		if code != http.StatusAccepted {
+			t.Fatalf("Expected session %d to be created, got %d", i+1, code)
+		}
+	}
+
+	code := post("192.0.2.1:5678")
+
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("Expected session to be refused once the per-address limit is reached, got %d", code)
+	}
+
+	code = post("192.0.2.2:1234")
+
+	if code != http.StatusAccepted {
+		t.Fatalf("Expected session from another address to be created, got %d", code)
+	}
+
+	code = post("192.0.2.3:1234")
+
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("Expected session to be refused once the room limit is reached, got %d", code)
+	}
+}
+
+func TestRelayHandlerOneTimeCodes(t *testing.T) {
+
+	opts := &RelayHandlerOptions{
+		Publisher:    newTestPublisher(),
+		Store:        newTestRelayStore(t),
+		Logger:       log.New(io.Discard, "", 0),
+		Room:         auth.DefaultRoom,
+		PollTimeout:  100 * time.Millisecond,
+		OneTimeCodes: true,
+	}
+
+	h, err := RelayHandler(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create relay handler, %v", err)
+	}
+
+	// The first controller to use the code claims it and is sent a session token
+
+	var token string
+
+	for _, f := range testRelayFrames(t, h, "192.0.2.1:1234", `{"type": "update", "code": "123456"}`) {
+
+		var session *ws.SessionMessage
+		err := json.Unmarshal(f, &session)
+
+		if err != nil {
+			t.Fatalf("Failed to decode frame, %v", err)
+		}
+
+		if session.Type == "session" {
+			token = session.Token
+		}
+	}
+
+	if token == "" {
+		t.Fatalf("Expected first controller to be sent a session token")
+	}
+
+	// Other controllers using the same code are sent a "claimed" response
+
+	for _, body := range []string{
+		`{"type": "update", "code": "123456"}`,
+		`{"type": "update", "code": "123456", "token": "not-the-token"}`,
+	} {
+
+		responses := testRelayPost(t, h, "192.0.2.2:1234", body)
+
+		if len(responses) != 1 || responses[0].Type != "claimed" || responses[0].Status != ws.StatusError {
+			t.Fatalf("Expected claimed response for %s, got %v", body, responses)
+		}
+	}
+
+	// The controller that claimed the code can continue to use it from a new session with its token
+
+	responses := testRelayPost(t, h, "192.0.2.1:5678", fmt.Sprintf(`{"type": "update", "code": "123456", "token": "%s"}`, token))
+
+	for _, rsp := range responses {
+
+		if rsp.Type == "claimed" {
+			t.Fatalf("Expected controller with session token not to be sent a claimed response, got %v", responses)
+		}
+	}
+}
+
+func TestRelayHandlerRejectedMessages(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"zoom.json": &fstest.MapFile{Data: []byte(`{"type": "object", "properties": {"level": {"type": "integer", "maximum": 20}}, "required": ["level"]}`)},
+	}
+
+	registry, err := ws.NewRegistry(fsys)
+
+	if err != nil {
+		t.Fatalf("Failed to create registry, %v", err)
+	}
+
+	pub := newTestPublisher()
+
+	opts := &RelayHandlerOptions{
+		Publisher:   pub,
+		Store:       newTestRelayStore(t),
+		Logger:      log.New(io.Discard, "", 0),
+		Room:        auth.DefaultRoom,
+		PollTimeout: 100 * time.Millisecond,
+		Messages:    registry,
+		// Each request starts a new session from the same address
+		MaxSessionsPerAddress: 16,
+	}
+
+	h, err := RelayHandler(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create relay handler, %v", err)
+	}
+
+	// Messages which fail validation, or whose type is not registered, are sent a "rejected" frame
+
+	rejected := map[string]string{
+		`{"id": "1", "type": "zoom", "code": "123456", "body": {"level": 30}}`: "/properties/level/maximum",
+		`{"id": "1", "type": "pan", "code": "123456", "body": {"x": 1}}`:       "",
+	}
+
+	for body, keyword := range rejected {
+
+		frames := testRelayFrames(t, h, "192.0.2.1:1234", body)
+
+		if len(frames) != 1 {
+			t.Fatalf("Expected a single frame for %s, got %d", body, len(frames))
+		}
+
+		var rejected_msg *ws.RejectedMessage
+		err := json.Unmarshal(frames[0], &rejected_msg)
+
+		if err != nil {
+			t.Fatalf("Failed to decode frame, %v", err)
+		}
+
+		if rejected_msg.Type != "rejected" || rejected_msg.ID != "1" || rejected_msg.Keyword != keyword || rejected_msg.Reason == "" {
+			t.Fatalf("Unexpected rejected frame for %s, %s", body, string(frames[0]))
+		}
+	}
+
+	// Messages whose type is reserved for the server's own messages are refused, whether or not they have a schema
+
+	for _, msg_type := range []string{"", "showCode", "hideCode", "hello", "codeExpired", "message"} {
+
+		body := fmt.Sprintf(`{"id": "2", "type": "%s", "code": "123456", "body": {"level": 2}}`, msg_type)
+		responses := testRelayPost(t, h, "192.0.2.1:1234", body)
+
+		if len(responses) != 1 || responses[0].Type != "invalid" || responses[0].ID != "2" || responses[0].Status != ws.StatusError {
+			t.Fatalf("Expected '%s' message to be refused, got %v", msg_type, responses)
+		}
+	}
+
+	pub.mu.Lock()
+	count := len(pub.messages)
+	pub.mu.Unlock()
+
+	if count != 0 {
+		t.Fatalf("Expected rejected messages not to be published, got %d messages", count)
+	}
+
+	// Valid messages are relayed
+
+	responses := testRelayPost(t, h, "192.0.2.1:1234", `{"id": "3", "type": "zoom", "code": "123456", "body": {"level": 2}}`)
+
+	for _, rsp := range responses {
+
+		if rsp.Type == "rejected" || rsp.Type == "invalid" {
+			t.Fatalf("Expected valid message to be relayed, got %v", responses)
+		}
+	}
+}
+
+func TestRelayHandlerUnknownSession(t *testing.T) {
+
+	opts := &RelayHandlerOptions{
+		Store:                 newTestRelayStore(t),
+		Logger:                log.New(io.Discard, "", 0),
+		Room:                  auth.DefaultRoom,
+		PollTimeout:           100 * time.Millisecond,
+		MaxSessionsPerAddress: 1,
+	}
+
+	h, err := RelayHandler(opts)
+
+	if err != nil {
+		t.Fatalf("Failed to create relay handler, %v", err)
+	}
+
+	for _, method := range []string{"POST", "GET"} {
+
+		req := httptest.NewRequest(method, "/relay/", strings.NewReader(`{"type": "update", "code": "000000"}`))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(RelaySessionHeader, "unknown")
+
+		rsp := httptest.NewRecorder()
+		h.ServeHTTP(rsp, req)
+
+		if rsp.Code != http.StatusNotFound {
+			t.Fatalf("Expected %s request for an unknown session to return 404, got %d", method, rsp.Code)
+		}
+	}
+
+	// Requests for an unknown session do not start a new session
+
+	responses := testRelayPost(t, h, "192.0.2.1:1234", `{"type": "update", "code": "000000"}`)
+
+	if len(responses) != 1 || responses[0].Type != "invalid" {
+		t.Fatalf("Expected a new session to be started, got %v", responses)
+	}
+}
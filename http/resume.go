@@ -0,0 +1,67 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// type resumableSessions is a struct for tracking the controllers, by resume token, whose sessions may be resumed by a new connection.
+type resumableSessions struct {
+	sessions map[string]*websocketController
+	mu       *sync.RWMutex
+}
+
+// newResumableSessions returns a new (empty) `resumableSessions` instance.
+func newResumableSessions() *resumableSessions {
+
+	s := &resumableSessions{
+		sessions: make(map[string]*websocketController),
+		mu:       new(sync.RWMutex),
+	}
+
+	return s
+}
+
+// Add registers 'c' with 'token'.
+func (s *resumableSessions) Add(token string, c *websocketController) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[token] = c
+}
+
+// Get returns the controller registered with 'token' and a boolean value indicating whether it was found.
+func (s *resumableSessions) Get(token string) (*websocketController, bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.sessions[token]
+	return c, ok
+}
+
+// Remove unregisters 'token'.
+func (s *resumableSessions) Remove(token string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, token)
+}
+
+// newResumeToken returns a new random token used to resume a controller's session.
+func newResumeToken() (string, error) {
+
+	b := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, b)
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to create resume token, %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
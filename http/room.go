@@ -0,0 +1,62 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// re_room is the pattern that valid room (installation) names must match.
+var re_room = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// IsValidRoom returns a boolean value indicating whether 'room' is a valid room (installation) name.
+func IsValidRoom(room string) bool {
+	return re_room.MatchString(room)
+}
+
+// RoomFromPath derives a room (installation) name from 'path' after removing 'prefix'. If the
+// remaining path is empty then 'default_room' is returned.
+func RoomFromPath(path string, prefix string, default_room string) (string, error) {
+
+	room := strings.TrimPrefix(path, prefix)
+	room = strings.Trim(room, "/")
+
+	if room == "" {
+		return default_room, nil
+	}
+
+	if !IsValidRoom(room) {
+		return "", fmt.Errorf("Invalid room name")
+	}
+
+	return room, nil
+}
+
+// RoomsHandler returns an http.Handler that derives a room (installation) name from the path of
+// each request, after removing 'prefix', and dispatches the request to the matching handler in 'handlers'.
+// Requests whose path does not specify a room are dispatched to the handler for 'default_room'.
+func RoomsHandler(prefix string, handlers map[string]http.Handler, default_room string) (http.Handler, error) {
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		room, err := RoomFromPath(req.URL.Path, prefix, default_room)
+
+		if err != nil {
+			http.Error(rsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		h, ok := handlers[room]
+
+		if !ok {
+			http.Error(rsp, "Not found", http.StatusNotFound)
+			return
+		}
+
+		h.ServeHTTP(rsp, req)
+	}
+
+	h := http.HandlerFunc(fn)
+	return h, nil
+}
@@ -0,0 +1,121 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/hub"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"log"
+	"net/http"
+)
+
+// StateHandlerOptions defines a struct containing configuration options for the
+// StateHandler http.Handler
+type StateHandlerOptions struct {
+	// A valid hub.Hub instance containing the controllers connected to the server.
+	Controllers *hub.Hub
+	// A valid auth.Store instance for storing and retrieving access codes.
+	Store auth.Store
+	// An optional auth.Signer instance used to validate signed (stateless) access codes. If nil access codes are validated using Store.
+	Signer *auth.Signer
+	// A valid *log.Logger  instance
+	Logger *log.Logger
+	// The name of the room (installation) that state messages are published for.
+	Room string
+	// The shared secret receivers must present, as a bearer token in the "Authorization" header or as the
+	// `ReceiverTokenParameter` query parameter, in order to publish their state. If empty all requests are refused.
+	ReceiverSecret string
+}
+
+// StateHandler returns an HTTP handler that accepts POST requests from a receiver containing a JSON-encoded
+// description of its current state and dispatches it, as a `ws.StateMessage`, to every controller in the room
+// whose access code is still valid. The response body is a JSON-encoded dictionary containing the number of
+// controllers the message was dispatched to. Requests which do not present the receiver secret are refused.
+func StateHandler(opts *StateHandlerOptions) (http.Handler, error) {
+
+	fn := func(rsp http.ResponseWriter, req *http.Request) {
+
+		if req.Method != "POST" {
+			http.Error(rsp, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !isAuthorizedReceiver(req, opts.ReceiverSecret) {
+			LogWithRequest(opts.Logger, req, "Refusing unauthorized state update")
+			http.Error(rsp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := req.Context()
+
+		var body interface{}
+
+		req_body := http.MaxBytesReader(rsp, req.Body, receiverReadLimit)
+
+		dec := json.NewDecoder(req_body)
+		err := dec.Decode(&body)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to decode state, %v", err)
+			http.Error(rsp, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		count := sendState(ctx, opts, req, body)
+
+		rsp.Header().Set("Content-Type", "application/json")
+		rsp.Write([]byte(fmt.Sprintf(`{"controllers":%d}`, count)))
+		return
+	}
+
+	h := http.HandlerFunc(fn)
+	return h, nil
+}
+
+// sendState dispatches 'body', received in 'req',, as a `ws.StateMessage`, to every controller in the room whose access code is still
+// valid and returns the number of controllers it was dispatched to.
+func sendState(ctx context.Context, opts *StateHandlerOptions, req *http.Request, body interface{}) int {
+
+	state_msg := ws.NewStateMessage(body)
+
+	// Multiple controllers may be using the same code so only validate each code once
+
+	valid_codes := make(map[string]bool)
+	count := 0
+
+	for _, c := range opts.Controllers.Controllers(opts.Room) {
+
+		code := c.Code()
+
+		if code == "" {
+			continue
+		}
+
+		is_valid, ok := valid_codes[code]
+
+		if !ok {
+
+			_, err := auth.ValidateRelayCode(ctx, opts.Store, opts.Signer, opts.Room, code)
+			is_valid = err == nil
+
+			valid_codes[code] = is_valid
+		}
+
+		if !is_valid {
+			continue
+		}
+
+		err := c.Send(ctx, state_msg)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to send state to controller '%s', %v", c.ID(), err)
+			continue
+		}
+
+		count += 1
+	}
+
+	return count
+}
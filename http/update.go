@@ -0,0 +1,589 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/www-multiscreen-starter/ack"
+	"github.com/sfomuseum/www-multiscreen-starter/auth"
+	"github.com/sfomuseum/www-multiscreen-starter/hub"
+	"github.com/sfomuseum/www-multiscreen-starter/sse"
+	"github.com/sfomuseum/www-multiscreen-starter/ws"
+	"log"
+	"net/http"
+	"time"
+)
+
+// type relayController is an interface for controllers whose `ws.UpdateMessage` instances are validated and
+// published by the `relayUpdate` method, regardless of the transport they are connected over.
+type relayController interface {
+	hub.Controller
+	// SetCode assigns the access code most recently validated for the controller.
+	SetCode(string)
+	// SendResponse dispatches 'rsp' to the controller, either as a JSON-encoded frame or as a bare string containing
+	// its type, depending on what the controller negotiated.
+	SendResponse(context.Context, *ws.ResponseMessage) error
+}
+
+// type relayOptions is a struct containing the configuration options shared by the transports (WebSocket
+// and HTTP) that controllers use to relay messages.
+type relayOptions struct {
+	Publisher        publisher.Publisher
+	Store            auth.Store
+	Signer           *auth.Signer
+	Logger           *log.Logger
+	Room             string
+	Acknowledgements *ack.Tracker
+	Controllers      *hub.Hub
+	Queue            *hub.Queue
+	IdleThreshold    time.Duration
+	OneTimeCodes     bool
+	Messages         *ws.Registry
+	// The throttles for invalid access codes sent from each address (in any room) and from each client address in
+	// this room, and the name of the trusted header used to determine client addresses.
+	Throttle            *auth.Throttle
+	ClientThrottle      *auth.Throttle
+	ClientAddressHeader string
+}
+
+// type controllerSession is a struct containing the state of a single controller's session with a transport.
+type controllerSession struct {
+	opts *relayOptions
+	// The controller for the session. This may be replaced, for example when a WebSocket connection resumes the
+	// session of a controller whose previous connection dropped.
+	controller relayController
+	// The one-time access code claimed by the session, if any.
+	session_code string
+	// The idle timer is (re)started every time the controller sends a message with a valid code.
+	idle_timer *time.Timer
+	// An optional function invoked the first time the controller sends a message with a valid code.
+	on_connected func(context.Context)
+}
+
+// newControllerSession returns a new `controllerSession` instance for 'c'. The `stop` method should be invoked
+// when the session's transport (for example its WebSocket connection) closes.
+func newControllerSession(opts *relayOptions, req *http.Request, c relayController) *controllerSession {
+
+	s := &controllerSession{
+		opts:       opts,
+		controller: c,
+	}
+
+	if opts.IdleThreshold > 0 {
+
+		s.idle_timer = time.AfterFunc(opts.IdleThreshold, func() {
+
+			if s.controller.Code() != "" {
+				publishControllerEvent(opts, req, sse.NewControllerIdleMessage(opts.Room, s.controller.ID()))
+			}
+		})
+
+		s.idle_timer.Stop()
+	}
+
+	return s
+}
+
+// touch restarts the session's idle timer.
+func (s *controllerSession) touch() {
+
+	if s.idle_timer != nil {
+		s.idle_timer.Reset(s.opts.IdleThreshold)
+	}
+}
+
+// stop stops the session's idle timer.
+func (s *controllerSession) stop() {
+
+	if s.idle_timer != nil {
+		s.idle_timer.Stop()
+	}
+}
+
+// attempt returns a boolean value indicating whether the client that sent 'req', and its address, may attempt to use
+// an access code. Allowed attempts are counted as failures until they are refunded by `succeed`, so that concurrent
+// requests can not all be allowed before any failures are recorded. Failures are recorded by address, rather than by
+// session, so that clients can not reset them by opening a new connection or relay session.
+func (s *controllerSession) attempt(req *http.Request) bool {
+
+	addr := clientAddress(req, s.opts.ClientAddressHeader)
+
+	if s.opts.ClientThrottle != nil && !s.opts.ClientThrottle.Attempt(s.clientKey(addr)) {
+		return false
+	}
+
+	if s.opts.Throttle != nil && !s.opts.Throttle.Attempt(addr) {
+
+		if s.opts.ClientThrottle != nil {
+			s.opts.ClientThrottle.Succeed(s.clientKey(addr))
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// succeed refunds an attempt, allowed by `attempt`, whose access code was not invalid.
+func (s *controllerSession) succeed(req *http.Request) {
+
+	addr := clientAddress(req, s.opts.ClientAddressHeader)
+
+	if s.opts.ClientThrottle != nil {
+		s.opts.ClientThrottle.Succeed(s.clientKey(addr))
+	}
+
+	if s.opts.Throttle != nil {
+		s.opts.Throttle.Succeed(addr)
+	}
+}
+
+// clientKey returns the key used to record the invalid access codes sent from 'addr' to the session's room.
+func (s *controllerSession) clientKey(addr string) string {
+	return fmt.Sprintf("%s#%s", s.opts.Room, addr)
+}
+
+// publishControllerEvent publishes 'msg', a controller lifecycle event. Note that lifecycle events are published
+// using a new context since they may be published after the request context has been cancelled.
+func publishControllerEvent(opts *relayOptions, req *http.Request, msg *sse.SSEMessage) {
+
+	err := msg.Publish(context.Background(), opts.Publisher)
+
+	if err != nil {
+		LogWithRequest(opts.Logger, req, "Failed to publish %s event, %v", msg.Type, err)
+	}
+}
+
+// endControllerSession ends the session for 'c', removing it from the room's controller queue and hub. Only
+// controllers which have sent a message with a valid code are considered to have connected so only they
+// publish a "controllerDisconnected" event.
+func endControllerSession(opts *relayOptions, req *http.Request, c relayController) {
+
+	if c.Code() != "" {
+		publishControllerEvent(opts, req, sse.NewControllerDisconnectedMessage(opts.Room, c.ID()))
+	}
+
+	if opts.Queue != nil {
+		opts.Queue.Leave(c)
+	}
+
+	if opts.Controllers != nil {
+		opts.Controllers.Remove(c)
+	}
+}
+
+// relayUpdate validates the access code in 'update_msg', sent by the controller for 's', and publishes it to the
+// room's receivers. Messages whose type is reserved for the server's own messages (see `sse.IsReservedMessageType`) are
+// refused. If the options define a `ws.Registry` the message must also validate against the schema for its type. The
+// outcome is reported to the controller using the same frames for all transports: "expired", "invalid", "claimed" and
+// "relay" responses, and JSON-encoded session, queue, rejected and acknowledgement messages.
+func relayUpdate(ctx context.Context, req *http.Request, s *controllerSession, update_msg *ws.UpdateMessage) {
+
+	opts := s.opts
+	controller := s.controller
+
+	LogWithRequest(opts.Logger, req, "Received '%s' message (%s)\n", update_msg.Type, update_msg.Code)
+
+	// Messages whose type is used by the server's own messages would be mistaken for them by receivers
+
+	if update_msg.Type == "" || sse.IsReservedMessageType(update_msg.Type) {
+
+		reason := fmt.Sprintf("Reserved message type '%s'", update_msg.Type)
+
+		if update_msg.Type == "" {
+			reason = "Missing message type"
+		}
+
+		LogWithRequest(opts.Logger, req, "Refusing to relay message, %s", reason)
+
+		err := controller.SendResponse(ctx, ws.NewErrorResponseMessage("invalid", update_msg.ID, reason))
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to send invalid notice, %v", err)
+		}
+
+		return
+	}
+
+	// START OF check relay code
+
+	// Controllers which have already joined the queue for this room do not need
+	// to have their code validated again since the queue, rather than the use of
+	// newer access codes, determines who is in control.
+
+	queued := opts.Queue != nil && update_msg.Code == controller.Code() && opts.Queue.Position(controller) != -1
+
+	var update_code *auth.RelayCode
+
+	if opts.Store != nil && !queued {
+
+		// Clients which have sent too many invalid access codes, or whose address has, are refused
+		// without their code being checked so that short codes (for example PINs) can not be guessed
+
+		if !s.attempt(req) {
+
+			LogWithRequest(opts.Logger, req, "Too many invalid access codes, refusing '%s'", update_msg.Code)
+
+			err := controller.SendResponse(ctx, ws.NewErrorResponseMessage("invalid", update_msg.ID, "Too many invalid access codes"))
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to send invalid notice for '%s', %v\n", update_msg.Code, err)
+			}
+
+			return
+		}
+
+		// log.Printf("Validate code")
+
+		rc, err := auth.ValidateRelayCode(ctx, opts.Store, opts.Signer, opts.Room, update_msg.Code)
+
+		// Only invalid access codes count as failures
+
+		if !errors.Is(err, auth.ErrInvalidCode) {
+			s.succeed(req)
+		}
+
+		if err != nil {
+
+			// There is a newer code in use so this code is no longer
+			// valid and we drop the update on the floor
+
+			if errors.Is(err, auth.ErrExpiredCode) || errors.Is(err, auth.ErrRevokedCode) {
+
+				LogWithRequest(opts.Logger, req, "Code '%s' has expired, %v\n", update_msg.Code, err)
+
+				publishControllerEvent(opts, req, sse.NewCodeExpiredMessage(opts.Room, controller.ID(), update_msg.Code))
+
+				err := controller.SendResponse(ctx, ws.NewErrorResponseMessage("expired", update_msg.ID, err.Error()))
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to send expiry notice for '%s', %v\n", update_msg.Code, err)
+				}
+
+				return
+			}
+
+			LogWithRequest(opts.Logger, req, "Failed to validate %s, %v", update_msg.Code, err)
+
+			err := controller.SendResponse(ctx, ws.NewErrorResponseMessage("invalid", update_msg.ID, err.Error()))
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to send invalid notice for '%s', %v\n", update_msg.Code, err)
+			}
+
+			return
+		}
+
+		update_code = rc
+	}
+
+	// START OF validate message
+
+	// Messages are validated before the access code is claimed or marked as used,
+	// so that a message which will be rejected has no side effects
+
+	if opts.Messages != nil {
+
+		err := opts.Messages.Validate(update_msg)
+
+		if err != nil {
+
+			LogWithRequest(opts.Logger, req, "Rejected '%s' message, %v", update_msg.Type, err)
+
+			var validation_err *ws.ValidationError
+
+			if !errors.As(err, &validation_err) {
+
+				validation_err = &ws.ValidationError{
+					Type:   update_msg.Type,
+					Reason: err.Error(),
+				}
+			}
+
+			err = controller.Send(ctx, ws.NewRejectedMessage(update_msg, validation_err))
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to send rejected notice, %v", err)
+			}
+
+			return
+		}
+	}
+
+	// END OF validate message
+
+	if update_code != nil {
+
+		// START OF one-time codes
+
+		// The first controller to use a code claims it and is sent a session token.
+		// Other connections using the same code must include that token in their
+		// messages, for example when a controller reconnects after a network error.
+
+		if opts.OneTimeCodes {
+
+			claimed := false
+
+			switch {
+			case s.session_code == update_code.Code:
+				// pass, this session claimed the code
+			case update_code.Session != "":
+
+				if auth.VerifyRelayCodeSession(update_code, update_msg.Token) {
+					s.session_code = update_code.Code
+				} else {
+					claimed = true
+				}
+
+			default:
+
+				token, err := auth.ClaimRelayCode(ctx, opts.Store, update_code)
+
+				if err != nil {
+
+					if !errors.Is(err, auth.ErrClaimedCode) {
+						LogWithRequest(opts.Logger, req, "Failed to claim code '%s', %v", update_msg.Code, err)
+					}
+
+					claimed = true
+					break
+				}
+
+				s.session_code = update_code.Code
+
+				err = controller.Send(ctx, ws.NewSessionMessage(token))
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to send session token for '%s', %v", update_msg.Code, err)
+				}
+			}
+
+			if claimed {
+
+				LogWithRequest(opts.Logger, req, "Code '%s' has already been claimed\n", update_msg.Code)
+
+				err := controller.SendResponse(ctx, ws.NewErrorResponseMessage("claimed", update_msg.ID, "Code has already been claimed"))
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to send claimed notice for '%s', %v\n", update_msg.Code, err)
+				}
+
+				return
+			}
+		}
+
+		// END OF one-time codes
+
+		// Remember the code so that messages sent by the receiver can be
+		// dispatched to this controller
+
+		if controller.Code() == "" {
+
+			controller.SetCode(update_code.Code)
+			publishControllerEvent(opts, req, sse.NewControllerConnectedMessage(opts.Room, controller.ID()))
+
+			if s.on_connected != nil {
+				s.on_connected(ctx)
+			}
+
+		} else {
+			controller.SetCode(update_code.Code)
+		}
+
+		// This code hasn't been used yet so send a message to hide the
+		// QR code. If there is a controller queue then the QR code stays
+		// visible so that other visitors can join the queue.
+
+		// log.Println("DEBUG", update_code.LastUpdate)
+
+		first_use := update_code.LastUpdate == 0
+
+		if first_use && opts.Queue == nil {
+
+			go func(ctx context.Context) {
+
+				msg := sse.NewHideCodeMessage(opts.Room)
+				err := msg.Publish(ctx, opts.Publisher)
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to publish message, %v", err)
+					return
+				}
+
+			}(ctx)
+		}
+
+		// Set last update for the current code
+
+		now := time.Now()
+		ts := now.Unix()
+
+		// log.Printf("Set last update for %s %d\n", update_code.Code, ts)
+
+		err := opts.Store.MarkUsed(ctx, update_code.Code, ts)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to set last update for '%s', %v", update_code.Code, err)
+		}
+
+		// This code is now in use which means that any older codes are no longer
+		// valid so let the controllers still using them know right away, rather than
+		// waiting for them to send another message. This is not necessary if there
+		// is a controller queue since it determines who is in control. Signed access
+		// codes are validated without querying the database so older codes need to
+		// be explicitly marked as superseded first.
+
+		if err == nil && first_use {
+
+			go func(rc *auth.RelayCode) {
+
+				ctx := context.Background()
+
+				if opts.Signer != nil {
+
+					err := opts.Store.Supersede(ctx, rc)
+
+					if err != nil {
+						LogWithRequest(opts.Logger, req, "Failed to supersede codes older than '%s', %v", rc.Code, err)
+						return
+					}
+				}
+
+				if opts.Controllers == nil || opts.Queue != nil {
+					return
+				}
+
+				expire_opts := &ExpireControllersOptions{
+					Controllers: opts.Controllers,
+					Store:       opts.Store,
+					Signer:      opts.Signer,
+					Publisher:   opts.Publisher,
+					Logger:      opts.Logger,
+					Room:        opts.Room,
+				}
+
+				ExpireControllers(ctx, expire_opts)
+			}(update_code)
+		}
+	}
+
+	// END OF check relay code
+
+	s.touch()
+
+	// START OF controller queue
+
+	if opts.Queue != nil {
+
+		position := opts.Queue.Position(controller)
+
+		if position == -1 {
+
+			// Controllers are notified of their position by the queue itself
+			position = opts.Queue.Join(controller)
+
+		} else if position > 0 {
+
+			err := controller.Send(ctx, ws.NewQueueMessage(position, ""))
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to send queue position, %v", err)
+			}
+		}
+
+		// Only the active controller is allowed to send messages
+
+		if position != 0 {
+			LogWithRequest(opts.Logger, req, "Controller is waiting in queue (%d), message not relayed", position)
+			return
+		}
+
+		opts.Queue.Touch(controller)
+	}
+
+	// END OF controller queue
+
+	// Finally send the update down to the receiver
+
+	go func(ctx context.Context, c relayController, update_msg *ws.UpdateMessage) {
+
+		// log.Printf("WS RELAY '%s'\n", string(data))
+
+		// If the message has an ID then wait for the receiver to acknowledge it
+		// and forward the result back to the controller. Note that we start
+		// tracking the message before it is published so that acknowledgements
+		// from very fast receivers are not lost.
+
+		track := update_msg.ID != "" && opts.Acknowledgements != nil
+
+		// The ID receivers use to acknowledge the message. If the message is tracked
+		// this is a delivery ID assigned by the server, rather than the ID chosen by
+		// the controller, so that controllers can not collide with each other.
+
+		delivery_id := update_msg.ID
+
+		if track {
+
+			// Note that acknowledgements are sent to the controller, rather than the
+			// connection, so that they are delivered if the controller's session
+			// is resumed by a new connection.
+
+			on_ack := func(a *ack.Acknowledgement) {
+
+				ack_msg := &ws.AcknowledgementMessage{
+					Type:   a.Status,
+					ID:     a.ID,
+					Reason: a.Reason,
+				}
+
+				err := c.Send(context.Background(), ack_msg)
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to send %s notice for message '%s', %v", a.Status, a.ID, err)
+				}
+			}
+
+			id, err := opts.Acknowledgements.Add(opts.Room, update_msg.ID, on_ack)
+
+			if err != nil {
+
+				LogWithRequest(opts.Logger, req, "Failed to track message '%s', %v", update_msg.ID, err)
+
+				ack_msg := &ws.AcknowledgementMessage{
+					Type:   ack.Failed,
+					ID:     update_msg.ID,
+					Reason: err.Error(),
+				}
+
+				c.Send(ctx, ack_msg)
+				return
+			}
+
+			delivery_id = id
+		}
+
+		msg := sse.NewMessageFromUpdate(opts.Room, update_msg)
+		msg.ID = delivery_id
+
+		err := msg.Publish(ctx, opts.Publisher)
+
+		if err != nil {
+
+			LogWithRequest(opts.Logger, req, "Failed to publish message, %v", err)
+
+			if track {
+				opts.Acknowledgements.Remove(opts.Room, delivery_id)
+			}
+
+			return
+		}
+
+		err = c.SendResponse(ctx, ws.NewOKResponseMessage("relay", update_msg.ID))
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to send relay notice, %v", err)
+		}
+
+	}(ctx, controller, update_msg)
+}
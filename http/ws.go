@@ -7,10 +7,11 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/www-multiscreen-starter/ack"
 	"github.com/sfomuseum/www-multiscreen-starter/auth"
-	"github.com/sfomuseum/www-multiscreen-starter/sse"
+	"github.com/sfomuseum/www-multiscreen-starter/hub"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
 	"github.com/sfomuseum/www-multiscreen-starter/ws"
-	"gocloud.dev/docstore"
 	"io"
 	"log"
 	"net/http"
@@ -23,8 +24,10 @@ import (
 type WebsocketHandlerOptions struct {
 	// A valid publisher.Publisher instance used to relay messages sent to the Websocket endpoint.
 	Publisher publisher.Publisher
-	// A valid docstore.Collection instance where access codes will be stored and retrieved from.
-	Database *docstore.Collection
+	// A valid auth.Store instance where access codes will be stored and retrieved from.
+	Store auth.Store
+	// An optional auth.Signer instance used to validate signed (stateless) access codes. If nil access codes are validated using Store.
+	Signer *auth.Signer
 	// The amount of time to allow for Websocket pong requests.
 	PongWait time.Duration
 	// The amount of time to allow for Websocket ping requests.
@@ -35,22 +38,78 @@ type WebsocketHandlerOptions struct {
 	CheckOrigin func(r *http.Request) bool
 	// A valid *log.Logger  instance
 	Logger *log.Logger
+	// The name of the room (installation) that messages are relayed to.
+	Room string
+	// An optional ack.Tracker instance used to notify controllers when receivers acknowledge messages.
+	Acknowledgements *ack.Tracker
+	// An optional hub.Hub instance used to track the controllers connected to the handler.
+	Controllers *hub.Hub
+	// An optional hub.Queue instance used to ensure that only one controller at a time may relay messages.
+	Queue *hub.Queue
+	// The amount of time a controller may go without sending a message before a "controllerIdle" event is
+	// published. If zero no idle events are published.
+	IdleThreshold time.Duration
+	// If true access codes may only be used by a single controller. The first controller to send a message with a
+	// valid access code is sent a session token which it must include in messages sent over subsequent connections.
+	OneTimeCodes bool
+	// The amount of time during which a controller whose connection drops may resume its session over a new
+	// connection. Frames sent to the controller during this time are buffered and delivered when it resumes. Only
+	// controllers which negotiate the `ws.ResponseEnvelopeProtocol` subprotocol, or announce a protocol version, are
+	// sent resume tokens. If zero sessions cannot be resumed.
+	ResumeGrace time.Duration
+	// An optional ws.Registry instance used to validate messages before they are relayed. Messages which fail validation
+	// are not relayed and the controller is sent a `ws.RejectedMessage`. If nil messages are not validated.
+	Messages *ws.Registry
+	// An optional auth.Throttle instance used to limit the number of invalid access codes sent by the controllers at
+	// each address, in any room. Controllers which exceed the limit are sent an "invalid" response without their access
+	// codes being checked. If nil invalid access codes are not throttled by address.
+	AccessCodeThrottle *auth.Throttle
+	// An optional auth.Throttle instance used to limit the number of invalid access codes sent by each client address
+	// to this room. Failures are kept when a client reconnects. If nil invalid access codes are not throttled by client.
+	ClientAccessCodeThrottle *auth.Throttle
+	// The name of a trusted header, set by a proxy or load balancer, containing the address of each client (for
+	// example "X-Forwarded-For"). If empty the remote address of each request is used.
+	ClientAddressHeader string
 }
 
-// WebsocketHandler returns an http.Handler for serving Websocket requests.
+// WebsocketHandler returns an http.Handler for serving Websocket requests. Controllers which announce a protocol
+// version (see `protocol.Role.NegotiateRequest`) are sent a `ws.HelloMessage` when they connect and controllers which
+// announce an unsupported version are refused.
 func WebsocketHandler(opts *WebsocketHandlerOptions) (http.Handler, error) {
 
 	// Note the way we are assigning a custom "check origin" function
 	// which may be nil
 	// https://pkg.go.dev/github.com/gorilla/websocket#Upgrader.CheckOrigin
 
+	// Controllers which request the ws.ResponseEnvelopeProtocol subprotocol, or announce the protocol.Responses
+	// capability, are sent JSON-encoded responses. Other controllers are sent bare strings.
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  512,
 		WriteBufferSize: 512,
 		CheckOrigin:     opts.CheckOrigin,
+		Subprotocols:    []string{ws.ResponseEnvelopeProtocol},
+	}
+
+	relay_opts := &relayOptions{
+		Publisher:           opts.Publisher,
+		Store:               opts.Store,
+		Signer:              opts.Signer,
+		Logger:              opts.Logger,
+		Room:                opts.Room,
+		Acknowledgements:    opts.Acknowledgements,
+		Controllers:         opts.Controllers,
+		Queue:               opts.Queue,
+		IdleThreshold:       opts.IdleThreshold,
+		OneTimeCodes:        opts.OneTimeCodes,
+		Messages:            opts.Messages,
+		Throttle:            opts.AccessCodeThrottle,
+		ClientThrottle:      opts.ClientAccessCodeThrottle,
+		ClientAddressHeader: opts.ClientAddressHeader,
 	}
 
-	mu := new(sync.RWMutex)
+	// Controllers whose sessions may be resumed, by resume token
+	sessions := newResumableSessions()
 
 	fn := func(rsp http.ResponseWriter, req *http.Request) {
 
@@ -61,6 +120,14 @@ func WebsocketHandler(opts *WebsocketHandlerOptions) (http.Handler, error) {
 			return
 		}
 
+		h, err := protocol.Controller.NegotiateRequest(req)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Refusing controller, %v", err)
+			http.Error(rsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		ctx := req.Context()
 		ctx, cancel := context.WithCancel(ctx)
 
@@ -80,6 +147,95 @@ func WebsocketHandler(opts *WebsocketHandlerOptions) (http.Handler, error) {
 
 		defer conn.Close()
 
+		// Writes to the connection are serialized using a mutex which belongs to this connection alone, so that
+		// a stalled connection does not block writes to the other controllers in the room.
+
+		mu := new(sync.RWMutex)
+
+		// Note that 'controller' may be replaced by a controller whose session
+		// is resumed by this connection (see "resume" messages below).
+
+		envelopes := conn.Subprotocol() == ws.ResponseEnvelopeProtocol || h.Has(protocol.Responses)
+
+		controller, err := newWebsocketController(opts.Room, conn, mu, opts.WriteWait, envelopes)
+
+		if err != nil {
+			LogWithRequest(opts.Logger, req, "Failed to create controller, %v", err)
+			return
+		}
+
+		if h.Announced {
+
+			err := controller.Send(ctx, ws.NewHelloMessage(h))
+
+			if err != nil {
+				LogWithRequest(opts.Logger, req, "Failed to send hello message, %v", err)
+				return
+			}
+		}
+
+		if opts.Controllers != nil {
+			opts.Controllers.Add(controller)
+		}
+
+		// START OF controller lifecycle events
+
+		session := newControllerSession(relay_opts, req, controller)
+		defer session.stop()
+
+		// Issue a token the controller can use to resume its session if its connection drops. Controllers which
+		// have neither negotiated JSON-encoded responses nor announced a protocol version only expect bare string
+		// responses so they are not sent resume tokens.
+
+		if opts.ResumeGrace > 0 && (envelopes || h.Announced) {
+
+			session.on_connected = func(ctx context.Context) {
+
+				c := controller
+
+				token, err := newResumeToken()
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to create resume token, %v", err)
+					return
+				}
+
+				c.SetResumeToken(token)
+				sessions.Add(token, c)
+
+				err = c.Send(ctx, ws.NewResumableMessage(token, int(opts.ResumeGrace.Seconds())))
+
+				if err != nil {
+					LogWithRequest(opts.Logger, req, "Failed to send resume token, %v", err)
+				}
+			}
+		}
+
+		end_session := func(c *websocketController) {
+
+			endControllerSession(relay_opts, req, c)
+
+			token := c.ResumeToken()
+
+			if token != "" {
+				sessions.Remove(token)
+			}
+		}
+
+		// If the controller can be resumed its session is only ended once the
+		// grace period has elapsed without it being resumed by a new connection
+
+		defer func() {
+
+			c := controller
+
+			c.Release(conn, opts.ResumeGrace, func() {
+				end_session(c)
+			})
+		}()
+
+		// END OF controller lifecycle events
+
 		// START OF ...
 		// https://github.com/gorilla/websocket/blob/master/examples/filewatch/main.go
 
@@ -181,12 +337,19 @@ func WebsocketHandler(opts *WebsocketHandlerOptions) (http.Handler, error) {
 
 				if update_msg.Type == "ping" {
 
+					frame, err := controller.responseFrame(ws.NewOKResponseMessage("pong", update_msg.ID))
+
+					if err != nil {
+						LogWithRequest(opts.Logger, req, "Failed to create WS pong message, %v", err)
+						continue
+					}
+
 					go func() {
 
 						mu.Lock()
 						defer mu.Unlock()
 
-						err := conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+						err := conn.WriteMessage(websocket.TextMessage, frame)
 
 						if err != nil {
 							LogWithRequest(opts.Logger, req, "Failed to send WS pong message, %v", err)
@@ -196,170 +359,75 @@ func WebsocketHandler(opts *WebsocketHandlerOptions) (http.Handler, error) {
 					continue
 				}
 
-				LogWithRequest(opts.Logger, req, "Received '%s' message (%s)\n", update_msg.Type, update_msg.Code)
-
-				// START OF check relay code
-
-				if opts.Database != nil {
+				// START OF resume session
 
-					// log.Printf("Validate code")
+				if update_msg.Type == "resume" {
 
-					update_code := &auth.RelayCode{
-						Code: update_msg.Code,
-					}
+					prev, ok := sessions.Get(update_msg.Token)
+					resumed := false
 
-					err := opts.Database.Get(ctx, update_code)
+					if ok && prev != controller {
 
-					if err != nil {
+						// Resume tokens are replaced each time they are used so that a token which has leaked can
+						// not be used to take over the session again. The new token is registered first so that it
+						// is removed if the resumed session ends straight away.
 
-						LogWithRequest(opts.Logger, req, "Failed to get %s, %v", update_msg.Code, err)
+						next_token, err := newResumeToken()
 
-						go func() {
+						if err != nil {
+							LogWithRequest(opts.Logger, req, "Failed to create resume token, %v", err)
+						} else {
 
-							mu.Lock()
-							defer mu.Unlock()
+							sessions.Add(next_token, prev)
 
-							conn.SetWriteDeadline(time.Now().Add(opts.WriteWait))
-							err := conn.WriteMessage(websocket.TextMessage, []byte("invalid"))
+							resumed_msg := ws.NewResumedMessage(next_token, int(opts.ResumeGrace.Seconds()))
+							resumed = prev.Resume(conn, mu, envelopes, update_msg.Token, next_token, resumed_msg)
 
-							if err != nil {
-								LogWithRequest(opts.Logger, req, "Failed to send invalid notice for '%s', %v\n", update_msg.Code, err)
+							if resumed {
+								sessions.Remove(update_msg.Token)
+							} else {
+								sessions.Remove(next_token)
 							}
-						}()
-
-						break
+						}
 					}
 
-					// Note the way we are returning the results in ascending order
-					// This is to ensure that the "last update" checks below always
-					// work and don't get unintentionally reset by an updated access
-					// code which is (2+) steps ahead of an expired code but hasn't
-					// been used yet.
-
-					q := opts.Database.Query()
-					q = q.Where("Created", ">", update_code.Created)
-
-					// query requires a table scan, but has an ordering requirement;
-					//  add an index or provide Options.RunQueryFallback (code=Unimplemented)
-					q = q.OrderBy("Created", docstore.Ascending)
+					if !resumed {
 
-					iter := q.Get(ctx)
-					defer iter.Stop()
+						LogWithRequest(opts.Logger, req, "Failed to resume controller session\n")
 
-					// other_code can't be a pointer without freaking out the Docstore code
-					// so we can't test it for 'nil' below.
+						err := controller.Send(ctx, ws.NewResumeFailedMessage())
 
-					var other_code auth.RelayCode
-					err = iter.Next(ctx, &other_code)
-
-					// Query failed - io.EOF is equivalent of "no rows"
-
-					if err != nil && err != io.EOF {
-
-						LogWithRequest(opts.Logger, req, "Bunk next, %v", err)
-
-						go func() {
-
-							mu.Lock()
-							defer mu.Unlock()
-
-							conn.SetWriteDeadline(time.Now().Add(opts.WriteWait))
-							err := conn.WriteMessage(websocket.TextMessage, []byte("invalid"))
-
-							if err != nil {
-								LogWithRequest(opts.Logger, req, "Failed to send invalid notice for '%s', %v\n", update_msg.Code, err)
-							}
-						}()
+						if err != nil {
+							LogWithRequest(opts.Logger, req, "Failed to send resume failed notice, %v", err)
+						}
 
-						break
+						continue
 					}
 
-					// There is a newer code. If it's in use then this code is no longer
-					// valid and we drop the update on the floor
-
-					// log.Println("UPDATE", update_code.Created)
-					// log.Println("OTHER", other_code.LastUpdate)
-					
-					if other_code.Code != "" {
-
-						if other_code.LastUpdate > update_code.Created {
-
-							LogWithRequest(opts.Logger, req, "Code '%s' has expired and another code ('%s') is in use\n", update_msg.Code, other_code.Code)
+					LogWithRequest(opts.Logger, req, "Resumed session for controller '%s'\n", prev.ID())
 
-							go func() {
+					// The controller created for this connection hasn't sent any messages
+					// so it can be discarded without publishing any events
 
-								mu.Lock()
-								defer mu.Unlock()
-
-								conn.SetWriteDeadline(time.Now().Add(opts.WriteWait))
-								err := conn.WriteMessage(websocket.TextMessage, []byte("expired"))
-
-								if err != nil {
-									LogWithRequest(opts.Logger, req, "Failed to send expiry notice for '%s', %v\n", update_msg.Code, err)
-								}
-							}()
-
-							continue
-						}
+					if opts.Controllers != nil {
+						opts.Controllers.Remove(controller)
 					}
 
-					// This code hasn't been used yet so send a message to hide the
-					// QR code
-
-					// log.Println("DEBUG", update_code.LastUpdate)
-
-					if update_code.LastUpdate == 0 {
-
-						go func(ctx context.Context) {
+					controller = prev
+					session.controller = prev
 
-							msg := sse.NewHideCodeMessage()
-							err := msg.Publish(ctx, opts.Publisher)
-
-							if err != nil {
-								LogWithRequest(opts.Logger, req, "Failed to publish message, %v", err)
-								return
-							}
-
-						}(ctx)
+					if opts.OneTimeCodes {
+						session.session_code = controller.Code()
 					}
 
-					// Set last update for the current code
-
-					now := time.Now()
-					ts := now.Unix()
-
-					// log.Printf("Set last update for %s %d\n", update_code.Code, ts)
-
-					mod := docstore.Mods{"LastUpdate": ts}
-					err = opts.Database.Update(ctx, update_code, mod)
+					session.touch()
 
-					if err != nil {
-						LogWithRequest(opts.Logger, req, "Failed to set last update for '%s', %v", update_code.Code, err)
-					}
+					continue
 				}
 
-				// END OF check relay code
-
-				// Finally send the update down to the receiver
-
-				go func(ctx context.Context, update_msg *ws.UpdateMessage) {
-
-					// log.Printf("WS RELAY '%s'\n", string(data))
-
-					msg := sse.NewMessageFromUpdate(update_msg)
-					err := msg.Publish(ctx, opts.Publisher)
-
-					if err != nil {
-						LogWithRequest(opts.Logger, req, "Failed to publish message, %v", err)
-						return
-					}
-
-					mu.Lock()
-					defer mu.Unlock()
-
-					conn.WriteMessage(websocket.TextMessage, []byte("relay"))
+				// END OF resume session
 
-				}(ctx, update_msg)
+				relayUpdate(ctx, req, session, update_msg)
 
 			default:
 				// pass
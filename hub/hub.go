@@ -0,0 +1,93 @@
+// Package hub provides methods for tracking the controllers connected to each room (installation) and dispatching messages to them.
+package hub
+
+import (
+	"context"
+	"sync"
+)
+
+// type Controller is an interface for a controller connected to the relay server.
+type Controller interface {
+	// ID returns a unique identifier for the controller's connection.
+	ID() string
+	// Room returns the name of the room (installation) the controller is connected to.
+	Room() string
+	// Code returns the access code most recently used (and validated) by the controller, or an empty string
+	// if the controller has not sent any messages yet.
+	Code() string
+	// Send dispatches 'msg' to the controller.
+	Send(ctx context.Context, msg interface{}) error
+	// Expire notifies the controller that its access code has expired and closes its connection.
+	Expire(ctx context.Context) error
+}
+
+// type Hub is a struct for tracking the controllers connected to each room (installation).
+type Hub struct {
+	controllers map[string]map[string]Controller
+	mu          *sync.RWMutex
+}
+
+// NewHub returns a new (empty) `Hub` instance.
+func NewHub() *Hub {
+
+	h := &Hub{
+		controllers: make(map[string]map[string]Controller),
+		mu:          new(sync.RWMutex),
+	}
+
+	return h
+}
+
+// Add registers 'c' with the hub.
+func (h *Hub) Add(c Controller) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room := c.Room()
+
+	_, ok := h.controllers[room]
+
+	if !ok {
+		h.controllers[room] = make(map[string]Controller)
+	}
+
+	h.controllers[room][c.ID()] = c
+}
+
+// Remove unregisters 'c' from the hub.
+func (h *Hub) Remove(c Controller) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room := c.Room()
+
+	room_controllers, ok := h.controllers[room]
+
+	if !ok {
+		return
+	}
+
+	delete(room_controllers, c.ID())
+
+	if len(room_controllers) == 0 {
+		delete(h.controllers, room)
+	}
+}
+
+// Controllers returns the list of controllers currently connected to 'room'.
+func (h *Hub) Controllers(room string) []Controller {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	room_controllers := h.controllers[room]
+	list := make([]Controller, 0, len(room_controllers))
+
+	for _, c := range room_controllers {
+		list = append(list, c)
+	}
+
+	return list
+}
@@ -0,0 +1,287 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// Ended because the controller disconnected.
+const EndedDisconnected string = "disconnected"
+
+// Ended because the controller exceeded the maximum session duration.
+const EndedTimeout string = "timeout"
+
+// Ended because the controller did not send any messages within the idle timeout.
+const EndedIdle string = "idle"
+
+// type QueueOptions is a struct containing configuration options for a `Queue` instance.
+type QueueOptions struct {
+	// The maximum amount of time a controller may remain active. If zero there is no limit.
+	MaxDuration time.Duration
+	// The maximum amount of time an active controller may go without sending a message. If zero there is no limit.
+	IdleTimeout time.Duration
+	// An optional function invoked whenever the active controller changes. 'active'
+	// is the ID of the newly active controller, or an empty string if there is none, and 'waiting' is the number of
+	// controllers waiting in the queue.
+	OnChange func(active string, waiting int)
+	// An optional function invoked whenever a controller's status in the queue changes.
+	// 'position' is zero for the active controller, the 1-based position in line for waiting controllers and -1 for
+	// a controller whose session has ended, in which case 'reason' will explain why.
+	OnStatus func(c Controller, position int, reason string)
+}
+
+// type Queue is a struct that implements turn-taking for the controllers in a room (installation). Only
+// one controller is active at a time and all other controllers wait, in the order they joined, until
+// the active controller's session ends.
+type Queue struct {
+	options    *QueueOptions
+	active     Controller
+	waiting    []Controller
+	generation int64
+	max_timer  *time.Timer
+	idle_timer *time.Timer
+	mu         *sync.Mutex
+}
+
+// type queueUpdate is a struct describing a change in status for a controller in a queue.
+type queueUpdate struct {
+	controller Controller
+	position   int
+	reason     string
+}
+
+// NewQueue returns a new `Queue` instance configured by 'opts'.
+func NewQueue(opts *QueueOptions) *Queue {
+
+	q := &Queue{
+		options: opts,
+		waiting: make([]Controller, 0),
+		mu:      new(sync.Mutex),
+	}
+
+	return q
+}
+
+// Join adds 'c' to the queue, if it is not already present, and returns its position. The active controller
+// has position zero.
+func (q *Queue) Join(c Controller) int {
+
+	q.mu.Lock()
+
+	pos := q.position(c)
+
+	if pos != -1 {
+		q.mu.Unlock()
+		return pos
+	}
+
+	updates := make([]*queueUpdate, 0)
+	changed := false
+
+	if q.active == nil {
+		updates = append(updates, q.promote(c))
+		changed = true
+		pos = 0
+	} else {
+		q.waiting = append(q.waiting, c)
+		pos = len(q.waiting)
+		updates = append(updates, &queueUpdate{controller: c, position: pos})
+	}
+
+	active, waiting := q.state()
+
+	q.mu.Unlock()
+
+	q.notify(updates, changed, active, waiting)
+	return pos
+}
+
+// Leave removes 'c' from the queue. If 'c' is the active controller then the next controller in line is promoted.
+func (q *Queue) Leave(c Controller) {
+	q.end(c, EndedDisconnected, -1)
+}
+
+// Touch records activity for 'c', resetting its idle timer, and returns true if 'c' is the active controller.
+func (q *Queue) Touch(c Controller) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active == nil || q.active.ID() != c.ID() {
+		return false
+	}
+
+	if q.idle_timer != nil {
+		q.idle_timer.Reset(q.options.IdleTimeout)
+	}
+
+	return true
+}
+
+// Position returns the position of 'c' in the queue. The active controller has position zero and
+// controllers which are not in the queue have position -1.
+func (q *Queue) Position(c Controller) int {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.position(c)
+}
+
+// Active returns the ID of the active controller, or an empty string if there is none.
+func (q *Queue) Active() string {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	active, _ := q.state()
+	return active
+}
+
+// end ends the session for 'c', if it is the active controller, or removes it from the list of waiting controllers.
+// If 'generation' is not -1 then the active session is only ended if it matches the current session generation.
+func (q *Queue) end(c Controller, reason string, generation int64) {
+
+	q.mu.Lock()
+
+	updates := make([]*queueUpdate, 0)
+	changed := false
+
+	if q.active != nil && q.active.ID() == c.ID() {
+
+		if generation != -1 && generation != q.generation {
+			q.mu.Unlock()
+			return
+		}
+
+		q.stopTimers()
+		q.active = nil
+
+		updates = append(updates, &queueUpdate{controller: c, position: -1, reason: reason})
+
+		if len(q.waiting) > 0 {
+			next := q.waiting[0]
+			q.waiting = q.waiting[1:]
+			updates = append(updates, q.promote(next))
+		}
+
+		changed = true
+
+	} else {
+
+		idx := -1
+
+		for i, w := range q.waiting {
+
+			if w.ID() == c.ID() {
+				idx = i
+				break
+			}
+		}
+
+		if idx == -1 {
+			q.mu.Unlock()
+			return
+		}
+
+		q.waiting = append(q.waiting[:idx], q.waiting[idx+1:]...)
+	}
+
+	// Let everyone still waiting know their new position in line
+
+	for i, w := range q.waiting {
+		updates = append(updates, &queueUpdate{controller: w, position: i + 1})
+	}
+
+	active, waiting := q.state()
+
+	q.mu.Unlock()
+
+	q.notify(updates, changed, active, waiting)
+}
+
+// promote makes 'c' the active controller and starts its session timers. It is assumed that the
+// queue's lock is already held.
+func (q *Queue) promote(c Controller) *queueUpdate {
+
+	q.active = c
+	q.generation += 1
+
+	generation := q.generation
+
+	if q.options.MaxDuration > 0 {
+
+		q.max_timer = time.AfterFunc(q.options.MaxDuration, func() {
+			q.end(c, EndedTimeout, generation)
+		})
+	}
+
+	if q.options.IdleTimeout > 0 {
+
+		q.idle_timer = time.AfterFunc(q.options.IdleTimeout, func() {
+			q.end(c, EndedIdle, generation)
+		})
+	}
+
+	return &queueUpdate{controller: c, position: 0}
+}
+
+// stopTimers stops the session timers for the active controller. It is assumed that the queue's lock is already held.
+func (q *Queue) stopTimers() {
+
+	if q.max_timer != nil {
+		q.max_timer.Stop()
+		q.max_timer = nil
+	}
+
+	if q.idle_timer != nil {
+		q.idle_timer.Stop()
+		q.idle_timer = nil
+	}
+}
+
+// position returns the position of 'c' in the queue. It is assumed that the queue's lock is already held.
+func (q *Queue) position(c Controller) int {
+
+	if q.active != nil && q.active.ID() == c.ID() {
+		return 0
+	}
+
+	for i, w := range q.waiting {
+
+		if w.ID() == c.ID() {
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// state returns the ID of the active controller and the number of waiting controllers. It is assumed that the
+// queue's lock is already held.
+func (q *Queue) state() (string, int) {
+
+	active := ""
+
+	if q.active != nil {
+		active = q.active.ID()
+	}
+
+	return active, len(q.waiting)
+}
+
+// notify dispatches 'updates' and, if 'changed' is true, the change of active controller to the queue's callback
+// functions. Updates are dispatched in order and it is assumed that the queue's lock is NOT held.
+func (q *Queue) notify(updates []*queueUpdate, changed bool, active string, waiting int) {
+
+	if q.options.OnStatus != nil {
+
+		for _, u := range updates {
+			q.options.OnStatus(u.controller, u.position, u.reason)
+		}
+	}
+
+	if changed && q.options.OnChange != nil {
+		q.options.OnChange(active, waiting)
+	}
+}
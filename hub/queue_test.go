@@ -0,0 +1,311 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The maximum amount of time to wait for a queue's timers to end a session.
+const testQueueWait time.Duration = 2 * time.Second
+
+// type testController implements the `Controller` interface for testing.
+type testController struct {
+	id string
+}
+
+func (c *testController) ID() string {
+	return c.id
+}
+
+func (c *testController) Room() string {
+	return "default"
+}
+
+func (c *testController) Code() string {
+	return ""
+}
+
+func (c *testController) Send(ctx context.Context, msg interface{}) error {
+	return nil
+}
+
+func (c *testController) Expire(ctx context.Context) error {
+	return nil
+}
+
+// type testStatus is a struct recording a call to a queue's `OnStatus` function.
+type testStatus struct {
+	id       string
+	position int
+	reason   string
+}
+
+// newTestQueue returns a new `Queue` configured by 'opts' and a channel which receives each of its status updates.
+func newTestQueue(opts *QueueOptions) (*Queue, chan testStatus) {
+
+	statuses := make(chan testStatus, 100)
+
+	opts.OnStatus = func(c Controller, position int, reason string) {
+		statuses <- testStatus{id: c.ID(), position: position, reason: reason}
+	}
+
+	return NewQueue(opts), statuses
+}
+
+// expectStatus fails 't' unless the next status update received from 'statuses' matches 'expected'.
+func expectStatus(t *testing.T, statuses chan testStatus, expected testStatus) {
+
+	t.Helper()
+
+	select {
+	case s := <-statuses:
+
+		if s != expected {
+			t.Fatalf("Expected status %+v, got %+v", expected, s)
+		}
+
+	case <-time.After(testQueueWait):
+		t.Fatalf("Timed out waiting for status %+v", expected)
+	}
+}
+
+func TestQueuePromotion(t *testing.T) {
+
+	changes := make([]string, 0)
+
+	opts := &QueueOptions{
+		OnChange: func(active string, waiting int) {
+			changes = append(changes, fmt.Sprintf("%s/%d", active, waiting))
+		},
+	}
+
+	q, statuses := newTestQueue(opts)
+
+	a := &testController{id: "a"}
+	b := &testController{id: "b"}
+	c := &testController{id: "c"}
+
+	for i, ctrl := range []*testController{a, b, c} {
+
+		pos := q.Join(ctrl)
+
+		if pos != i {
+			t.Fatalf("Expected '%s' to join at position %d, got %d", ctrl.id, i, pos)
+		}
+
+		expectStatus(t, statuses, testStatus{id: ctrl.id, position: i})
+	}
+
+	// Joining again does not change a controller's position
+
+	if q.Join(b) != 1 {
+		t.Fatalf("Expected 'b' to remain at position 1")
+	}
+
+	if q.Active() != "a" || !q.Touch(a) || q.Touch(b) {
+		t.Fatalf("Expected 'a' to be the active controller")
+	}
+
+	// Waiting controllers which leave are removed and the controllers behind them move up
+
+	q.Leave(b)
+
+	expectStatus(t, statuses, testStatus{id: "c", position: 1})
+
+	if q.Position(b) != -1 || q.Position(c) != 1 {
+		t.Fatalf("Expected 'b' to have left and 'c' to be at position 1, got %d and %d", q.Position(b), q.Position(c))
+	}
+
+	// The next controller in line is promoted when the active controller leaves
+
+	q.Leave(a)
+
+	expectStatus(t, statuses, testStatus{id: "a", position: -1, reason: EndedDisconnected})
+	expectStatus(t, statuses, testStatus{id: "c", position: 0})
+
+	if q.Active() != "c" {
+		t.Fatalf("Expected 'c' to be the active controller, got '%s'", q.Active())
+	}
+
+	q.Leave(c)
+
+	expectStatus(t, statuses, testStatus{id: "c", position: -1, reason: EndedDisconnected})
+
+	if q.Active() != "" {
+		t.Fatalf("Expected no active controller, got '%s'", q.Active())
+	}
+
+	// Controllers which are not in the queue can leave without side effects
+
+	q.Leave(a)
+
+	select {
+	case s := <-statuses:
+		t.Fatalf("Unexpected status %+v", s)
+	default:
+		// pass
+	}
+
+	expected_changes := []string{"a/0", "c/0", "/0"}
+
+	if fmt.Sprintf("%v", changes) != fmt.Sprintf("%v", expected_changes) {
+		t.Fatalf("Expected changes %v, got %v", expected_changes, changes)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+
+	opts := &QueueOptions{
+		MaxDuration: 50 * time.Millisecond,
+	}
+
+	q, statuses := newTestQueue(opts)
+
+	a := &testController{id: "a"}
+	b := &testController{id: "b"}
+
+	q.Join(a)
+	q.Join(b)
+
+	expectStatus(t, statuses, testStatus{id: "a", position: 0})
+	expectStatus(t, statuses, testStatus{id: "b", position: 1})
+
+	// Activity does not extend the maximum session duration
+
+	q.Touch(a)
+
+	expectStatus(t, statuses, testStatus{id: "a", position: -1, reason: EndedTimeout})
+	expectStatus(t, statuses, testStatus{id: "b", position: 0})
+
+	expectStatus(t, statuses, testStatus{id: "b", position: -1, reason: EndedTimeout})
+
+	if q.Active() != "" {
+		t.Fatalf("Expected no active controller, got '%s'", q.Active())
+	}
+}
+
+func TestQueueIdle(t *testing.T) {
+
+	idle := 100 * time.Millisecond
+
+	opts := &QueueOptions{
+		IdleTimeout: idle,
+	}
+
+	q, statuses := newTestQueue(opts)
+
+	a := &testController{id: "a"}
+
+	q.Join(a)
+
+	expectStatus(t, statuses, testStatus{id: "a", position: 0})
+
+	// Activity resets the idle timer
+
+	for i := 0; i < 5; i++ {
+
+		time.Sleep(idle / 4)
+
+		if !q.Touch(a) {
+			t.Fatalf("Expected 'a' to remain active while it is sending messages")
+		}
+	}
+
+	select {
+	case s := <-statuses:
+		t.Fatalf("Unexpected status %+v", s)
+	default:
+		// pass
+	}
+
+	expectStatus(t, statuses, testStatus{id: "a", position: -1, reason: EndedIdle})
+}
+
+func TestQueueGeneration(t *testing.T) {
+
+	opts := &QueueOptions{}
+
+	q, statuses := newTestQueue(opts)
+
+	a := &testController{id: "a"}
+
+	q.Join(a)
+	expectStatus(t, statuses, testStatus{id: "a", position: 0})
+
+	stale_generation := q.generation
+
+	q.Leave(a)
+	expectStatus(t, statuses, testStatus{id: "a", position: -1, reason: EndedDisconnected})
+
+	q.Join(a)
+	expectStatus(t, statuses, testStatus{id: "a", position: 0})
+
+	// A timer for an earlier session, which fired before it could be stopped, does not end the current session
+
+	q.end(a, EndedTimeout, stale_generation)
+
+	if q.Active() != "a" {
+		t.Fatalf("Expected stale timer not to end the current session")
+	}
+
+	q.end(a, EndedTimeout, q.generation)
+	expectStatus(t, statuses, testStatus{id: "a", position: -1, reason: EndedTimeout})
+
+	if q.Active() != "" {
+		t.Fatalf("Expected no active controller, got '%s'", q.Active())
+	}
+}
+
+func TestQueueConcurrency(t *testing.T) {
+
+	opts := &QueueOptions{
+		MaxDuration: 5 * time.Millisecond,
+		IdleTimeout: 5 * time.Millisecond,
+	}
+
+	q := NewQueue(opts)
+
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < 20; i++ {
+
+		wg.Add(1)
+
+		go func(c Controller) {
+
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+
+				pos := q.Join(c)
+
+				if pos < 0 {
+					t.Errorf("Expected '%s' to be in the queue after joining, got %d", c.ID(), pos)
+				}
+
+				if pos == 0 {
+					q.Touch(c)
+				}
+
+				q.Leave(c)
+			}
+
+		}(&testController{id: fmt.Sprintf("controller-%d", i)})
+	}
+
+	wg.Wait()
+
+	if q.Active() != "" {
+		t.Fatalf("Expected no active controller after every controller left, got '%s'", q.Active())
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) != 0 {
+		t.Fatalf("Expected no waiting controllers, got %d", len(q.waiting))
+	}
+}
@@ -0,0 +1,182 @@
+// Package protocol provides methods for negotiating the version and capabilities of the messaging protocol spoken
+// between the server and the controllers and receivers connected to it.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version1 is the original version of the protocol. The data of the messages relayed from controllers to receivers
+// is a dictionary containing the message body as a "body" property.
+const Version1 int = 1
+
+// Version2 is the version of the protocol where the data of the messages relayed from controllers to receivers is the
+// message body itself.
+const Version2 int = 2
+
+// DefaultVersion is the version of the protocol assumed for clients which do not announce one.
+const DefaultVersion int = Version1
+
+// CurrentVersion is the most recent version of the protocol supported by the server.
+const CurrentVersion int = Version2
+
+// ControllerEvents is the capability of receivers which handle the "controllerConnected", "controllerIdle",
+// "controllerDisconnected", "controllerChanged" and "codeExpired" messages.
+const ControllerEvents string = "controllerEvents"
+
+// Responses is the capability of controllers which handle JSON-encoded `ws.ResponseMessage` frames, rather than bare strings.
+const Responses string = "responses"
+
+// The name of the query parameter, or header, used by clients to announce the version of the protocol they speak.
+// Query parameters are used by browsers which can not set headers when opening SSE or WebSocket connections.
+const VersionParameter string = "version"
+
+// The name of the query parameter used by clients to announce a comma-separated list of the capabilities they support.
+const CapabilitiesParameter string = "capabilities"
+
+// The name of the header used by clients to announce the version of the protocol they speak.
+const VersionHeader string = "X-Protocol-Version"
+
+// The name of the header used by clients to announce a comma-separated list of the capabilities they support.
+const CapabilitiesHeader string = "X-Protocol-Capabilities"
+
+// ErrUnsupportedVersion is returned when a client announces a version of the protocol the server does not support.
+var ErrUnsupportedVersion = errors.New("Unsupported protocol version")
+
+// type Role is a struct describing the capabilities the server supports for a kind of client.
+type Role struct {
+	// The capabilities the server supports for clients in this role.
+	Capabilities []string
+	// The capabilities assumed for clients in this role which do not announce a protocol version. These preserve
+	// the behaviour of the server before protocol versions were introduced.
+	Legacy []string
+}
+
+// Receiver is the `Role` for receivers. Receivers which do not announce a protocol version are sent all messages.
+var Receiver = &Role{
+	Capabilities: []string{ControllerEvents},
+	Legacy:       []string{ControllerEvents},
+}
+
+// Controller is the `Role` for controllers. Controllers which do not announce a protocol version are sent bare string responses.
+var Controller = &Role{
+	Capabilities: []string{Responses},
+	Legacy:       []string{},
+}
+
+// type Handshake is a struct containing the version of the protocol and the capabilities agreed with a client.
+type Handshake struct {
+	// The version of the protocol spoken with the client.
+	Version int `json:"version"`
+	// The capabilities supported by both the client and the server, sorted alphabetically.
+	Capabilities []string `json:"capabilities"`
+	// A boolean flag indicating whether the client announced a protocol version. Clients which did should be sent
+	// the handshake (as a "hello" message) so that they know which version and capabilities were agreed.
+	Announced bool `json:"-"`
+}
+
+// Has returns a boolean value indicating whether 'capability' was agreed with the client.
+func (h *Handshake) Has(capability string) bool {
+
+	for _, c := range h.Capabilities {
+
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Negotiate returns a new `Handshake` for a client in role 'r' which announced 'version' and 'capabilities'. If
+// 'version' is 0 the client is assumed to speak `DefaultVersion` and support the role's legacy capabilities. If
+// 'version' is not supported an error wrapping `ErrUnsupportedVersion` is returned. Capabilities which the server
+// does not support are ignored.
+func (r *Role) Negotiate(version int, capabilities []string) (*Handshake, error) {
+
+	if version == 0 {
+
+		h := &Handshake{
+			Version:      DefaultVersion,
+			Capabilities: r.Legacy,
+		}
+
+		return h, nil
+	}
+
+	if version < Version1 || version > CurrentVersion {
+		return nil, fmt.Errorf("%w, %d (supported versions are %d to %d)", ErrUnsupportedVersion, version, Version1, CurrentVersion)
+	}
+
+	supported := make(map[string]bool)
+
+	for _, c := range r.Capabilities {
+		supported[c] = true
+	}
+
+	agreed := make([]string, 0)
+
+	for _, c := range capabilities {
+
+		if supported[c] {
+			agreed = append(agreed, c)
+			delete(supported, c)
+		}
+	}
+
+	sort.Strings(agreed)
+
+	h := &Handshake{
+		Version:      version,
+		Capabilities: agreed,
+		Announced:    true,
+	}
+
+	return h, nil
+}
+
+// NegotiateRequest returns a new `Handshake` for a client in role 'r' using the version and capabilities announced
+// by 'req', either as query parameters or headers.
+func (r *Role) NegotiateRequest(req *http.Request) (*Handshake, error) {
+
+	q := req.URL.Query()
+
+	str_version := q.Get(VersionParameter)
+	str_capabilities := q.Get(CapabilitiesParameter)
+
+	if str_version == "" {
+		str_version = req.Header.Get(VersionHeader)
+	}
+
+	if str_capabilities == "" {
+		str_capabilities = req.Header.Get(CapabilitiesHeader)
+	}
+
+	if str_version == "" {
+		return r.Negotiate(0, nil)
+	}
+
+	version, err := strconv.Atoi(str_version)
+
+	if err != nil || version == 0 {
+		return nil, fmt.Errorf("%w, '%s'", ErrUnsupportedVersion, str_version)
+	}
+
+	capabilities := make([]string, 0)
+
+	for _, c := range strings.Split(str_capabilities, ",") {
+
+		c = strings.TrimSpace(c)
+
+		if c != "" {
+			capabilities = append(capabilities, c)
+		}
+	}
+
+	return r.Negotiate(version, capabilities)
+}
@@ -0,0 +1,284 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sfomuseum/go-pubsub/subscriber"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The default number of messages retained for each room, by `RoomsBroker`, in order to replay them to reconnecting clients.
+const DefaultBufferSize int = 100
+
+// type RoomsBroker is a struct that dispatches messages received from a single subscriber.Subscriber
+// instance to the SSE clients connected to each room (installation).
+type RoomsBroker struct {
+	brokers map[string]*roomBroker
+	// The subscriber used to replay messages to reconnecting clients, if it implements `ReplaySubscriber`.
+	replayer     ReplaySubscriber
+	default_room string
+	mu           *sync.RWMutex
+	// A valid *log.Logger instance
+	Logger *log.Logger
+	// The number of messages retained for each room in order to replay them to clients which reconnect with a
+	// "Last-Event-ID" header. This is only used if the subscriber does not implement `ReplaySubscriber`. If 0
+	// messages are not numbered and can not be replayed. Must be set before the `Start` method is invoked.
+	BufferSize int
+	// The list of rooms whose messages are written as named SSE events, where the message type is written as the "event:"
+	// field and its data as the "data:" field, rather than as JSON-encoded `SSEMessage` instances in the "data:" field of
+	// the default "message" event. If the list contains "*" all rooms use named events. Must be set before the `Start`
+	// method is invoked.
+	NamedEventRooms []string
+	// The reconnection time sent to SSE clients, using the "retry:" field, when they connect. If zero no reconnection
+	// time is sent and clients use their own default. Must be set before the `Start` method is invoked.
+	Retry time.Duration
+	// An optional function invoked with each message received from the subscriber before it is dispatched. If it
+	// returns true the message is assumed to have been handled and is not dispatched to the room's broker.
+	Intercept func(context.Context, *SSEMessage) bool
+}
+
+// NewRoomsBroker returns a new `RoomsBroker` instance with a broker for each of 'rooms'.
+func NewRoomsBroker(rooms []string) (*RoomsBroker, error) {
+
+	brokers := make(map[string]*roomBroker)
+
+	// Message identifiers are prefixed with a unique value for each broker so that clients which reconnect to a
+	// different server instance, or after the server restarts, are sent a reset message rather than the wrong messages.
+
+	epoch := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	for _, room := range rooms {
+		brokers[room] = newRoomBroker(room, epoch)
+	}
+
+	b := &RoomsBroker{
+		brokers:    brokers,
+		mu:         new(sync.RWMutex),
+		Logger:     log.Default(),
+		BufferSize: DefaultBufferSize,
+	}
+
+	return b, nil
+}
+
+// Start will begin listening for messages from 'sub', dispatching each message to the clients connected to the room
+// matching its `Room` property. Messages without a room are dispatched to 'default_room'. If 'sub' implements the
+// `ReplaySubscriber` interface each message is sent with its identifier and clients which reconnect with a
+// "Last-Event-ID" header are sent the messages they missed. Otherwise messages are numbered, and the most recent
+// messages for each room (up to `BufferSize`) are retained and replayed. Clients which have missed more messages
+// than can be replayed are sent a "reset" message.
+func (b *RoomsBroker) Start(ctx context.Context, sub subscriber.Subscriber, default_room string) error {
+
+	events := make(chan *Event)
+
+	replay_sub, ok := sub.(ReplaySubscriber)
+
+	named_events := make(map[string]bool)
+
+	for _, room := range b.NamedEventRooms {
+		named_events[room] = true
+	}
+
+	for room, br := range b.brokers {
+
+		br.Logger = b.Logger
+		br.setFormat(named_events[room] || named_events["*"], b.Retry)
+
+		if !ok {
+			br.setBufferSize(b.BufferSize)
+		}
+	}
+
+	b.mu.Lock()
+
+	b.default_room = default_room
+
+	if ok {
+		b.replayer = replay_sub
+	}
+
+	b.mu.Unlock()
+
+	if ok {
+
+		go func() {
+
+			err := replay_sub.ListenEvents(ctx, events)
+
+			if err != nil {
+				b.Logger.Printf("Failed to listen for SSE events, %v", err)
+			}
+		}()
+
+	} else {
+
+		messages := make(chan string)
+
+		go func() {
+
+			// something something error handling...
+
+			sub.Listen(ctx, messages)
+		}()
+
+		go func() {
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case str_msg := <-messages:
+
+					select {
+					case <-ctx.Done():
+						return
+					case events <- &Event{Data: str_msg}:
+						// pass
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-events:
+
+				var msg SSEMessage
+
+				err := json.Unmarshal([]byte(ev.Data), &msg)
+
+				if err != nil {
+					b.Logger.Printf("Failed to decode SSE message, %v", err)
+					continue
+				}
+
+				if b.Intercept != nil && b.Intercept(ctx, &msg) {
+					continue
+				}
+
+				room := msg.Room
+
+				if room == "" {
+					room = default_room
+				}
+
+				br, ok := b.brokers[room]
+
+				if !ok {
+					b.Logger.Printf("Received message for unknown room '%s'", room)
+					continue
+				}
+
+				br.dispatch(ev)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// HandlerFuncWithTimeout returns a http.HandlerFunc for the SSE clients connected to 'room'.
+func (b *RoomsBroker) HandlerFuncWithTimeout(room string, ttl *time.Duration) (http.HandlerFunc, error) {
+
+	br, ok := b.brokers[room]
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown room '%s'", room)
+	}
+
+	return br.handlerFuncWithTimeout(ttl, b.replayFunc(room)), nil
+}
+
+// Subscribe returns a new `Subscription` for the messages dispatched to 'room', adapted to the protocol version and
+// capabilities in 'h' (which may be nil). This is used to deliver messages to receivers using transports other than
+// SSE. The `Subscription.Close` method should be invoked when the receiver disconnects.
+func (b *RoomsBroker) Subscribe(room string, h *protocol.Handshake) (*Subscription, error) {
+
+	br, ok := b.brokers[room]
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown room '%s'", room)
+	}
+
+	return newSubscription(br, b.replayFunc(room), h), nil
+}
+
+// replayFunc returns a `ReplayFunc` for 'room' which replays messages from the subscriber, if it implements the
+// `ReplaySubscriber` interface, or from the room's buffer of numbered messages.
+func (b *RoomsBroker) replayFunc(room string) ReplayFunc {
+
+	br := b.brokers[room]
+
+	fn := func(ctx context.Context, last_id string) ([]*Event, error) {
+
+		b.mu.RLock()
+		replayer := b.replayer
+		b.mu.RUnlock()
+
+		if replayer == nil {
+			return br.replayHistory(last_id)
+		}
+
+		return b.replay(ctx, room, last_id)
+	}
+
+	return fn
+}
+
+// replay returns the messages for 'room' received after 'last_id' from the subscriber, if it implements the
+// `ReplaySubscriber` interface. Messages used internally by server instances are excluded.
+func (b *RoomsBroker) replay(ctx context.Context, room string, last_id string) ([]*Event, error) {
+
+	b.mu.RLock()
+	replayer := b.replayer
+	default_room := b.default_room
+	b.mu.RUnlock()
+
+	if replayer == nil {
+		return nil, fmt.Errorf("%w, subscriber does not support replay", ErrEventsExpired)
+	}
+
+	events, err := replayer.Replay(ctx, last_id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	room_events := make([]*Event, 0)
+
+	for _, ev := range events {
+
+		var msg SSEMessage
+
+		err := json.Unmarshal([]byte(ev.Data), &msg)
+
+		if err != nil || isInternalMessage(&msg) {
+			continue
+		}
+
+		msg_room := msg.Room
+
+		if msg_room == "" {
+			msg_room = default_room
+		}
+
+		if msg_room != room {
+			continue
+		}
+
+		room_events = append(room_events, ev)
+	}
+
+	return room_events, nil
+}
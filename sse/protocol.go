@@ -0,0 +1,85 @@
+package sse
+
+import (
+	"encoding/json"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
+)
+
+// The types of messages which are only delivered to receivers with the `protocol.ControllerEvents` capability.
+var controllerEventTypes = map[string]bool{
+	"controllerConnected":    true,
+	"controllerIdle":         true,
+	"controllerDisconnected": true,
+	"controllerChanged":      true,
+	"codeExpired":            true,
+}
+
+// adaptEvent returns a copy of 'ev' whose message has been adapted to the protocol version and capabilities agreed
+// with a receiver in 'h', and a boolean value indicating whether the event should be delivered to the receiver at all.
+// Events which can not be decoded are returned unchanged.
+func adaptEvent(ev *Event, h *protocol.Handshake) (*Event, bool) {
+
+	if h == nil {
+		return ev, true
+	}
+
+	if h.Version == protocol.Version1 && h.Has(protocol.ControllerEvents) {
+		return ev, true
+	}
+
+	var msg map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(ev.Data), &msg)
+
+	if err != nil || msg == nil {
+		return ev, true
+	}
+
+	var msg_type string
+	var msg_version int
+
+	json.Unmarshal(msg["type"], &msg_type)
+	json.Unmarshal(msg["version"], &msg_version)
+
+	if controllerEventTypes[msg_type] && !h.Has(protocol.ControllerEvents) {
+		return nil, false
+	}
+
+	// Version 1 messages relayed from controllers wrap the message body in a dictionary
+
+	if msg_version != protocol.Version1 || h.Version < protocol.Version2 {
+		return ev, true
+	}
+
+	var data map[string]json.RawMessage
+
+	err = json.Unmarshal(msg["data"], &data)
+
+	if err != nil || data == nil {
+		return ev, true
+	}
+
+	body, ok := data["body"]
+
+	if !ok {
+		body = json.RawMessage("null")
+	}
+
+	enc_version, _ := json.Marshal(protocol.Version2)
+
+	msg["data"] = body
+	msg["version"] = enc_version
+
+	enc_msg, err := json.Marshal(msg)
+
+	if err != nil {
+		return ev, true
+	}
+
+	adapted_ev := &Event{
+		ID:   ev.ID,
+		Data: string(enc_msg),
+	}
+
+	return adapted_ev, true
+}
@@ -0,0 +1,334 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/go-pubsub/subscriber"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The default (approximate) maximum number of messages retained in a Redis stream.
+const DefaultRedisStreamMaxLength int64 = 1000
+
+// The name of the Redis stream field containing the encoded message.
+const redisStreamField string = "data"
+
+// The amount of time to block waiting for new messages in each XREAD call.
+const redisStreamBlock time.Duration = 5 * time.Second
+
+var re_redis_stream_id = regexp.MustCompile(`^\d+-\d+$`)
+
+// type RedisStreamsPublisher implements the go-pubsub `publisher.Publisher` interface for messages appended to a Redis stream.
+type RedisStreamsPublisher struct {
+	publisher.Publisher
+	redis_client *redis.Client
+	redis_stream string
+	maxlen       int64
+}
+
+// type RedisStreamsSubscriber implements the go-pubsub `subscriber.Subscriber` and `ReplaySubscriber` interfaces for
+// messages read from a Redis stream. Unlike Redis PubSub channels messages are retained in the stream, up to an
+// approximate maximum length, so that the messages missed by reconnecting SSE clients can be replayed. The identifier
+// of each message is the ID assigned to it by Redis.
+type RedisStreamsSubscriber struct {
+	subscriber.Subscriber
+	redis_client *redis.Client
+	redis_stream string
+}
+
+func init() {
+	ctx := context.Background()
+	publisher.RegisterPublisher(ctx, "redisstreams", NewRedisStreamsPublisher)
+	subscriber.RegisterSubscriber(ctx, "redisstreams", NewRedisStreamsSubscriber)
+}
+
+// NewRedisStreamsPublisher returns a new `RedisStreamsPublisher` instance derived from 'uri' which is expected to take the form of:
+//
+//	redisstreams://?host={HOST}&port={PORT}&stream={STREAM}
+//
+// Optional parameters are:
+// * `?maxlen=` The approximate maximum number of messages to retain in the stream. Default is 1000.
+func NewRedisStreamsPublisher(ctx context.Context, uri string) (publisher.Publisher, error) {
+
+	client, stream, q, err := newRedisStreamsClient(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	maxlen := DefaultRedisStreamMaxLength
+
+	if q.Has("maxlen") {
+
+		v, err := strconv.ParseInt(q.Get("maxlen"), 10, 64)
+
+		if err != nil || v < 1 {
+			client.Close()
+			return nil, fmt.Errorf("Invalid ?maxlen= parameter")
+		}
+
+		maxlen = v
+	}
+
+	p := &RedisStreamsPublisher{
+		redis_client: client,
+		redis_stream: stream,
+		maxlen:       maxlen,
+	}
+
+	return p, nil
+}
+
+// Publish appends 'msg' to the Redis stream, trimming the stream to (approximately) its maximum length.
+func (p *RedisStreamsPublisher) Publish(ctx context.Context, msg string) error {
+
+	select {
+	case <-ctx.Done():
+		return nil
+	default:
+		// pass
+	}
+
+	args := &redis.XAddArgs{
+		Stream: p.redis_stream,
+		MaxLen: p.maxlen,
+		Approx: true,
+		Values: map[string]interface{}{
+			redisStreamField: msg,
+		},
+	}
+
+	err := p.redis_client.XAdd(ctx, args).Err()
+
+	if err != nil {
+		return fmt.Errorf("Failed to add message to stream '%s', %w", p.redis_stream, err)
+	}
+
+	return nil
+}
+
+// Close closes the underlying Redis client.
+func (p *RedisStreamsPublisher) Close() error {
+	return p.redis_client.Close()
+}
+
+// NewRedisStreamsSubscriber returns a new `RedisStreamsSubscriber` instance derived from 'uri' which is expected to take the form of:
+//
+//	redisstreams://?host={HOST}&port={PORT}&stream={STREAM}
+func NewRedisStreamsSubscriber(ctx context.Context, uri string) (subscriber.Subscriber, error) {
+
+	client, stream, _, err := newRedisStreamsClient(uri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RedisStreamsSubscriber{
+		redis_client: client,
+		redis_stream: stream,
+	}
+
+	return s, nil
+}
+
+// Listen sends each new message in the Redis stream to 'messages_ch' until 'ctx' is cancelled.
+func (s *RedisStreamsSubscriber) Listen(ctx context.Context, messages_ch chan string) error {
+
+	events := make(chan *Event)
+	done_ch := make(chan error)
+
+	go func() {
+		done_ch <- s.ListenEvents(ctx, events)
+	}()
+
+	for {
+		select {
+		case err := <-done_ch:
+			return err
+		case ev := <-events:
+
+			select {
+			case <-ctx.Done():
+			case messages_ch <- ev.Data:
+				// pass
+			}
+		}
+	}
+}
+
+// ListenEvents sends each new message in the Redis stream, and its ID, to 'events' until 'ctx' is cancelled.
+// Only messages added after this method is invoked are sent.
+func (s *RedisStreamsSubscriber) ListenEvents(ctx context.Context, events chan *Event) error {
+
+	last_id, err := s.lastID(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+			// pass
+		}
+
+		args := &redis.XReadArgs{
+			Streams: []string{s.redis_stream, last_id},
+			Count:   100,
+			Block:   redisStreamBlock,
+		}
+
+		streams, err := s.redis_client.XRead(ctx, args).Result()
+
+		if err != nil {
+
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			// Wait before trying again in case the Redis server is unavailable
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+
+		for _, str := range streams {
+
+			for _, xmsg := range str.Messages {
+
+				last_id = xmsg.ID
+
+				ev, ok := newRedisStreamEvent(xmsg)
+
+				if !ok {
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case events <- ev:
+					// pass
+				}
+			}
+		}
+	}
+}
+
+// Replay returns the messages in the Redis stream added after the message whose ID is 'last_id', oldest first. If the
+// message for 'last_id' has been trimmed from the stream, or never existed, an error wrapping `ErrEventsExpired` is returned.
+func (s *RedisStreamsSubscriber) Replay(ctx context.Context, last_id string) ([]*Event, error) {
+
+	if !re_redis_stream_id.MatchString(last_id) {
+		return nil, fmt.Errorf("%w, invalid stream ID '%s'", ErrEventsExpired, last_id)
+	}
+
+	// XRANGE is inclusive so the first message should be the one for 'last_id'. If it isn't then
+	// it has been trimmed and the messages that followed it may have been trimmed too.
+
+	messages, err := s.redis_client.XRange(ctx, s.redis_stream, last_id, "+").Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read stream '%s', %w", s.redis_stream, err)
+	}
+
+	if len(messages) == 0 || messages[0].ID != last_id {
+		return nil, fmt.Errorf("%w, stream ID '%s' not found", ErrEventsExpired, last_id)
+	}
+
+	events := make([]*Event, 0)
+
+	for _, xmsg := range messages[1:] {
+
+		ev, ok := newRedisStreamEvent(xmsg)
+
+		if ok {
+			events = append(events, ev)
+		}
+	}
+
+	return events, nil
+}
+
+// Close closes the underlying Redis client.
+func (s *RedisStreamsSubscriber) Close() error {
+	return s.redis_client.Close()
+}
+
+// lastID returns the ID of the newest message in the Redis stream, or "0-0" if the stream is empty.
+func (s *RedisStreamsSubscriber) lastID(ctx context.Context) (string, error) {
+
+	messages, err := s.redis_client.XRevRangeN(ctx, s.redis_stream, "+", "-", 1).Result()
+
+	if err != nil {
+		return "", fmt.Errorf("Failed to read stream '%s', %w", s.redis_stream, err)
+	}
+
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+
+	return messages[0].ID, nil
+}
+
+// newRedisStreamsClient returns a new Redis client, the name of the stream and the query parameters derived from 'uri'.
+func newRedisStreamsClient(uri string) (*redis.Client, string, url.Values, error) {
+
+	u, err := url.Parse(uri)
+
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to parse URI, %w", err)
+	}
+
+	q := u.Query()
+
+	host := q.Get("host")
+	port := q.Get("port")
+	stream := q.Get("stream")
+
+	if stream == "" {
+		return nil, "", nil, fmt.Errorf("Missing ?stream= parameter")
+	}
+
+	addr := fmt.Sprintf("%s:%s", host, port)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	return client, stream, q, nil
+}
+
+// newRedisStreamEvent returns a new `Event` for 'xmsg' and a boolean value indicating whether it contains a message.
+func newRedisStreamEvent(xmsg redis.XMessage) (*Event, bool) {
+
+	data, ok := xmsg.Values[redisStreamField].(string)
+
+	if !ok {
+		return nil, false
+	}
+
+	ev := &Event{
+		ID:   xmsg.ID,
+		Data: data,
+	}
+
+	return ev, true
+}
@@ -0,0 +1,181 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// The name of the environment variable containing the address (host and port) of a Redis server to test against. If
+// it is not set the Redis Streams tests are skipped.
+const testRedisAddrEnvVar string = "RELAY_TEST_REDIS_ADDR"
+
+// The approximate maximum length of the streams used by the Redis Streams tests.
+const testRedisStreamMaxLength int = 10
+
+// The number of messages to publish in order to ensure that the first message in a stream has been trimmed. Redis
+// only trims whole nodes of (by default) 100 messages when the maximum length is approximate.
+const testRedisStreamTrimCount int = 500
+
+func TestRedisStreams(t *testing.T) {
+
+	addr := os.Getenv(testRedisAddrEnvVar)
+
+	if addr == "" {
+		t.Skipf("%s is not set", testRedisAddrEnvVar)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		t.Fatalf("Invalid %s, %v", testRedisAddrEnvVar, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	q := url.Values{}
+	q.Set("host", host)
+	q.Set("port", port)
+	q.Set("stream", fmt.Sprintf("relay-test-%d", time.Now().UnixNano()))
+	q.Set("maxlen", fmt.Sprintf("%d", testRedisStreamMaxLength))
+
+	uri := fmt.Sprintf("redisstreams://?%s", q.Encode())
+
+	p, err := NewRedisStreamsPublisher(ctx, uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create publisher, %v", err)
+	}
+
+	defer p.Close()
+
+	s, err := NewRedisStreamsSubscriber(ctx, uri)
+
+	if err != nil {
+		t.Fatalf("Failed to create subscriber, %v", err)
+	}
+
+	defer s.Close()
+
+	sub := s.(*RedisStreamsSubscriber)
+
+	defer sub.redis_client.Del(context.Background(), sub.redis_stream)
+
+	// The stream is empty so every message published after this point is sent to 'events', regardless of when
+	// ListenEvents starts reading the stream
+
+	listen_ctx, listen_cancel := context.WithCancel(ctx)
+	defer listen_cancel()
+
+	events := make(chan *Event)
+	done_ch := make(chan error, 1)
+
+	go func() {
+		done_ch <- sub.ListenEvents(listen_ctx, events)
+	}()
+
+	messages := []string{"a", "b", "c"}
+
+	for _, msg := range messages {
+
+		err := p.Publish(ctx, msg)
+
+		if err != nil {
+			t.Fatalf("Failed to publish '%s', %v", msg, err)
+		}
+	}
+
+	ids := make([]string, 0)
+
+	for _, msg := range messages {
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for '%s'", msg)
+		case err := <-done_ch:
+			t.Fatalf("Listener exited before receiving '%s', %v", msg, err)
+		case ev := <-events:
+
+			if ev.Data != msg {
+				t.Fatalf("Expected '%s', got '%s'", msg, ev.Data)
+			}
+
+			if !re_redis_stream_id.MatchString(ev.ID) {
+				t.Fatalf("Expected a Redis stream ID for '%s', got '%s'", msg, ev.ID)
+			}
+
+			ids = append(ids, ev.ID)
+		}
+	}
+
+	listen_cancel()
+
+	select {
+	case err := <-done_ch:
+
+		if err != nil {
+			t.Fatalf("Listener failed, %v", err)
+		}
+
+	case <-time.After(redisStreamBlock + time.Second):
+		t.Fatalf("Timed out waiting for listener to exit")
+	}
+
+	// Replaying from the first message returns the messages that followed it
+
+	replayed, err := sub.Replay(ctx, ids[0])
+
+	if err != nil {
+		t.Fatalf("Failed to replay after '%s', %v", ids[0], err)
+	}
+
+	if len(replayed) != len(messages)-1 {
+		t.Fatalf("Expected %d replayed events, got %d", len(messages)-1, len(replayed))
+	}
+
+	for i, ev := range replayed {
+
+		if ev.ID != ids[i+1] || ev.Data != messages[i+1] {
+			t.Fatalf("Expected replayed event %d to be '%s' (%s), got '%s' (%s)", i, messages[i+1], ids[i+1], ev.Data, ev.ID)
+		}
+	}
+
+	replayed, err = sub.Replay(ctx, ids[len(ids)-1])
+
+	if err != nil {
+		t.Fatalf("Failed to replay after '%s', %v", ids[len(ids)-1], err)
+	}
+
+	if len(replayed) != 0 {
+		t.Fatalf("Expected no events after the newest message, got %d", len(replayed))
+	}
+
+	_, err = sub.Replay(ctx, "not-an-id")
+
+	if !errors.Is(err, ErrEventsExpired) {
+		t.Fatalf("Expected ErrEventsExpired for an invalid ID, got %v", err)
+	}
+
+	// Publish enough messages for the first message to be trimmed from the stream
+
+	for i := 0; i < testRedisStreamTrimCount; i++ {
+
+		err := p.Publish(ctx, fmt.Sprintf("%d", i))
+
+		if err != nil {
+			t.Fatalf("Failed to publish message %d, %v", i, err)
+		}
+	}
+
+	_, err = sub.Replay(ctx, ids[0])
+
+	if !errors.Is(err, ErrEventsExpired) {
+		t.Fatalf("Expected ErrEventsExpired after '%s' was trimmed, got %v", ids[0], err)
+	}
+}
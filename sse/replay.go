@@ -0,0 +1,41 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"github.com/sfomuseum/go-pubsub/subscriber"
+)
+
+// ErrEventsExpired is returned when the events following a given identifier can not be replayed, either because
+// they are no longer retained or because the identifier is not known. Clients are sent a "reset" message instead.
+var ErrEventsExpired = errors.New("Events are no longer available")
+
+// type Event is a struct containing an encoded `SSEMessage` and the unique identifier assigned to it by the transport
+// it was received from. Identifiers are written as the SSE "id:" field and are sent back by reconnecting clients
+// using the "Last-Event-ID" header.
+type Event struct {
+	// The unique identifier for the event. This is distinct from the `SSEMessage.ID` property which is used to
+	// acknowledge messages. If empty no "id:" field is written.
+	ID string
+	// The encoded `SSEMessage` (or other string) to write as the SSE "data:" field.
+	Data string
+}
+
+// type ReplaySubscriber is an interface for `subscriber.Subscriber` implementations which assign a unique, ordered
+// identifier to each message they receive and are able to replay the messages received after a given identifier.
+// When the `RoomsBroker` is started with a `ReplaySubscriber` reconnecting SSE clients are sent the messages they
+// missed, for their room, before any new messages.
+type ReplaySubscriber interface {
+	subscriber.Subscriber
+	// ListenEvents sends each new message, and its identifier, to 'events' until 'ctx' is cancelled.
+	ListenEvents(ctx context.Context, events chan *Event) error
+	// Replay returns the messages received after the message whose identifier is 'last_id', oldest first. If those
+	// messages can not all be replayed an error wrapping `ErrEventsExpired` is returned.
+	Replay(ctx context.Context, last_id string) ([]*Event, error)
+}
+
+// isInternalMessage returns a boolean value indicating whether 'msg' is used to communicate between server
+// instances and should never be dispatched (or replayed) to receivers.
+func isInternalMessage(msg *SSEMessage) bool {
+	return msg.Type == InvalidateCodesMessageType
+}
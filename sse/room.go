@@ -0,0 +1,455 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The separator between the event identifier and the acknowledgement ID in the "id:" field of named events whose
+// message has an acknowledgement ID, for example "dm76scwqk9aq-5#m1". Neither event identifiers nor the delivery IDs
+// assigned by the server contain this character.
+const AcknowledgementIDSeparator string = "#"
+
+// The number of events buffered for each SSE client. Clients which fall further behind than this are disconnected
+// so that they can reconnect and, if the subscriber supports it, replay the events they missed.
+const clientBufferSize int = 64
+
+// type ReplayFunc is a function which returns the events received after the event whose identifier is the second argument, oldest first.
+type ReplayFunc func(context.Context, string) ([]*Event, error)
+
+// type roomClient is a struct representing a single SSE connection.
+type roomClient struct {
+	events  chan *Event
+	dropped chan struct{}
+}
+
+// type roomBroker is a struct that dispatches events to the SSE clients connected to a single room. Events without an
+// identifier are numbered, using identifiers of the form "{EPOCH}-{SEQUENCE}", and retained in a ring buffer so that
+// they can be replayed to reconnecting clients.
+type roomBroker struct {
+	room    string
+	clients map[*roomClient]bool
+	// The identifier of the most recently dispatched event.
+	last_id string
+	// A unique identifier for the broker used to distinguish its event identifiers from those of other brokers
+	// (for example other server instances or previous runs of the same server).
+	epoch string
+	// The sequence number of the most recently numbered event.
+	seq int64
+	// The ring buffer of numbered events, where the event numbered 'n' is stored at index (n-1) % len(history).
+	history []*Event
+	// A boolean flag indicating whether messages are written as named events.
+	named_events bool
+	// The reconnection time sent to clients when they connect. If zero no reconnection time is sent.
+	retry  time.Duration
+	mu     *sync.Mutex
+	Logger *log.Logger
+}
+
+func newRoomBroker(room string, epoch string) *roomBroker {
+
+	b := &roomBroker{
+		room:    room,
+		clients: make(map[*roomClient]bool),
+		epoch:   epoch,
+		history: make([]*Event, 0),
+		mu:      new(sync.Mutex),
+		Logger:  log.Default(),
+	}
+
+	return b
+}
+
+// setBufferSize sets the number of numbered events retained for replay. If 'size' is 0 events are not numbered.
+func (b *roomBroker) setBufferSize(size int) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq = 0
+	b.history = make([]*Event, size)
+}
+
+// setFormat sets whether messages are written as named events and the reconnection time sent to clients when they connect.
+func (b *roomBroker) setFormat(named_events bool, retry time.Duration) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.named_events = named_events
+	b.retry = retry
+}
+
+// dispatch sends 'ev' to all the clients connected to the room, numbering it first if it does not have an identifier.
+// Clients whose buffers are full are disconnected.
+func (b *roomBroker) dispatch(ev *Event) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ev.ID == "" && len(b.history) > 0 {
+
+		b.seq += 1
+
+		ev = &Event{
+			ID:   fmt.Sprintf("%s-%d", b.epoch, b.seq),
+			Data: ev.Data,
+		}
+
+		b.history[(b.seq-1)%int64(len(b.history))] = ev
+	}
+
+	if ev.ID != "" {
+		b.last_id = ev.ID
+	}
+
+	for c, _ := range b.clients {
+
+		select {
+		case c.events <- ev:
+			// pass
+		default:
+			b.Logger.Printf("SSE client is not keeping up, disconnecting")
+			delete(b.clients, c)
+			close(c.dropped)
+		}
+	}
+}
+
+// replayHistory returns the numbered events dispatched after the event whose identifier is 'last_id', oldest first. If
+// 'last_id' was not numbered by this broker, or events following it are no longer retained, an error wrapping
+// `ErrEventsExpired` is returned.
+func (b *roomBroker) replayHistory(last_id string) ([]*Event, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := int64(len(b.history))
+
+	if size == 0 {
+		return nil, fmt.Errorf("%w, replay is disabled", ErrEventsExpired)
+	}
+
+	epoch, str_seq, ok := strings.Cut(last_id, "-")
+
+	if !ok || epoch != b.epoch {
+		return nil, fmt.Errorf("%w, unknown event ID '%s'", ErrEventsExpired, last_id)
+	}
+
+	seq, err := strconv.ParseInt(str_seq, 10, 64)
+
+	if err != nil || seq < 0 || seq > b.seq {
+		return nil, fmt.Errorf("%w, unknown event ID '%s'", ErrEventsExpired, last_id)
+	}
+
+	if b.seq-seq > size {
+		return nil, fmt.Errorf("%w, %d events since '%s' exceeds buffer size of %d", ErrEventsExpired, b.seq-seq, last_id, size)
+	}
+
+	events := make([]*Event, 0)
+
+	for n := seq + 1; n <= b.seq; n++ {
+		events = append(events, b.history[(n-1)%size])
+	}
+
+	return events, nil
+}
+
+// lastID returns the identifier of the most recently dispatched event.
+func (b *roomBroker) lastID() string {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.last_id
+}
+
+func (b *roomBroker) subscribe() *roomClient {
+
+	c := &roomClient{
+		events:  make(chan *Event, clientBufferSize),
+		dropped: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.clients[c] = true
+	b.mu.Unlock()
+
+	return c
+}
+
+func (b *roomBroker) unsubscribe(c *roomClient) {
+
+	b.mu.Lock()
+	delete(b.clients, c)
+	b.mu.Unlock()
+}
+
+// handlerFuncWithTimeout returns a http.HandlerFunc which streams events to SSE clients for up to 'ttl', if defined.
+// Clients which send a "Last-Event-ID" header are sent the events they missed, as returned by 'replay', first. Clients
+// which announce a protocol version are sent a "hello" message and events adapted to that version.
+func (b *roomBroker) handlerFuncWithTimeout(ttl *time.Duration, replay ReplayFunc) http.HandlerFunc {
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+
+		if ttl != nil {
+			b.Logger.Printf("SSE start handler from %s with TTL %v", r.RemoteAddr, ttl)
+		} else {
+			b.Logger.Printf("SSE start handler from %s", r.RemoteAddr)
+		}
+
+		defer func() {
+			b.Logger.Printf("SSE finish handler from %s", r.RemoteAddr)
+		}()
+
+		fl, ok := w.(http.Flusher)
+
+		if !ok {
+			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := r.Context()
+
+		if ttl != nil {
+
+			c, cancel := context.WithTimeout(ctx, *ttl)
+			defer cancel()
+
+			ctx = c
+		}
+
+		h, err := protocol.Receiver.NegotiateRequest(r)
+
+		if err != nil {
+			b.Logger.Printf("Refusing SSE client %s, %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Subscribe before replaying so that no events are missed in between
+
+		sub := newSubscription(b, replay, h)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// https://stackoverflow.com/questions/27898622/server-sent-events-stopped-work-after-enabling-ssl-on-proxy
+		// https://www.nginx.com/resources/wiki/start/topics/examples/x-accel/#X-Accel-Buffering
+
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		w.WriteHeader(http.StatusOK)
+
+		b.mu.Lock()
+		retry := b.retry
+		b.mu.Unlock()
+
+		if retry > 0 {
+			fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds())
+		}
+
+		if h.Announced {
+
+			ev, err := sub.Hello()
+
+			if err != nil {
+				b.Logger.Printf("Failed to create hello event, %v", err)
+				return
+			}
+
+			b.writeEvent(w, ev)
+		}
+
+		fl.Flush()
+
+		last_id := r.Header.Get("Last-Event-ID")
+
+		if last_id != "" {
+
+			events, err := sub.Replay(ctx, last_id)
+
+			if err != nil {
+
+				if !errors.Is(err, ErrEventsExpired) {
+					b.Logger.Printf("Failed to replay SSE events after '%s', %v", last_id, err)
+				} else {
+
+					// Tell the client to discard its state and update its last event ID so that it
+					// doesn't ask for the same (missing) events the next time it reconnects
+
+					b.Logger.Printf("Unable to replay SSE events to %s, sending reset, %v", r.RemoteAddr, err)
+
+					err = b.writeReset(w, sub)
+
+					if err != nil {
+						b.Logger.Printf("Failed to write reset event, %v", err)
+					}
+
+					fl.Flush()
+				}
+			}
+
+			for _, ev := range events {
+				b.writeEvent(w, ev)
+			}
+
+			if len(events) > 0 {
+				b.Logger.Printf("Replayed %d SSE events after '%s' to %s", len(events), last_id, r.RemoteAddr)
+				fl.Flush()
+			}
+		}
+
+		for {
+
+			ev, err := sub.Next(ctx)
+
+			if err != nil {
+				return
+			}
+
+			b.writeEvent(w, ev)
+			fl.Flush()
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// writeReset writes the "reset" message for 'sub' to 'w'. Its identifier is always written, even if it is empty, since
+// an empty identifier causes clients to stop sending a "Last-Event-ID" header.
+func (b *roomBroker) writeReset(w http.ResponseWriter, sub *Subscription) error {
+
+	ev, err := sub.Reset()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "id: %s\n", ev.ID)
+
+	ev = &Event{
+		Data: ev.Data,
+	}
+
+	b.writeEvent(w, ev)
+	return nil
+}
+
+// writeEvent writes 'ev' to 'w' using the SSE wire format. If the room uses named events the message's type is written
+// as the "event:" field, its data as the "data:" field and its acknowledgement ID, if present, as part of the "id:"
+// field (see `eventID`). Otherwise the entire message is written as the "data:" field.
+func (b *roomBroker) writeEvent(w http.ResponseWriter, ev *Event) {
+
+	b.mu.Lock()
+	named_events := b.named_events
+	b.mu.Unlock()
+
+	id := ev.ID
+	name := ""
+	data := ev.Data
+
+	write_id := id != ""
+
+	if named_events {
+
+		n, d, ack_id, relayed, err := namedEvent(ev.Data)
+
+		if err != nil {
+			b.Logger.Printf("Failed to derive named event, writing message instead, %v", err)
+		} else {
+
+			id = eventID(ev.ID, ack_id)
+			name = n
+			data = d
+
+			// Clients report the most recent "id:" field they were sent with every event that follows it, so
+			// it is always written for messages relayed from controllers, even if it is empty, in order that
+			// receivers never mistake the acknowledgement ID of an earlier message for that of the current one.
+
+			write_id = write_id || relayed
+		}
+	}
+
+	if write_id {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+
+	if name != "" {
+		fmt.Fprintf(w, "event: %s\n", name)
+	}
+
+	for _, ln := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", ln)
+	}
+
+	fmt.Fprintf(w, "\n")
+}
+
+// namedEvent returns the name (the message type), data and acknowledgement ID for the encoded `SSEMessage` 'str_msg',
+// and a boolean value indicating whether the message was relayed from a controller. The data is returned as-is so that
+// the "data:" field carries only the message payload. The acknowledgement ID is written as part of the "id:" field
+// instead, see `eventID`.
+func namedEvent(str_msg string) (string, string, string, bool, error) {
+
+	var msg struct {
+		Type    string          `json:"type"`
+		Data    json.RawMessage `json:"data"`
+		ID      string          `json:"id"`
+		Version int             `json:"version"`
+	}
+
+	err := json.Unmarshal([]byte(str_msg), &msg)
+
+	if err != nil {
+		return "", "", "", false, fmt.Errorf("Failed to decode message, %w", err)
+	}
+
+	if msg.Type == "" || strings.ContainsAny(msg.Type, "\r\n") {
+		return "", "", "", false, fmt.Errorf("Invalid message type '%s'", msg.Type)
+	}
+
+	if strings.ContainsAny(msg.ID, "\r\n") {
+		return "", "", "", false, fmt.Errorf("Invalid message ID '%s'", msg.ID)
+	}
+
+	data := msg.Data
+
+	if len(data) == 0 {
+		data = json.RawMessage("null")
+	}
+
+	// Only messages relayed from controllers have a version, see NewMessageFromUpdate
+
+	return msg.Type, string(data), msg.ID, msg.Version != 0, nil
+}
+
+// eventID returns the "id:" field for a named event whose identifier is 'id' and whose acknowledgement ID is 'ack_id'.
+// If 'ack_id' is not empty it is appended to 'id' using `AcknowledgementIDSeparator`.
+func eventID(id string, ack_id string) string {
+
+	if ack_id == "" {
+		return id
+	}
+
+	return id + AcknowledgementIDSeparator + ack_id
+}
+
+// TrimAcknowledgementID returns the event identifier 'id', sent by a client as its "Last-Event-ID" header, without
+// the acknowledgement ID appended to it by rooms which use named events.
+func TrimAcknowledgementID(id string) string {
+
+	id, _, _ = strings.Cut(id, AcknowledgementIDSeparator)
+	return id
+}
@@ -0,0 +1,291 @@
+package sse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoomBrokerReplayHistory(t *testing.T) {
+
+	epoch := "test"
+
+	tests := []struct {
+		name        string
+		buffer_size int
+		dispatched  int
+		last_id     string
+		expected    []int64
+		expired     bool
+	}{
+		{
+			name:        "no missed events",
+			buffer_size: 4,
+			dispatched:  3,
+			last_id:     "test-3",
+			expected:    []int64{},
+		},
+		{
+			name:        "without wraparound",
+			buffer_size: 4,
+			dispatched:  3,
+			last_id:     "test-1",
+			expected:    []int64{2, 3},
+		},
+		{
+			name:        "from the start",
+			buffer_size: 4,
+			dispatched:  3,
+			last_id:     "test-0",
+			expected:    []int64{1, 2, 3},
+		},
+		{
+			name:        "wraparound",
+			buffer_size: 4,
+			dispatched:  10,
+			last_id:     "test-7",
+			expected:    []int64{8, 9, 10},
+		},
+		{
+			name:        "exact-size gap",
+			buffer_size: 4,
+			dispatched:  10,
+			last_id:     "test-6",
+			expected:    []int64{7, 8, 9, 10},
+		},
+		{
+			name:        "size+1 gap",
+			buffer_size: 4,
+			dispatched:  10,
+			last_id:     "test-5",
+			expired:     true,
+		},
+		{
+			name:        "foreign epoch",
+			buffer_size: 4,
+			dispatched:  10,
+			last_id:     "other-9",
+			expired:     true,
+		},
+		{
+			name:        "future sequence",
+			buffer_size: 4,
+			dispatched:  10,
+			last_id:     "test-11",
+			expired:     true,
+		},
+		{
+			name:        "invalid sequence",
+			buffer_size: 4,
+			dispatched:  10,
+			last_id:     "test-nine",
+			expired:     true,
+		},
+		{
+			name:        "replay disabled",
+			buffer_size: 0,
+			dispatched:  10,
+			last_id:     "test-9",
+			expired:     true,
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			b := newRoomBroker("default", epoch)
+			b.setBufferSize(tt.buffer_size)
+
+			for i := 1; i <= tt.dispatched; i++ {
+				b.dispatch(&Event{Data: fmt.Sprintf("%d", i)})
+			}
+
+			events, err := b.replayHistory(tt.last_id)
+
+			if tt.expired {
+
+				if !errors.Is(err, ErrEventsExpired) {
+					t.Fatalf("Expected ErrEventsExpired for '%s', got %v", tt.last_id, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Failed to replay events after '%s', %v", tt.last_id, err)
+			}
+
+			if len(events) != len(tt.expected) {
+				t.Fatalf("Expected %d events after '%s', got %d", len(tt.expected), tt.last_id, len(events))
+			}
+
+			for i, seq := range tt.expected {
+
+				expected_id := fmt.Sprintf("%s-%d", epoch, seq)
+				expected_data := fmt.Sprintf("%d", seq)
+
+				if events[i].ID != expected_id || events[i].Data != expected_data {
+					t.Fatalf("Expected event %d to be '%s' (%s), got '%s' (%s)", i, expected_data, expected_id, events[i].Data, events[i].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestRoomBrokerDispatch(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		buffer_size int
+		event       *Event
+		expected_id string
+	}{
+		{
+			name:        "numbered",
+			buffer_size: 4,
+			event:       &Event{Data: "a"},
+			expected_id: "test-1",
+		},
+		{
+			name:        "existing identifier",
+			buffer_size: 4,
+			event:       &Event{ID: "1-0", Data: "a"},
+			expected_id: "1-0",
+		},
+		{
+			name:        "replay disabled",
+			buffer_size: 0,
+			event:       &Event{Data: "a"},
+			expected_id: "",
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			b := newRoomBroker("default", "test")
+			b.setBufferSize(tt.buffer_size)
+
+			c := b.subscribe()
+			defer b.unsubscribe(c)
+
+			b.dispatch(tt.event)
+
+			select {
+			case ev := <-c.events:
+
+				if ev.ID != tt.expected_id || ev.Data != tt.event.Data {
+					t.Fatalf("Expected '%s' (%s), got '%s' (%s)", tt.event.Data, tt.expected_id, ev.Data, ev.ID)
+				}
+
+			default:
+				t.Fatalf("Event was not dispatched to client")
+			}
+
+			if b.lastID() != tt.expected_id {
+				t.Fatalf("Expected last ID to be '%s', got '%s'", tt.expected_id, b.lastID())
+			}
+		})
+	}
+}
+
+func TestRoomBrokerDispatchSlowClient(t *testing.T) {
+
+	b := newRoomBroker("default", "test")
+	b.setBufferSize(4)
+	b.Logger = log.New(io.Discard, "", 0)
+
+	c := b.subscribe()
+
+	// Clients whose buffers are full are disconnected rather than blocking other clients
+
+	for i := 0; i <= clientBufferSize; i++ {
+		b.dispatch(&Event{Data: fmt.Sprintf("%d", i)})
+	}
+
+	select {
+	case <-c.dropped:
+		// pass
+	default:
+		t.Fatalf("Expected slow client to be disconnected")
+	}
+}
+
+func TestRoomBrokerWriteEvent(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		named_events bool
+		event        *Event
+		expected     string
+	}{
+		{
+			name:         "message",
+			named_events: false,
+			event:        &Event{ID: "test-1", Data: `{"type":"update","data":{"body":"hi"},"room":"default","version":1}`},
+			expected:     "id: test-1\ndata: {\"type\":\"update\",\"data\":{\"body\":\"hi\"},\"room\":\"default\",\"version\":1}\n\n",
+		},
+		{
+			name:         "named event without acknowledgement ID",
+			named_events: true,
+			event:        &Event{ID: "test-1", Data: `{"type":"update","data":{"body":"hi"},"room":"default","version":1}`},
+			expected:     "id: test-1\nevent: update\ndata: {\"body\":\"hi\"}\n\n",
+		},
+		{
+			name:         "named event with acknowledgement ID",
+			named_events: true,
+			event:        &Event{ID: "test-1", Data: `{"type":"update","data":{"body":"hi"},"room":"default","id":"m1","version":1}`},
+			expected:     "id: test-1#m1\nevent: update\ndata: {\"body\":\"hi\"}\n\n",
+		},
+		{
+			name:         "unnumbered named event without acknowledgement ID",
+			named_events: true,
+			event:        &Event{Data: `{"type":"update","data":{"body":"hi"},"room":"default","version":1}`},
+			expected:     "id: \nevent: update\ndata: {\"body\":\"hi\"}\n\n",
+		},
+		{
+			name:         "named server event",
+			named_events: true,
+			event:        &Event{Data: `{"type":"hideCode","data":null,"room":"default"}`},
+			expected:     "event: hideCode\ndata: null\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			b := newRoomBroker("default", "test")
+			b.setFormat(tt.named_events, 0)
+
+			rsp := httptest.NewRecorder()
+			b.writeEvent(rsp, tt.event)
+
+			if rsp.Body.String() != tt.expected {
+				t.Fatalf("Expected %q, got %q", tt.expected, rsp.Body.String())
+			}
+		})
+	}
+}
+
+func TestTrimAcknowledgementID(t *testing.T) {
+
+	tests := map[string]string{
+		"test-1":    "test-1",
+		"test-1#m1": "test-1",
+		"#m1":       "",
+		"":          "",
+	}
+
+	for id, expected := range tests {
+
+		if TrimAcknowledgementID(id) != expected {
+			t.Fatalf("Expected '%s' to be trimmed to '%s', got '%s'", id, expected, TrimAcknowledgementID(id))
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/sfomuseum/go-pubsub/publisher"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
 	"github.com/sfomuseum/www-multiscreen-starter/ws"
 	_ "log"
 )
@@ -13,6 +14,13 @@ import (
 type SSEMessage struct {
 	Type string      `json:"type"` // make this an iota
 	Data interface{} `json:"data"`
+	// The name of the room (installation) the message should be delivered to.
+	Room string `json:"room,omitempty"`
+	// An optional unique identifier for the message which receivers should include when acknowledging it.
+	ID string `json:"id,omitempty"`
+	// The version of the protocol that the shape of `Data` corresponds to. If 0 the data is the same in all versions
+	// of the protocol. Messages are adapted to the version spoken by each receiver when they are delivered.
+	Version int `json:"version,omitempty"`
 }
 
 // Publish a message to a publisher.Publisher instance.
@@ -29,27 +37,161 @@ func (msg *SSEMessage) Publish(ctx context.Context, p publisher.Publisher) error
 	return p.Publish(ctx, str_msg)
 }
 
-// Create a new SSE message for updating the current access code.
-func NewAccessCodeMessage(data interface{}) *SSEMessage {
+// Create a new SSE message for updating the current access code in 'room'.
+func NewAccessCodeMessage(room string, data interface{}) *SSEMessage {
 
 	msg := &SSEMessage{
 		Type: "showCode",
 		Data: data,
+		Room: room,
 	}
 
 	return msg
 }
 
-// Create a new SSE message to indicate that the QR (access) code should be hidden.
-func NewHideCodeMessage() *SSEMessage {
+// Create a new SSE message to indicate that the QR (access) code in 'room' should be hidden.
+func NewHideCodeMessage(room string) *SSEMessage {
 
 	msg := &SSEMessage{
 		Type: "hideCode",
+		Room: room,
 	}
 
 	return msg
 }
 
+// Create a new SSE message to indicate that the active controller in 'room' has changed. 'controller' is the ID
+// of the active controller, or an empty string if there is none, and 'waiting' is the number of controllers waiting
+// in the queue.
+func NewControllerChangedMessage(room string, controller string, waiting int) *SSEMessage {
+
+	msg := &SSEMessage{
+		Type: "controllerChanged",
+		Data: map[string]interface{}{
+			"controller": controller,
+			"waiting":    waiting,
+		},
+		Room: room,
+	}
+
+	return msg
+}
+
+// Create a new SSE message to indicate that controller 'controller' has connected to 'room' with a valid access code.
+func NewControllerConnectedMessage(room string, controller string) *SSEMessage {
+	return newControllerEventMessage("controllerConnected", room, controller)
+}
+
+// Create a new SSE message to indicate that controller 'controller' in 'room' has not sent any messages recently.
+func NewControllerIdleMessage(room string, controller string) *SSEMessage {
+	return newControllerEventMessage("controllerIdle", room, controller)
+}
+
+// Create a new SSE message to indicate that controller 'controller' has disconnected from 'room'.
+func NewControllerDisconnectedMessage(room string, controller string) *SSEMessage {
+	return newControllerEventMessage("controllerDisconnected", room, controller)
+}
+
+// Create a new SSE message to indicate that the access code used by controller 'controller' in 'room' has expired.
+func NewCodeExpiredMessage(room string, controller string, code string) *SSEMessage {
+
+	msg := &SSEMessage{
+		Type: "codeExpired",
+		Data: map[string]interface{}{
+			"controller": controller,
+			"code":       code,
+		},
+		Room: room,
+	}
+
+	return msg
+}
+
+func newControllerEventMessage(event string, room string, controller string) *SSEMessage {
+
+	msg := &SSEMessage{
+		Type: event,
+		Data: map[string]interface{}{
+			"controller": controller,
+		},
+		Room: room,
+	}
+
+	return msg
+}
+
+// InvalidateCodesMessageType is the type of messages used to notify other server instances that the access codes for
+// a room have been modified. These messages are used internally and are not dispatched to receivers.
+const InvalidateCodesMessageType string = "invalidateCodes"
+
+// Create a new SSE message to notify other server instances that the access codes for 'room' have been modified.
+// 'origin' is the unique identifier of the server instance that modified the access codes.
+func NewInvalidateCodesMessage(room string, origin string) *SSEMessage {
+
+	msg := &SSEMessage{
+		Type: InvalidateCodesMessageType,
+		Data: map[string]interface{}{
+			"origin": origin,
+		},
+		Room: room,
+	}
+
+	return msg
+}
+
+// ResetMessageType is the type of messages sent to SSE clients which reconnect after missing more messages than can be
+// replayed. Clients should discard any state derived from earlier messages, for example by requesting the current access code.
+const ResetMessageType string = "reset"
+
+// Create a new SSE message to indicate that messages for 'room' were missed and can not be replayed.
+func NewResetMessage(room string) *SSEMessage {
+
+	msg := &SSEMessage{
+		Type: ResetMessageType,
+		Room: room,
+	}
+
+	return msg
+}
+
+// HelloMessageType is the type of messages sent to receivers which announce a protocol version when they connect.
+const HelloMessageType string = "hello"
+
+// Create a new SSE message containing the protocol version and capabilities agreed with a receiver in 'room'.
+func NewHelloMessage(room string, h *protocol.Handshake) *SSEMessage {
+
+	msg := &SSEMessage{
+		Type: HelloMessageType,
+		Data: h,
+		Room: room,
+	}
+
+	return msg
+}
+
+// The types of the messages created by the server itself. Controllers may not relay messages of these types since
+// receivers would mistake them for the server's own messages. "message" is the name of the default SSE event.
+var reservedMessageTypes = map[string]bool{
+	"showCode":                 true,
+	"hideCode":                 true,
+	"controllerChanged":        true,
+	"controllerConnected":      true,
+	"controllerIdle":           true,
+	"controllerDisconnected":   true,
+	"codeExpired":              true,
+	InvalidateCodesMessageType: true,
+	ResetMessageType:           true,
+	HelloMessageType:           true,
+	"ping":                     true,
+	"message":                  true,
+}
+
+// IsReservedMessageType returns a boolean value indicating whether 'msg_type' is the type of a message created by the
+// server, which controllers may not relay.
+func IsReservedMessageType(msg_type string) bool {
+	return reservedMessageTypes[msg_type]
+}
+
 // Empty "ping"-style message to send clients in order to prevent
 // AWS ELB connection timeouts (generally 60 seconds)
 func NewPingMessage() *SSEMessage {
@@ -61,16 +203,21 @@ func NewPingMessage() *SSEMessage {
 	return msg
 }
 
-// Create a new SSE message for a ws.UpdateMessage instance (messages sent by the web application over a WebSocket connection).
-func NewMessageFromUpdate(update *ws.UpdateMessage) *SSEMessage {
+// Create a new SSE message for a ws.UpdateMessage instance (messages sent by the web application over a WebSocket connection) to be delivered to 'room'.
+func NewMessageFromUpdate(room string, update *ws.UpdateMessage) *SSEMessage {
 
 	msg := &SSEMessage{
 		Type: update.Type,
 		// Note that this used to be just Data: updateBody
 		// but because of the way that SSE messages are being
 		// decoded in ios-multiscreen-starter it is necessary to
-		// pass a dictionary.
-		Data: map[string]interface{}{"body": update.Body},
+		// pass a dictionary. Receivers which speak version 2 (or
+		// higher) of the protocol are sent the body itself, see
+		// adaptEvent.
+		Data:    map[string]interface{}{"body": update.Body},
+		Room:    room,
+		ID:      update.ID,
+		Version: protocol.Version1,
 	}
 
 	return msg
@@ -0,0 +1,148 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sfomuseum/www-multiscreen-starter/protocol"
+)
+
+// ErrSubscriptionDropped is returned by `Subscription.Next` when the subscription was disconnected because it was
+// not keeping up with the messages dispatched to its room. Clients should reconnect and replay the messages they missed.
+var ErrSubscriptionDropped = errors.New("Subscription was dropped")
+
+// type Subscription is a struct representing a single client receiving the messages dispatched to a room. It is used
+// by the SSE handlers returned by `RoomsBroker` and by other transports (for example WebSockets) which deliver the same
+// messages to receivers. Events are adapted to the protocol version and capabilities agreed with the client.
+type Subscription struct {
+	broker *roomBroker
+	client *roomClient
+	replay ReplayFunc
+	// The protocol version and capabilities agreed with the client. If nil events are returned unchanged.
+	handshake *protocol.Handshake
+	// The identifiers of replayed events which should not be returned again by the `Next` method.
+	replayed map[string]bool
+}
+
+func newSubscription(b *roomBroker, replay ReplayFunc, h *protocol.Handshake) *Subscription {
+
+	s := &Subscription{
+		broker:    b,
+		client:    b.subscribe(),
+		replay:    replay,
+		handshake: h,
+		replayed:  make(map[string]bool),
+	}
+
+	return s
+}
+
+// Replay returns the events dispatched to the subscription's room after the event whose identifier is 'last_id',
+// oldest first, excluding those the client does not support. Any acknowledgement ID appended to 'last_id' by rooms
+// which use named events is ignored. Replayed events are not returned again by the `Next` method. If the events can not be replayed an
+// error wrapping `ErrEventsExpired` is returned and clients should be sent the event returned by the `Reset` method.
+func (s *Subscription) Replay(ctx context.Context, last_id string) ([]*Event, error) {
+
+	if s.replay == nil {
+		return nil, ErrEventsExpired
+	}
+
+	events, err := s.replay(ctx, TrimAcknowledgementID(last_id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	adapted := make([]*Event, 0)
+
+	for _, ev := range events {
+
+		s.replayed[ev.ID] = true
+
+		ev, ok := adaptEvent(ev, s.handshake)
+
+		if ok {
+			adapted = append(adapted, ev)
+		}
+	}
+
+	return adapted, nil
+}
+
+// Hello returns an event containing a "hello" message with the protocol version and capabilities agreed with the
+// client. It should be sent to clients which announced a protocol version before any other events. The event does not
+// have an identifier so that it does not change the last event ID of the client.
+func (s *Subscription) Hello() (*Event, error) {
+
+	if s.handshake == nil {
+		return nil, fmt.Errorf("Subscription does not have a handshake")
+	}
+
+	msg := NewHelloMessage(s.broker.room, s.handshake)
+
+	enc_msg, err := json.Marshal(msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &Event{
+		Data: string(enc_msg),
+	}
+
+	return ev, nil
+}
+
+// Reset returns an event containing a "reset" message whose identifier is that of the most recently dispatched event.
+// If no events have been dispatched the identifier is empty.
+func (s *Subscription) Reset() (*Event, error) {
+
+	msg := NewResetMessage(s.broker.room)
+
+	enc_msg, err := json.Marshal(msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &Event{
+		ID:   s.broker.lastID(),
+		Data: string(enc_msg),
+	}
+
+	return ev, nil
+}
+
+// Next blocks until the next event, which the client supports, is dispatched to the subscription's room and returns it. If 'ctx' is cancelled its
+// error is returned. If the subscription was disconnected `ErrSubscriptionDropped` is returned.
+func (s *Subscription) Next(ctx context.Context) (*Event, error) {
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.client.dropped:
+			return nil, ErrSubscriptionDropped
+		case ev := <-s.client.events:
+
+			if s.replayed[ev.ID] {
+				continue
+			}
+
+			ev, ok := adaptEvent(ev, s.handshake)
+
+			if !ok {
+				continue
+			}
+
+			return ev, nil
+		}
+	}
+}
+
+// Close stops the delivery of events to the subscription.
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s.client)
+}
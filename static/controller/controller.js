@@ -4,6 +4,7 @@ window.addEventListener("load", function load(event){
 
     var message_el = document.getElementById("message");
     var feedback_el = document.getElementById("feedback");    
+    var state_el = document.getElementById("state");
     var send_btn = document.getElementById("send");
 
     var feedback = function(msg){
@@ -11,57 +12,315 @@ window.addEventListener("load", function load(event){
 	feedback_el.innerText = msg;
     };
     
-    var ws_url = "ws://" + location.host + "/ws/";
-    
     var params = new URLSearchParams(window.location.search);
     var code = params.get("code");
+    var room = params.get("room");
+
+    if (! room){
+	room = "";
+    }
+    
+    var ws_url = "ws://" + location.host + "/ws/" + encodeURIComponent(room);
+    var relay_url = "/relay/" + encodeURIComponent(room);
     
     // initialize WS stuff
 
     var socker = null;
     var connected = false;
 
+    // Used to assign IDs to messages so that they can be acknowledged by the receiver
+    var message_id = Date.now();
+
+    // Short access codes (for example numeric PINs) may be typed in by hand rather than scanned
+    
+    if (!code){
+	code = window.prompt("Enter the access code displayed on the screen");
+    }
+    
+    if (code){
+	code = code.trim();
+    }
+    
     if (!code){
 	feedback("Missing code");
 	send_btn.setAttribute("disabled", "disabled");
 	return;
     }
-	
-    socket = new WebSocket(ws_url);
-    
-    socket.onopen = function(e){
-	console.log("connected", e);
-	connected = true;
-    };
+
+    // The session token for a one-time access code claimed by this controller. It is stored
+    // so that the controller can continue to use the code if the page is reloaded.
     
-    socket.onclose = function(e){
-	console.log("close");
-	connected = false;
+    var session_key = "session:" + code;
+    var session_token = null;
+
+    try {
+	session_token = sessionStorage.getItem(session_key);
+    } catch (err) {
+	console.log("Failed to read session token", err);
     }
+	
+    // The token used to resume this controller's session if its connection drops, the number
+    // of seconds the server will wait for it to be resumed and when the connection dropped.
     
-    socket.onerror = function(e){
-	feedback("Socket closed");
-	send_btn.setAttribute("disabled", "disabled");	
-	console.log("error", e);
-	// connected = false;
-    }
+    var resume_token = null;
+    var resume_grace = 0;
+    var dropped_at = null;
+
+    // Set when the server has ended the session and there is no point reconnecting
+    var ended = false;
+
+    // Set if a WebSocket connection could not be opened (for example behind a captive portal or a proxy)
+    // in which case messages are POST-ed to the relay endpoint and responses are long-polled instead.
+    var opened = false;
+    var use_http = false;
+    var relay_session = null;
+    var polling = false;
+
+    // The (WebSocket sub)protocol used to ask the server for structured response frames
+    var response_protocol = "multiscreen.v1";
+    
+    var connect = function(){
+	
+	// Ask for structured (JSON) response frames; servers which don't support them send bare strings
+	
+	socket = new WebSocket(ws_url, [ response_protocol ]);
+	
+	socket.onopen = function(e){
+	    console.log("connected", e);
+	    opened = true;
+	    connected = true;
+	    send_btn.removeAttribute("disabled");
+
+	    if (resume_token){
+		socket.send(JSON.stringify({ "type": "resume", "token": resume_token }));
+	    }
+	};
+	
+	socket.onclose = function(e){
+	    console.log("close", e.code, e.reason);
+	    connected = false;
+	    send_btn.setAttribute("disabled", "disabled");
+	    
+	    if (e.reason == "expired"){
+		ended = true;
+		feedback("Code has expired, please scan the new code to reconnect");
+		return;
+	    }
+
+	    if (ended){
+		return;
+	    }
+
+	    if (! opened){
+		console.log("Unable to open WebSocket connection, falling back to HTTP");
+		use_http = true;
+		send_btn.removeAttribute("disabled");
+		return;
+	    }
+	    
+	    if (! dropped_at){
+		dropped_at = Date.now();
+	    }
+	    
+	    if (resume_token && (Date.now() - dropped_at) < (resume_grace * 1000)){
+		feedback("Connection lost, reconnecting...");
+		setTimeout(connect, 1000);
+		return;
+	    }
+	    
+	    feedback("Socket closed");
+	};
+	
+	socket.onerror = function(e){
+	    console.log("error", e);
+	};
+	
+	socket.onmessage = on_message;
+    };
     
-    socket.onmessage = function(rsp){
+    var on_message = function(rsp){
 	
 	var data = rsp['data'];
 	console.log("received", data);
 
-	if (data == "invalid"){
-	    feedback("Invalid");
-	} else if (data == "expired"){
+	// Acknowledgements and state updates from the receiver are sent as JSON-encoded messages
+	
+	if (data.charAt(0) == "{"){
+
+	    try {
+		var msg = JSON.parse(data);
+	    } catch (err) {
+		console.log("Failed to parse message", data, err);
+		return;
+	    }
+
+	    // Structured response frames, see on_response
+
+	    if (msg.status){
+		on_response(msg.type, msg.reason);
+		return;
+	    }
+
+	    if (msg.type == "delivered"){
+		feedback("Message " + msg.id + " delivered");
+	    } else if (msg.type == "failed"){
+		feedback("Message " + msg.id + " failed: " + msg.reason);
+	    } else if (msg.type == "rejected"){
+		feedback("Message rejected: " + msg.reason);
+	    } else if (msg.type == "active"){
+		feedback("It's your turn!");
+	    } else if (msg.type == "queued"){
+		feedback("You are number " + msg.position + " in line");
+	    } else if (msg.type == "ended"){
+		feedback("Your turn has ended (" + msg.reason + ")");
+	    } else if (msg.type == "session"){
+
+		session_token = msg.token;
+
+		try {
+		    sessionStorage.setItem(session_key, session_token);
+		} catch (err) {
+		    console.log("Failed to store session token", err);
+		}
+		
+	    } else if (msg.type == "resumable"){
+		resume_token = msg.token;
+		resume_grace = msg.grace;
+	    } else if (msg.type == "resumed"){
+		// Resume tokens can only be used once so a new token is sent each time a session is resumed
+		resume_token = msg.token;
+		resume_grace = msg.grace;
+		dropped_at = null;
+		feedback("Reconnected");
+	    } else if (msg.type == "resumeFailed"){
+		resume_token = null;
+		dropped_at = null;
+		feedback("Reconnected, but your previous session has ended");
+	    } else if (msg.type == "state"){
+		console.log("Receiver state", msg.body);
+		state_el.innerText = "The receiver has displayed " + msg.body.messages + " messages";
+	    } else {
+		console.log("Unhandled message type", msg.type);
+	    }
+
+	    return;
+	}
+	
+	on_response(data, "");
+    };
+
+    // Responses to the messages sent by this controller are either bare strings or, if the server
+    // supports the response protocol, JSON-encoded dictionaries with "type", "id", "status" and "reason" properties
+
+    var on_response = function(rsp_type, reason){
+
+	if (rsp_type == "invalid"){
+	    feedback((reason) ? "Invalid: " + reason : "Invalid");
+	} else if (rsp_type == "expired"){
 	    feedback("Code has expired");
-	} else if (data == "relay"){
+	} else if (rsp_type == "claimed"){
+	    ended = true;
+	    feedback("Code has already been used by someone else, please scan the new code");
+	    send_btn.setAttribute("disabled", "disabled");
+	} else if (rsp_type == "relay"){
 	    feedback("Message relayed '" + message_el.value + "'");
 	    message_el.value = "";
 	}
-	
     };
 
+    // Long-poll the relay endpoint for the frames that would otherwise be sent over the WebSocket connection
+
+    var poll = function(){
+
+	if (polling || ! relay_session){
+	    return;
+	}
+
+	polling = true;
+
+	fetch(relay_url, { headers: { "X-Relay-Session": relay_session } }).then(function(rsp){
+
+	    if (rsp.status == 404 || rsp.status == 410){
+		relay_session = null;
+		return null;
+	    }
+
+	    if (! rsp.ok){
+		throw new Error(rsp.statusText);
+	    }
+
+	    return rsp.json();
+
+	}).then(function(frames){
+
+	    polling = false;
+
+	    if (! frames){
+		return;
+	    }
+
+	    // Bare text frames are encoded as strings
+
+	    frames.forEach(function(f){
+		on_message({ "data": (typeof(f) == "string") ? f : JSON.stringify(f) });
+	    });
+
+	    if (! ended){
+		poll();
+	    }
+
+	}).catch(function(err){
+	    console.log("Failed to poll for messages", err);
+	    polling = false;
+	    setTimeout(poll, 1000);
+	});
+    };
+
+    var send_http = function(msg){
+
+	var headers = {
+	    "Content-Type": "application/json",
+	    "X-Relay-Protocol": response_protocol,
+	};
+
+	if (relay_session){
+	    headers["X-Relay-Session"] = relay_session;
+	}
+
+	fetch(relay_url, { method: "POST", headers: headers, body: JSON.stringify(msg) }).then(function(rsp){
+
+	    // The session has ended and the message was not handled so start a new session. Any frames
+	    // for the old session that had not been polled for are lost.
+
+	    if (relay_session && (rsp.status == 404 || rsp.status == 410)){
+		relay_session = null;
+		feedback("Relay session ended, starting a new session");
+		send_http(msg);
+		return null;
+	    }
+
+	    if (! rsp.ok){
+		throw new Error(rsp.statusText);
+	    }
+
+	    return rsp.json();
+
+	}).then(function(data){
+
+	    if (! data){
+		return;
+	    }
+
+	    relay_session = data.session;
+	    poll();
+	}).catch(function(err){
+	    console.log("Failed to send message", err);
+	    feedback("Failed to send message");
+	});
+    };
+
+    connect();
+    
     send_btn.onclick = function(){
 
 	var msg = message_el.value;
@@ -73,11 +332,23 @@ window.addEventListener("load", function load(event){
 
 	feedback("");
 	
+	message_id += 1;
+	
 	var update_msg = {
+	    "id": String(message_id),
 	    "type": "update",
 	    "code": code,
 	    "body": msg,
 	};
+
+	if (session_token){
+	    update_msg["token"] = session_token;
+	}
+	
+	if (use_http){
+	    send_http(update_msg);
+	    return false;
+	}
 	
 	socket.send(JSON.stringify(update_msg));
 	return false;
@@ -4,9 +4,66 @@ window.addEventListener("load", function load(event){
     
     var root_url = location.protocol + "//" + location.host;
 
+    // The room (installation) to listen for updates in, for example /receiver/?room=lobby
+    
+    var params = new URLSearchParams(window.location.search);
+    var room = params.get("room");
+
+    if (! room){
+	room = "";
+    }
+
+    // The shared secret (the server's -receiver-secret flag) used to publish state and acknowledge messages,
+    // for example /receiver/?receiver_token=SECRET
+
+    var receiver_token = params.get("receiver_token");
+    
     var sender_url = root_url + "/";
-    var sse_url = root_url + "/sse/";
-    var code_url = root_url + "/code/";
+    var sse_url = root_url + "/sse/" + encodeURIComponent(room);
+    var code_url = root_url + "/code/" + encodeURIComponent(room);
+    var ack_url = root_url + "/ack/" + encodeURIComponent(room);
+    var state_url = root_url + "/state/" + encodeURIComponent(room);
+
+    // Publish the receiver's current state to any controllers in the room
+    
+    var publish_state = function(state){
+
+	var req = new XMLHttpRequest();
+	req.open("POST", state_url, true);
+	req.setRequestHeader("Content-Type", "application/json");
+	req.setRequestHeader("Authorization", "Bearer " + receiver_token);
+	req.send(JSON.stringify(state));
+    };
+
+    // Let the server (and the controller) know whether a message with an ID was handled
+    
+    var ack = function(id, status, reason){
+
+	if (! id){
+	    return;
+	}
+	
+	var req = new XMLHttpRequest();
+	req.open("POST", ack_url, true);
+	req.setRequestHeader("Content-Type", "application/json");
+	req.setRequestHeader("Authorization", "Bearer " + receiver_token);
+	req.send(JSON.stringify({ "id": id, "status": status, "reason": reason }));
+    };
+    
+    // Ask the server to (re) publish the most recent access code
+    
+    var fetch_code = function(){
+
+	var on_load = function(rsp){
+	    console.log("WHAT", rsp);
+	};
+	
+	var req = new XMLHttpRequest();
+	
+	req.addEventListener("load", on_load);
+	req.open("GET", code_url, true);
+	req.send();
+    };
     
     // initialize the map
     
@@ -22,14 +79,7 @@ window.addEventListener("load", function load(event){
 	console.log("SSE error", e);
     };
     
-    ev.onmessage = function(e) {
-
-	try {
-	    var msg = JSON.parse(e.data);
-	} catch (err) {
-	    console.log("Failed to parse message", e.data, err);
-	    return;
-	}
+    var on_message = function(msg) {
 
 	if (msg.type == "update"){
 
@@ -39,12 +89,24 @@ window.addEventListener("load", function load(event){
 	    item.innerText = dt.toLocaleString() + ": " + msg.data.body;
 
 	    messages_el.prepend(item);
+
+	    ack(msg.id, "delivered");
+
+	    publish_state({
+		"messages": messages_el.children.length,
+		"last_message": msg.data.body,
+	    });
 	    
 	} else if (msg.type == "showCode"){
 	    
 	    var code = msg.data;
 
 	    var url = sender_url + "?code=" + encodeURIComponent(msg.data.code);
+
+	    if (room){
+		url = url + "&room=" + encodeURIComponent(room);
+	    }
+	    
 	    console.log("URL", url);
 	    
 	    var qr_el = document.getElementById("qr");
@@ -75,25 +137,95 @@ window.addEventListener("load", function load(event){
 	    url_el.innerHTML = "";
 	    url_el.setAttribute("href", "#");
 	    
+	} else if (msg.type == "controllerConnected"){
+
+	    console.log("Controller connected", msg.data.controller);
+
+	} else if (msg.type == "controllerIdle"){
+
+	    console.log("Controller idle", msg.data.controller);
+	    
+	} else if (msg.type == "controllerDisconnected" || msg.type == "codeExpired"){
+
+	    // Return to "attract" mode by displaying the current access code again
+	    
+	    console.log("Controller left", msg.type, msg.data.controller);
+	    fetch_code();
+	    
+	} else if (msg.type == "reset"){
+
+	    // Messages were missed while reconnecting and could not be replayed so
+	    // fetch the current access code again
+	    
+	    console.log("SSE reset");
+	    fetch_code();
+	    
+	} else if (msg.type == "controllerChanged"){
+
+	    if (msg.data.controller){
+		console.log("Controller changed", msg.data.controller, msg.data.waiting);
+	    } else {
+		console.log("No active controller");
+	    }
+	    
 	} else {
 	    console.log("Unhandled message type", msg.type)
+	    ack(msg.id, "failed", "Unhandled message type");
 	}
 	
-    }
+    };
 
-    // Fetch the most recent access code to display
+    // Messages written to the default "message" event contain the message type and data
+    
+    ev.onmessage = function(e) {
 
-    setTimeout(function(){
+	try {
+	    var msg = JSON.parse(e.data);
+	} catch (err) {
+	    console.log("Failed to parse message", e.data, err);
+	    return;
+	}
 
-	var on_load = function(rsp){
-	    console.log("WHAT", rsp);
-	};
-	
-	var req = new XMLHttpRequest();
-	
-	req.addEventListener("load", on_load);
-	req.open("GET", code_url, true);
-	req.send();
-	
-    }, 500);
+	on_message(msg);
+    };
+
+    // Rooms configured with the -sse-named-event-rooms flag use the message type as the
+    // event name and the event data contains only the message data. The acknowledgement ID
+    // of messages relayed from controllers follows a "#" in the event ID. Clients report the
+    // most recent event ID with every event so it is only read for relayed messages
+    
+    var relayed_events = [
+	"update",
+    ];
+
+    var named_events = [
+	"update", "showCode", "hideCode", "reset",
+	"controllerConnected", "controllerIdle", "controllerDisconnected", "codeExpired", "controllerChanged",
+    ];
+
+    named_events.forEach(function(name){
+
+	ev.addEventListener(name, function(e){
+
+	    try {
+		var data = JSON.parse(e.data);
+	    } catch (err) {
+		console.log("Failed to parse event", name, e.data, err);
+		return;
+	    }
+
+	    var id = undefined;
+	    var idx = e.lastEventId.indexOf("#");
+
+	    if (idx != -1 && relayed_events.indexOf(name) != -1){
+		id = e.lastEventId.substring(idx + 1);
+	    }
+	    
+	    on_message({ "type": name, "data": data, "id": id });
+	});
+    });
+
+    // Fetch the most recent access code to display
+
+    setTimeout(fetch_code, 500);
 });